@@ -0,0 +1,466 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// Errors returned by Analyze, to be tested with errors.Is.
+var (
+	// ErrNoGoMod means the directory to analyze has no go.mod.
+	ErrNoGoMod = errors.New("no go.mod found")
+	// ErrModuleResolution means the module cache, a package or a dependency couldn't be located.
+	ErrModuleResolution = errors.New("module resolution failed")
+)
+
+// ParseError is a file that could not be parsed, or only partially.
+type ParseError struct {
+	File    string
+	Err     error
+	Partial bool // The parser recovered, so what it could read of the file was still analyzed
+}
+
+func (e ParseError) Error() string { return e.Err.Error() }
+
+func (e ParseError) Unwrap() error { return e.Err }
+
+// ParseErrors lists the files that could not be parsed. These files are normally summarized
+// in the log and analyzed as far as they could be parsed; with Options.Strict, Analyze
+// returns them as its error, along with the result, so callers can decide whether that is
+// acceptable.
+type ParseErrors []ParseError
+
+func (e ParseErrors) Error() string {
+	if len(e) == 1 {
+		return fmt.Sprintf("could not parse %s: %v", e[0].File, e[0].Err)
+	}
+	files := make([]string, len(e))
+	for i, pe := range e {
+		files[i] = pe.File
+	}
+	return fmt.Sprintf("could not parse %d files: %s", len(e), strings.Join(files, ", "))
+}
+
+// parseErrors collects the parse failures of the current run, once per file.
+var parseErrors ParseErrors
+
+// recordParseError remembers that filePath failed to parse, ignoring repeats from Pass 2.
+func recordParseError(filePath string, err error, partial bool) {
+	if hasParseError(filePath) {
+		return
+	}
+	parseErrors = append(parseErrors, ParseError{File: filePath, Err: err, Partial: partial})
+}
+
+// hasParseError reports whether filePath failed to parse during this run. The records of
+// such files aren't cached, so the failure is reported again on the next run.
+func hasParseError(filePath string) bool {
+	for _, pe := range parseErrors {
+		if pe.File == filePath {
+			return true
+		}
+	}
+	return false
+}
+
+// logParseErrorSummary prints the files that failed to parse, once all of them are known,
+// rather than interleaving a warning per file with the progress of the passes.
+func logParseErrorSummary(errs ParseErrors) {
+	if len(errs) == 0 {
+		return
+	}
+	partial := 0
+	for _, pe := range errs {
+		if pe.Partial {
+			partial++
+		}
+	}
+	log.Printf("Parse summary: %d files had syntax errors, %d of them analyzed partially", len(errs), partial)
+	for _, pe := range errs {
+		how := "skipped"
+		if pe.Partial {
+			how = "partially analyzed"
+		}
+		log.Printf("  %s (%s): %v", pe.File, how, pe.Err)
+	}
+}
+
+// resetAnalysisState clears everything a previous Analyze call accumulated.
+func resetAnalysisState() {
+	definitions = make(map[string]Definition)
+	mappings = make(map[string]*Mapping)
+	typeDefs = make(map[string]*TypeDef)
+	typeMethods = make(map[string]map[string]bool)
+	interfaceAssertions = nil
+	astCache = make(map[string]*ast.File)
+	initIDs = make(map[string]string)
+	packageImports = make(map[string]map[string]bool)
+	resolution = ResolutionStats{ByReason: make(map[string]int), ByPackage: make(map[string]PackageResolution)}
+	unresolvedCalls = nil
+	parseErrors = nil
+	typesChecker = nil
+	interfaceCalls = nil
+	packageNames = nil
+	valueMappings = make(map[string]*Mapping)
+}
+
+// Analyze runs both passes over the module at o.TargetPath, the other modules of
+// o.ModuleRoots (and of the workspace with o.Workspace) and the dependencies they select,
+// and returns the mappings of every definition that is called. Setup failures wrap
+// ErrNoGoMod or ErrModuleResolution; files that fail to parse only produce an error (of type
+// ParseErrors) when o.Strict is set.
+func Analyze(o Options) (*Result, error) {
+	resetAnalysisState()
+	opts := o
+	timer := newPhaseTimer()
+	if err := opts.resolveGoEnv(); err != nil {
+		return nil, fmt.Errorf("%w: could not auto-detect GOMODCACHE, please specify it with the -gopath flag: %v", ErrModuleResolution, err)
+	}
+
+	mainRoot := opts.TargetPath
+	extraRoots := opts.ModuleRoots
+	if opts.Workspace {
+		workspaceRoots, err := workspaceModules(opts.TargetPath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrModuleResolution, err)
+		}
+		// Without a go.work, only the module at TargetPath is analyzed, as usual.
+		// A workspace root usually isn't a module itself; its first module is then the main one.
+		if _, err := os.Stat(filepath.Join(mainRoot, "go.mod")); os.IsNotExist(err) && len(workspaceRoots) > 0 {
+			mainRoot, workspaceRoots = workspaceRoots[0], workspaceRoots[1:]
+		}
+		extraRoots = append(append([]string(nil), extraRoots...), workspaceRoots...)
+	}
+
+	mainModulePath, err := getModulePath(mainRoot)
+	if err != nil {
+		return nil, fmt.Errorf("finding module path in %s: %w", mainRoot, err)
+	}
+	log.Printf("Analyzing main module: %s\n", mainModulePath)
+
+	// --- Identify all codebases to analyze (local project + dependencies) ---
+	mainGoVersion := goModGoVersion(mainRoot)
+	analysisTargets := []AnalysisTarget{{FSRoot: mainRoot, ModulePath: mainModulePath, GoVersion: mainGoVersion}}
+	if opts.Package != "" {
+		pkgTarget, err := resolvePackageTarget(mainRoot, mainModulePath, opts.Package)
+		if err != nil {
+			return nil, fmt.Errorf("%w: package %s: %v", ErrModuleResolution, opts.Package, err)
+		}
+		pkgTarget.SinglePackage = !opts.Recursive
+		pkgTarget.GoVersion = mainGoVersion
+		log.Printf("Analyzing package %s at %s", pkgTarget.ModulePath, pkgTarget.FSRoot)
+		analysisTargets[0] = pkgTarget
+	}
+	roots := []string{mainRoot}
+	for _, root := range extraRoots {
+		if slices.ContainsFunc(roots, func(r string) bool { return sameDir(r, root) }) {
+			continue
+		}
+		modulePath, err := getModulePath(root)
+		if err != nil {
+			return nil, fmt.Errorf("finding module path in %s: %w", root, err)
+		}
+		for _, target := range analysisTargets {
+			if target.ModulePath == modulePath {
+				return nil, fmt.Errorf("%w: %s and %s are both module %s", ErrModuleResolution, target.FSRoot, root, modulePath)
+			}
+		}
+		log.Printf("Analyzing module: %s (%s)", modulePath, root)
+		roots = append(roots, root)
+		analysisTargets = append(analysisTargets, AnalysisTarget{FSRoot: root, ModulePath: modulePath, GoVersion: goModGoVersion(root)})
+	}
+	if len(opts.AnalyzeDeps) > 0 {
+		log.Printf("Finding specified dependencies to analyze: %v", opts.AnalyzeDeps)
+		analyzed := make(map[string]bool)
+		for _, target := range analysisTargets {
+			analyzed[target.ModulePath] = true
+		}
+		// Each root selects its own dependencies; a module required by several roots, or
+		// that is itself one of the roots, is analyzed once.
+		for _, root := range roots {
+			dependencyTargets, err := findDependencyPaths(root, opts.GoModCache, opts.AnalyzeDeps, opts.DepDepth)
+			if err != nil {
+				return nil, fmt.Errorf("%w: dependency paths: %v", ErrModuleResolution, err)
+			}
+			for _, dep := range dependencyTargets {
+				if !analyzed[dep.ModulePath] {
+					analyzed[dep.ModulePath] = true
+					analysisTargets = append(analysisTargets, dep)
+				}
+			}
+		}
+	}
+
+	for i := range analysisTargets {
+		analysisTargets[i].FileSet = token.NewFileSet()
+		analysisTargets[i].NestedRoots = nestedRoots(analysisTargets[i], analysisTargets)
+	}
+
+	if opts.ResolvePkgNames {
+		packageNames = newPackageNameResolver(analysisTargets, opts.BuildContext)
+	}
+	state := &passState{opts: &opts, typeDefs: typeDefs, packageNames: packageNames}
+	for i := range analysisTargets {
+		analysisTargets[i].state = state
+	}
+	timer.done("dependencies")
+
+	// --- Run Analysis Passes ---
+	if opts.DefIndexIn != "" {
+		log.Printf("Pass 1: Loading definition index from %s...", opts.DefIndexIn)
+		if err := loadDefinitionIndex(opts.DefIndexIn); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Println("Pass 1: Finding all function definitions...")
+		progress.StartPhase("definitions")
+		for _, target := range analysisTargets {
+			log.Printf("Scanning definitions in %s (%s)", target.ModulePath, target.FSRoot)
+			if err := walkAndProcess(target, definitionsPass); err != nil {
+				return nil, fmt.Errorf("definition scan in %s: %w", target.FSRoot, err)
+			}
+		}
+		computeTypeStats()
+		linkConstructors()
+	}
+	numberInitFunctions()
+	timer.done("pass1")
+
+	if opts.DefIndexOut != "" {
+		if err := writeDefinitionIndex(opts.DefIndexOut); err != nil {
+			return nil, fmt.Errorf("writing definition index: %w", err)
+		}
+		log.Printf("Successfully created definition index: %s", opts.DefIndexOut)
+	}
+
+	log.Println("Pass 2: Finding all call sites...")
+	progress.StartPhase("call sites")
+	if opts.TypeCheck {
+		typesChecker = newTypeChecker(analysisTargets, opts.BuildContext)
+	}
+	for _, target := range analysisTargets {
+		log.Printf("Scanning call sites in %s (%s)", target.ModulePath, target.FSRoot)
+		if err := walkAndProcess(target, callSitesPass); err != nil {
+			return nil, fmt.Errorf("call site scan in %s: %w", target.FSRoot, err)
+		}
+	}
+	if typesChecker != nil {
+		typesChecker.refineImplementations()
+	}
+	if opts.ResolveInterfaces {
+		resolveInterfaceCalls(&opts)
+	}
+	typesChecker = nil
+	timer.done("pass2")
+	logParseErrorSummary(parseErrors)
+	logResolutionSummary(resolution, opts.TypeCheck)
+	if opts.WarnDeprecated {
+		logDeprecatedCalls(mappings)
+	}
+	kinds, packageKinds := countKinds(definitions)
+	log.Printf("Definitions: %d functions, %d methods, %d constructors", kinds.Functions, kinds.Methods, kinds.Constructors)
+	if opts.IncludeTests {
+		tested, total := testedDefinitions(mappings)
+		log.Printf("Tests: %d of %d definitions outside test files are called from a test file", tested, total)
+	}
+	if !opts.PerPackageKinds {
+		packageKinds = nil
+	}
+
+	var impact *Impact
+	var impacted map[string]bool
+	if opts.ImpactBase != "" {
+		// The first target is the main module (or the -package selection); dependencies
+		// aren't part of the repository being diffed.
+		changes, err := changedLines(analysisTargets[0].FSRoot, opts.ImpactBase, opts.ImpactHead)
+		if err != nil {
+			return nil, fmt.Errorf("computing changes for -impact-base: %w", err)
+		}
+		impact = &Impact{Base: opts.ImpactBase, Head: opts.ImpactHead, Changed: changedDefinitions(analysisTargets[0], changes)}
+		for _, id := range impact.Changed {
+			log.Printf("Changed %s, reached by %d functions", id, len(impactSet([]string{id}, mappings))-1)
+		}
+		impacted = impactSet(impact.Changed, mappings)
+		impact.Impacted = len(impacted)
+		log.Printf("Impact: %d changed definitions, %d definitions affected", len(impact.Changed), impact.Impacted)
+	}
+
+	var focused map[string]bool
+	if opts.Focus != "" {
+		focused = focusSet(opts.Focus, mappings)
+		log.Printf("Focus: keeping %d definitions of %s and their direct callers", len(focused), opts.Focus)
+	}
+
+	// The call sites are sorted first, so that the ones -focus filters into new slices are too.
+	for _, m := range mappings {
+		sortCallSites(m.CallSites)
+	}
+	finalMappings := []Mapping{}
+	// <<< CHANGED: Filter out mappings that have no call sites.
+	for _, m := range mappings {
+		if focused != nil {
+			if !focused[m.Definition.ID] {
+				continue
+			}
+			kept := *m
+			if !inPackageTree(m.Definition.Package, opts.Focus) {
+				// A caller outside the focus keeps only the calls from the kept definitions.
+				kept.CallSites = []CallSite{}
+				for _, cs := range m.CallSites {
+					if focused[cs.CallerID] {
+						kept.CallSites = append(kept.CallSites, cs)
+					}
+				}
+			}
+			countCalls(&kept)
+			finalMappings = append(finalMappings, kept)
+			continue
+		}
+		if impacted != nil {
+			// In impact mode the subgraph is what matters, including changed definitions
+			// and entry points that nothing calls.
+			if impacted[m.Definition.ID] {
+				countCalls(m)
+				finalMappings = append(finalMappings, *m)
+			}
+			continue
+		}
+		if len(m.CallSites) > 0 {
+			countCalls(m)
+			finalMappings = append(finalMappings, *m)
+		}
+	}
+
+	// Maps are ranged over in random order; sorting keeps the output identical between runs.
+	sort.Slice(finalMappings, func(i, j int) bool { return finalMappings[i].Definition.ID < finalMappings[j].Definition.ID })
+	sort.SliceStable(unresolvedCalls, func(i, j int) bool {
+		a, b := unresolvedCalls[i], unresolvedCalls[j]
+		if a.FilePath != b.FilePath {
+			return a.FilePath < b.FilePath
+		}
+		return a.Line < b.Line
+	})
+
+	result := &Result{
+		Mappings:    finalMappings,
+		Definitions: definitions,
+		Types:       sortedTypeDefs(),
+		Imports:     packageImports,
+		Metadata:    Metadata{Targets: analysisTargets, Resolution: resolution, Kinds: kinds, PackageKinds: packageKinds, Impact: impact},
+		Options:     &opts,
+		Timings:     timer.timings,
+		passes:      state,
+		index:       mappings,
+		values:      valueMappings,
+		unresolved:  unresolvedCalls,
+	}
+	if opts.Strict && len(parseErrors) > 0 {
+		return result, parseErrors
+	}
+	return result, nil
+}
+
+// testedDefinitions counts the definitions of non-test files, and those among them called
+// directly from a _test.go file, with -include-tests.
+func testedDefinitions(mappings map[string]*Mapping) (tested, total int) {
+	for _, m := range mappings {
+		if m.Definition.TestFile {
+			continue
+		}
+		total++
+		for _, cs := range m.CallSites {
+			if strings.HasSuffix(cs.FilePath, "_test.go") {
+				tested++
+				break
+			}
+		}
+	}
+	return tested, total
+}
+
+// focusSet returns the IDs of the called definitions of the packages in the focus tree,
+// for -focus, along with the definitions calling them directly from any package.
+func focusSet(focus string, mappings map[string]*Mapping) map[string]bool {
+	set := make(map[string]bool)
+	for id, m := range mappings {
+		if len(m.CallSites) == 0 || !inPackageTree(m.Definition.Package, focus) {
+			continue
+		}
+		set[id] = true
+		for _, cs := range m.CallSites {
+			if _, ok := mappings[cs.CallerID]; ok {
+				set[cs.CallerID] = true
+			}
+		}
+	}
+	return set
+}
+
+// inPackageTree reports whether the import path pkg is root or one of the packages below it.
+func inPackageTree(pkg, root string) bool {
+	return pkg == root || strings.HasPrefix(pkg, strings.TrimSuffix(root, "/")+"/")
+}
+
+// workspaceModules returns the directories of the modules listed by the use directives of
+// the go.work file in dir, or nothing when dir has no go.work.
+func workspaceModules(dir string) ([]string, error) {
+	workPath := filepath.Join(dir, "go.work")
+	content, err := os.ReadFile(workPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read go.work in '%s': %w", dir, err)
+	}
+	workFile, err := modfile.ParseWork(workPath, content, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse go.work: %w", err)
+	}
+	var roots []string
+	for _, use := range workFile.Use {
+		root := filepath.FromSlash(use.Path)
+		if !filepath.IsAbs(root) {
+			root = filepath.Join(dir, root)
+		}
+		roots = append(roots, root)
+	}
+	log.Printf("Found workspace modules in %s: %v", workPath, roots)
+	return roots, nil
+}
+
+// sameDir reports whether two paths name the same directory.
+func sameDir(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// nestedRoots returns the slash-separated paths, relative to target's root, of the other
+// targets below it. A workspace module nested in another one is only walked as itself.
+func nestedRoots(target AnalysisTarget, targets []AnalysisTarget) []string {
+	root, err := filepath.Abs(target.FSRoot)
+	if err != nil {
+		return nil
+	}
+	var nested []string
+	for _, other := range targets {
+		otherRoot, err := filepath.Abs(other.FSRoot)
+		if err != nil || otherRoot == root {
+			continue
+		}
+		if rel, err := filepath.Rel(root, otherRoot); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			nested = append(nested, filepath.ToSlash(rel))
+		}
+	}
+	return nested
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestAnalyzeErrors(t *testing.T) {
+	t.Run("no go.mod", func(t *testing.T) {
+		dir := writeModule(t, map[string]string{"main.go": "package main\n\nfunc main() {}\n"})
+		_, err := Analyze(Options{TargetPath: dir})
+		if !errors.Is(err, ErrNoGoMod) {
+			t.Errorf("got %v, want ErrNoGoMod", err)
+		}
+	})
+
+	t.Run("module resolution", func(t *testing.T) {
+		dir := writeModule(t, map[string]string{
+			"go.mod":  "module example.com/errs\n\ngo 1.23.0\n",
+			"main.go": "package main\n\nfunc main() {}\n",
+		})
+		_, err := Analyze(Options{TargetPath: dir, Package: "example.org/elsewhere"})
+		if !errors.Is(err, ErrModuleResolution) || errors.Is(err, ErrNoGoMod) {
+			t.Errorf("got %v, want ErrModuleResolution", err)
+		}
+	})
+
+	t.Run("parse errors", func(t *testing.T) {
+		dir := writeModule(t, map[string]string{
+			"go.mod":    "module example.com/errs\n\ngo 1.23.0\n",
+			"main.go":   "package main\n\nfunc ok() {}\n\nfunc main() { ok() }\n",
+			"broken.go": "package main\n\nfunc broken( {\n",
+		})
+		result, err := Analyze(Options{TargetPath: dir})
+		if err != nil {
+			t.Fatalf("without -strict, got %v, want no error", err)
+		}
+		if findMapping(result, "example.com/errs.ok") == nil {
+			t.Error("the files that parse weren't analyzed")
+		}
+
+		result, err = Analyze(Options{TargetPath: dir, Strict: true})
+		var parseErrs ParseErrors
+		if !errors.As(err, &parseErrs) {
+			t.Fatalf("with -strict, got %v, want ParseErrors", err)
+		}
+		if len(parseErrs) != 1 || filepath.Base(parseErrs[0].File) != "broken.go" {
+			t.Errorf("got %v, want broken.go alone", parseErrs)
+		}
+		if result == nil || findMapping(result, "example.com/errs.ok") == nil {
+			t.Error("the partial result wasn't returned with the parse errors")
+		}
+		if errors.Is(err, ErrNoGoMod) || errors.Is(err, ErrModuleResolution) {
+			t.Errorf("parse errors were taken for a setup failure: %v", err)
+		}
+	})
+}
+
+func TestReportsReadTheirResult(t *testing.T) {
+	first := analyzeModule(t, writeModule(t, map[string]string{
+		"go.mod":  "module example.com/first\n\ngo 1.21\n",
+		"main.go": "package main\n\nconst Limit = 1\n\nfunc unused() {}\n\nfunc used() int { return Limit }\n\nfunc main() { used() }\n",
+	}), Options{TrackVars: true, Focus: "example.com/first"})
+	// A second run resets the analysis state; the first result's reports must not change.
+	second := analyzeModule(t, writeModule(t, map[string]string{
+		"go.mod":  "module example.com/second\n\ngo 1.21\n",
+		"main.go": "package main\n\nfunc orphan() {}\n\nfunc main() {}\n",
+	}), Options{})
+
+	if dead := deadDefinitions(first, false); len(dead) != 1 || dead[0].ID != "example.com/first.unused" {
+		t.Errorf("dead definitions of the first run = %+v, want only unused", dead)
+	}
+	if dead := deadDefinitions(second, false); len(dead) != 1 || dead[0].ID != "example.com/second.orphan" {
+		t.Errorf("dead definitions of the second run = %+v, want only orphan", dead)
+	}
+	if entries := entryPoints(first); len(entries) != 1 || entries[0].ID != "example.com/first.main" {
+		t.Errorf("entry points of the first run = %+v", entries)
+	}
+	if values := valueReport(first); len(values) != 1 || values[0].CallCount != 1 {
+		t.Errorf("values of the first run = %+v, want Limit referenced once", values)
+	}
+	if failures := checkUsageAssertions(first, []string{"example.com/first.unused"}, []string{"example.com/first.used"}); len(failures) != 0 {
+		t.Errorf("assertions on the first run failed: %v", failures)
+	}
+	if summaries := packageSummaries(first); len(summaries) != 1 || summaries[0].Package != "example.com/first" || summaries[0].Definitions != 3 {
+		t.Errorf("summaries of the first run = %+v", summaries)
+	}
+	if first.Options.Focus != "example.com/first" || second.Options.Focus != "" {
+		t.Errorf("options: first focus %q, second %q", first.Options.Focus, second.Options.Focus)
+	}
+}
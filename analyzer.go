@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Analyzer extracts definitions and call sites from the source files of one language.
+// walkAndProcess hands every file to the first enabled analyzer that matches it. Both passes
+// return a record that is applied to the run's state (and cached), rather than mutating it
+// directly, so an analyzer only has to describe what it found in a single file.
+type Analyzer interface {
+	// Name is the value that enables the analyzer with -lang.
+	Name() string
+	// Match reports whether the analyzer handles the file name in dir in a run with o.
+	Match(dir, name string, o *Options) bool
+	// FindDefinitions scans a file in Pass 1. It returns false when the file can't be read.
+	FindDefinitions(filePath string, target AnalysisTarget) (fileRecord, bool)
+	// FindCallSites scans a file in Pass 2, once every definition is known.
+	FindCallSites(filePath string, target AnalysisTarget) (fileRecord, bool)
+}
+
+// analyzers is the registry of languages selectable with -lang.
+var analyzers = make(map[string]Analyzer)
+
+// defaultLanguages are the analyzers enabled when -lang isn't set.
+var defaultLanguages = []string{"go"}
+
+func init() {
+	RegisterAnalyzer(goAnalyzer{})
+}
+
+// RegisterAnalyzer makes an analyzer available under its name. Registering the same name
+// twice panics.
+func RegisterAnalyzer(a Analyzer) {
+	if _, exists := analyzers[a.Name()]; exists {
+		panic(fmt.Sprintf("analyzer %q registered twice", a.Name()))
+	}
+	analyzers[a.Name()] = a
+}
+
+// analyzerNames lists the registered languages in sorted order.
+func analyzerNames() []string {
+	names := make([]string, 0, len(analyzers))
+	for name := range analyzers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// enabledAnalyzers returns the analyzers for the given language names, or the default ones
+// when there are none.
+func enabledAnalyzers(languages []string) ([]Analyzer, error) {
+	if len(languages) == 0 {
+		languages = defaultLanguages
+	}
+	var enabled []Analyzer
+	for _, name := range languages {
+		a, ok := analyzers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown language %q (available: %v)", name, analyzerNames())
+		}
+		enabled = append(enabled, a)
+	}
+	return enabled, nil
+}
+
+// goAnalyzer is the Go analyzer built on go/parser: .go files, without _test.go files unless
+// -include-tests is set, selected by build constraints when a build context is set.
+type goAnalyzer struct{}
+
+func (goAnalyzer) Name() string { return "go" }
+
+func (goAnalyzer) Match(dir, name string, o *Options) bool {
+	if !strings.HasSuffix(name, ".go") || (strings.HasSuffix(name, "_test.go") && !o.IncludeTests) {
+		return false
+	}
+	if o.BuildContext != nil {
+		match, err := o.BuildContext.MatchFile(dir, name)
+		if err != nil {
+			log.Printf("Warning: could not evaluate build constraints of %s: %v", filepath.Join(dir, name), err)
+		} else if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesDefaultBuild reports whether the build constraints of a dependency's file select it
+// for the platform being built. With -tags or -env, Match has already applied those;
+// otherwise they are those of the host, as `go build` would use.
+func matchesDefaultBuild(dir, name string, o *Options) bool {
+	if o.BuildContext != nil {
+		return true
+	}
+	match, err := build.Default.MatchFile(dir, name)
+	if err != nil {
+		log.Printf("Warning: could not evaluate build constraints of %s: %v", filepath.Join(dir, name), err)
+		return true
+	}
+	return match
+}
+
+func (goAnalyzer) FindDefinitions(filePath string, target AnalysisTarget) (fileRecord, bool) {
+	return findDefinitions(filePath, target)
+}
+
+func (goAnalyzer) FindCallSites(filePath string, target AnalysisTarget) (fileRecord, bool) {
+	return findCallSites(filePath, target)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// archLayers is an ordered chain of package patterns from -arch-rules, top layer first. A
+// package may call its own layer and the layers below it, never the ones above.
+type archLayers []string
+
+// ArchViolation is a call that goes up a chain of layers.
+type ArchViolation struct {
+	CallerID    string
+	CalleeID    string
+	FilePath    string
+	Line        int
+	CallerLayer string
+	CalleeLayer string
+}
+
+func (v ArchViolation) String() string {
+	return fmt.Sprintf("%s -> %s at %s:%d (%s may not call %s)", v.CallerID, v.CalleeID, v.FilePath, v.Line, v.CallerLayer, v.CalleeLayer)
+}
+
+// loadArchRules reads an -arch-rules file. It has the YAML syntax of -config, with a single
+// "layers" key listing chains such as "handlers -> services -> repositories".
+func loadArchRules(path string) ([]archLayers, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseYAMLConfig(content)
+	if err != nil {
+		return nil, err
+	}
+	var chains []archLayers
+	for key, items := range values {
+		if key != "layers" {
+			return nil, fmt.Errorf("unknown key %q, want layers", key)
+		}
+		for _, item := range items {
+			var chain archLayers
+			for _, pattern := range strings.Split(item, "->") {
+				pattern = strings.TrimSpace(pattern)
+				if pattern == "" || pattern == "..." {
+					return nil, fmt.Errorf("empty package pattern in %q", item)
+				}
+				chain = append(chain, pattern)
+			}
+			if len(chain) < 2 {
+				return nil, fmt.Errorf("%q needs at least two layers separated by ->", item)
+			}
+			chains = append(chains, chain)
+		}
+	}
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("no layers declared")
+	}
+	return chains, nil
+}
+
+// matchPackagePattern reports whether the import path pkg matches an -arch-rules pattern:
+// "github.com/me/proj/api/..." matches that package and the ones below it, while any other
+// pattern matches the packages whose path ends with it, so "handlers" matches
+// github.com/me/proj/internal/handlers.
+func matchPackagePattern(pkg, pattern string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/..."); ok {
+		return inPackageTree(pkg, prefix)
+	}
+	return pkg == pattern || strings.HasSuffix(pkg, "/"+pattern)
+}
+
+// layer returns the index of the first layer of the chain matching pkg, or -1.
+func (c archLayers) layer(pkg string) int {
+	for i, pattern := range c {
+		if matchPackagePattern(pkg, pattern) {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkArchRules returns the call sites in the complete call site index of result that call
+// up a chain of layers, ordered by callee ID, then by file and line.
+func checkArchRules(chains []archLayers, result *Result) []ArchViolation {
+	mappings, defs := result.index, result.Definitions
+	known := make(map[string]bool)
+	for _, def := range defs {
+		known[def.Package] = true
+	}
+	ids := make([]string, 0, len(mappings))
+	for id := range mappings {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var violations []ArchViolation
+	for _, id := range ids {
+		m := mappings[id]
+		calleePkg := m.Definition.Package
+		for _, cs := range m.CallSites {
+			callerPkg := packageOfID(cs.CallerID, defs, known)
+			if callerPkg == calleePkg {
+				continue
+			}
+			for _, chain := range chains {
+				from, to := chain.layer(callerPkg), chain.layer(calleePkg)
+				if from >= 0 && to >= 0 && to < from {
+					violations = append(violations, ArchViolation{
+						CallerID: cs.CallerID, CalleeID: id, FilePath: cs.FilePath, Line: cs.Line,
+						CallerLayer: chain[from], CalleeLayer: chain[to],
+					})
+					break
+				}
+			}
+		}
+	}
+	return violations
+}
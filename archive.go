@@ -0,0 +1,107 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// stdinPath is the -path value that reads the module as a tar stream from standard input.
+const stdinPath = "-"
+
+// extractSourceArchive extracts the tar stream r, optionally gzip-compressed, into a new
+// temporary directory and returns the directory holding the module's go.mod: the root of the
+// archive, or its single top-level directory as written by `git archive --prefix`. Only
+// regular files and directories are extracted; entries escaping the archive root are
+// rejected. The caller removes the returned tmpDir when done.
+func extractSourceArchive(r io.Reader) (moduleDir, tmpDir string, err error) {
+	br := bufio.NewReader(r)
+	var stream io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return "", "", fmt.Errorf("could not read gzip stream: %w", err)
+		}
+		defer gz.Close()
+		stream = gz
+	}
+
+	dir, err := os.MkdirTemp("", "codemapper-src-")
+	if err != nil {
+		return "", "", err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	tr := tar.NewReader(stream)
+	topLevel := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("could not read tar stream: %w", err)
+		}
+		name := path.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return "", "", fmt.Errorf("tar entry %q is outside the archive root", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return "", "", err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return "", "", err
+			}
+			if err := writeArchiveFile(target, tr); err != nil {
+				return "", "", err
+			}
+		default:
+			continue // Links, devices and metadata such as git archive's pax_global_header
+		}
+		topLevel[strings.SplitN(name, "/", 2)[0]] = true
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+		return dir, dir, nil
+	}
+	if len(topLevel) == 1 {
+		for name := range topLevel {
+			moduleDir = filepath.Join(dir, name)
+		}
+		if _, err := os.Stat(filepath.Join(moduleDir, "go.mod")); err == nil {
+			return moduleDir, dir, nil
+		}
+	}
+	return "", "", fmt.Errorf("%w: the archive has no go.mod at its root or in its single top-level directory", ErrNoGoMod)
+}
+
+// writeArchiveFile copies the current tar entry to a new file at target.
+func writeArchiveFile(target string, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("could not extract %s: %w", target, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// cacheDirName is the directory, below the analyzed module, that holds the file cache.
+const cacheDirName = ".codemap-cache"
+
+// cacheVersion is mixed into every cache key; bump it when a record's layout or the way it
+// is computed changes, so stale entries are ignored rather than misread.
+const cacheVersion = "15"
+
+// fileRecord is what an analysis pass found in one file. Applying it adds its findings to
+// the run's state. Records hold no ASTs, so they can be cached and replayed on a later run
+// without parsing the file again.
+type fileRecord interface {
+	apply(target AnalysisTarget)
+}
+
+// analysisPass is one of the two passes walkAndProcess runs over every file.
+type analysisPass struct {
+	name    string // Names the pass's records in the cache
+	keepAST bool   // The file's AST is still needed by a later pass
+	scan    func(a Analyzer, filePath string, target AnalysisTarget) (fileRecord, bool)
+	decode  func(r io.Reader) (fileRecord, error)
+}
+
+var (
+	definitionsPass = analysisPass{name: "definitions", keepAST: true, scan: Analyzer.FindDefinitions, decode: decodeRecord[fileDefinitions]}
+	callSitesPass   = analysisPass{name: "call sites", scan: Analyzer.FindCallSites, decode: decodeRecord[fileCallSites]}
+)
+
+// decodeRecord reads a gob-encoded record of type T.
+func decodeRecord[T any, PT interface {
+	*T
+	fileRecord
+}](r io.Reader) (fileRecord, error) {
+	rec := PT(new(T))
+	if err := gob.NewDecoder(r).Decode(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// fileDefinitions is the Pass 1 record of a file. Definitions are kept as declared:
+// constructors and init IDs are settled once every file is known.
+type fileDefinitions struct {
+	Definitions []Definition
+	Types       []TypeDef
+	Methods     [][2]string  // {type ID, method name} of every method declared on a named type
+	Assertions  [][2]string  // {type ID, interface ID} of `var _ I = (*T)(nil)` declarations
+	Values      []Definition // Package-level constants and variables, with -track-vars
+}
+
+func (rec *fileDefinitions) apply(AnalysisTarget) {
+	for _, def := range rec.Definitions {
+		definitions[def.ID] = def
+		mappings[def.ID] = &Mapping{Definition: def, CallSites: []CallSite{}}
+	}
+	for i := range rec.Types {
+		td := rec.Types[i]
+		typeDefs[td.ID] = &td
+	}
+	for _, method := range rec.Methods {
+		if typeMethods[method[0]] == nil {
+			typeMethods[method[0]] = make(map[string]bool)
+		}
+		typeMethods[method[0]][method[1]] = true
+	}
+	interfaceAssertions = append(interfaceAssertions, rec.Assertions...)
+	for _, def := range rec.Values {
+		valueMappings[def.ID] = &Mapping{Definition: def, CallSites: []CallSite{}}
+	}
+}
+
+// fileCall is a call expression found in Pass 2, before it is matched with a definition.
+type fileCall struct {
+	Callee       string
+	Alternatives []string // Tried in order when Callee isn't defined (dot imports)
+	Reason       string   // Counted in the resolution summary if no callee is defined
+	// CallerInitKey is set when the caller is an init function; its final ID replaces
+	// Site.CallerID once numberInitFunctions has run.
+	CallerInitKey string
+	// Interface and Method name the interface method called, when Callee is unknown and
+	// -resolve-interfaces is on; the call is linked to the implementations after Pass 2.
+	Interface string
+	Method    string
+	Expr      string // The called expression as written, with -unresolved
+	Site      CallSite
+}
+
+// callSite returns the call site of c linked to calleeID.
+func (c fileCall) callSite(calleeID string) CallSite {
+	site := c.Site
+	site.CalleeID = calleeID
+	if c.CallerInitKey != "" {
+		if id := initIDs[c.CallerInitKey]; id != "" {
+			site.CallerID = id
+		}
+	}
+	return site
+}
+
+// fileCallSites is the Pass 2 record of a file.
+type fileCallSites struct {
+	Package    string
+	Imports    []string
+	Calls      []fileCall
+	References []fileCall // Uses of package-level constants and variables, with -track-vars
+	// MethodValues are the method expressions used as values rather than called, like
+	// (*T).Less passed as an argument. They aren't call expressions, so they are linked to
+	// the method without counting in the resolution summary.
+	MethodValues []fileCall
+}
+
+// apply links the calls to the definitions known now, so a cached record still drops the
+// calls to definitions that disappeared since it was written.
+func (rec *fileCallSites) apply(target AnalysisTarget) {
+	recordImports(rec.Package, rec.Imports)
+	for _, c := range rec.Calls {
+		m, found := mappings[c.Callee]
+		for _, alt := range c.Alternatives {
+			if found {
+				break
+			}
+			m, found = mappings[alt]
+		}
+		if !found && c.Interface != "" {
+			interfaceCalls = append(interfaceCalls, interfaceCall{fileCall: c, pkg: rec.Package})
+			continue
+		}
+		resolution.record(rec.Package, found, c.Reason)
+		if !found {
+			recordUnresolved(c, target.state.opts)
+			continue
+		}
+		m.CallSites = append(m.CallSites, c.callSite(m.Definition.ID))
+	}
+	for _, ref := range rec.MethodValues {
+		for _, id := range append([]string{ref.Callee}, ref.Alternatives...) {
+			if m, ok := mappings[id]; ok {
+				m.CallSites = append(m.CallSites, ref.callSite(m.Definition.ID))
+				break
+			}
+		}
+	}
+	for _, ref := range rec.References {
+		if m, ok := valueMappings[ref.Callee]; ok {
+			m.CallSites = append(m.CallSites, ref.callSite(m.Definition.ID))
+		}
+	}
+}
+
+// recordUnresolved keeps a call that wasn't linked for the -unresolved report of a run with o.
+func recordUnresolved(c fileCall, o *Options) {
+	if !o.RecordUnresolved {
+		return
+	}
+	site := c.callSite("")
+	unresolvedCalls = append(unresolvedCalls, UnresolvedCall{Reason: c.Reason, Expr: c.Expr, CallerID: site.CallerID, FilePath: site.FilePath, Line: site.Line})
+}
+
+// interfaceCall is a call through an interface method waiting for resolveInterfaceCalls,
+// with the package it was made from.
+type interfaceCall struct {
+	fileCall
+	pkg string
+}
+
+// interfaceCalls are the calls through interface methods of the current run, linked by
+// resolveInterfaceCalls once the implementations are known.
+var interfaceCalls []interfaceCall
+
+// resolveInterfaceCalls links every call through an interface method to the method of each
+// analyzed type implementing the interface, marking the call sites as resolved through
+// the interface. Calls without a known implementation count as unresolved.
+func resolveInterfaceCalls(o *Options) {
+	methodOf := make(map[[2]string]string) // {receiver type ID, name} -> method ID
+	for id, def := range definitions {
+		if def.Kind == "method" && def.ReceiverTypeID != "" {
+			methodOf[[2]string{def.ReceiverTypeID, def.Name}] = id
+		}
+	}
+	implementers := make(map[string][]string)
+	for id, td := range typeDefs {
+		for _, ifaceID := range td.Implements {
+			implementers[ifaceID] = append(implementers[ifaceID], id)
+		}
+	}
+	for _, ids := range implementers {
+		sort.Strings(ids)
+	}
+	for _, c := range interfaceCalls {
+		linked := false
+		for _, typeID := range implementers[c.Interface] {
+			m, ok := mappings[methodOf[[2]string{typeID, c.Method}]]
+			if !ok {
+				continue
+			}
+			site := c.callSite(m.Definition.ID)
+			site.Resolved = resolvedInterface
+			m.CallSites = append(m.CallSites, site)
+			linked = true
+		}
+		resolution.record(c.pkg, linked, c.Reason)
+		if !linked {
+			recordUnresolved(c.fileCall, o)
+		}
+	}
+	interfaceCalls = nil
+}
+
+// analysisCache stores file records on disk, keyed by a hash of the file's content, its
+// place in the target and the options that change what a record holds.
+type analysisCache struct {
+	dir    string
+	opts   *Options // Of the run; the options that change a record are part of its key
+	failed bool     // A write failed; further failures aren't logged
+}
+
+// newAnalysisCache returns the cache configured by o, or nil when caching is off. Records
+// found with -types depend on other files' types, so that mode is never cached.
+func newAnalysisCache(o *Options) *analysisCache {
+	if o.CacheDir == "" || o.TypeCheck {
+		return nil
+	}
+	return &analysisCache{dir: o.CacheDir, opts: o}
+}
+
+// key returns the cache key of filePath for a pass, or "" if the file can't be read.
+func (c *analysisCache) key(pass string, target AnalysisTarget, filePath string) string {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return ""
+	}
+	_, relPath := packagePathFor(target, filePath)
+	h := sha256.New()
+	o := c.opts
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%t\x00%t\x00%d\x00%t\x00%t\x00%d\x00%t\x00%t\x00", cacheVersion, pass, target.ModulePath, relPath, o.WithOffsets, o.CallContext, o.DocMax, o.TrackVars, o.EmbedSource, o.SourceMax, o.ResolvePkgNames, o.RecordUnresolved)
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the record stored under key, if any.
+func (c *analysisCache) get(key string, pass analysisPass) (fileRecord, bool) {
+	if key == "" {
+		return nil, false
+	}
+	f, err := os.Open(filepath.Join(c.dir, key))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	rec, err := pass.decode(f)
+	return rec, err == nil
+}
+
+// put stores rec under key. The record is written to a temporary file first, so an
+// interrupted run never leaves a truncated entry behind.
+func (c *analysisCache) put(key string, rec fileRecord) {
+	if key == "" {
+		return
+	}
+	err := os.MkdirAll(c.dir, 0755)
+	if err == nil {
+		var tmp *os.File
+		if tmp, err = os.CreateTemp(c.dir, key+".*.tmp"); err == nil {
+			err = gob.NewEncoder(tmp).Encode(rec)
+			if closeErr := tmp.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				err = os.Rename(tmp.Name(), filepath.Join(c.dir, key))
+			} else {
+				os.Remove(tmp.Name())
+			}
+		}
+	}
+	if err != nil && !c.failed {
+		c.failed = true
+		log.Printf("Warning: could not write to the cache in %s: %v", c.dir, err)
+	}
+}
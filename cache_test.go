@@ -0,0 +1,83 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordParses makes parseSourceFile record the base name of every file it parses, until
+// the test ends.
+func recordParses(t *testing.T) func() []string {
+	t.Helper()
+	saved := parseSourceFile
+	t.Cleanup(func() { parseSourceFile = saved })
+	var mu sync.Mutex
+	var parsed []string
+	parseSourceFile = func(fset *token.FileSet, filePath string) (*ast.File, error) {
+		mu.Lock()
+		parsed = append(parsed, filepath.Base(filePath))
+		mu.Unlock()
+		return saved(fset, filePath)
+	}
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		names := parsed
+		parsed = nil
+		sort.Strings(names)
+		return names
+	}
+}
+
+func TestCacheParsesChangedFilesOnly(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/cached\n\ngo 1.23.0\n",
+		"a.go":   "package main\n\nfunc main() { b() }\n",
+		"b.go":   "package main\n\nfunc b() { c() }\n",
+		"c.go":   "package main\n\nfunc c() {}\n",
+	})
+	o := Options{CacheDir: filepath.Join(dir, cacheDirName), Jobs: 2}
+	parsed := recordParses(t)
+
+	analyzeModule(t, dir, o)
+	if got := strings.Join(parsed(), ","); got != "a.go,b.go,c.go" {
+		t.Fatalf("first run parsed %s, want every file", got)
+	}
+	analyzeModule(t, dir, o)
+	if got := parsed(); len(got) != 0 {
+		t.Errorf("unchanged run parsed %v, want nothing", got)
+	}
+
+	// b no longer calls c, and c's call from b must disappear though c.go is cached.
+	if err := os.WriteFile(filepath.Join(dir, "b.go"), []byte("package main\n\nfunc b() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result := analyzeModule(t, dir, o)
+	if got := strings.Join(parsed(), ","); got != "b.go" {
+		t.Errorf("run after editing b.go parsed %s, want b.go alone", got)
+	}
+	if findMapping(result, "example.com/cached.c") != nil {
+		t.Error("the removed call to c is still mapped")
+	}
+	if got := callers(t, result, "example.com/cached.b"); len(got) != 1 {
+		t.Errorf("b has %d call sites, want 1", len(got))
+	}
+
+	// A definition that disappears takes the cached calls to it along.
+	if err := os.WriteFile(filepath.Join(dir, "b.go"), []byte("package main\n\nfunc renamed() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result = analyzeModule(t, dir, o)
+	if got := strings.Join(parsed(), ","); got != "b.go" {
+		t.Errorf("run after renaming b parsed %s, want b.go alone", got)
+	}
+	if len(result.Mappings) != 0 {
+		t.Errorf("got %d mappings, want none once b is gone", len(result.Mappings))
+	}
+}
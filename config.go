@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// configValues are the flag values read from a -config file, by flag name. A list holds one
+// value per element.
+type configValues map[string][]string
+
+// loadConfigFile reads a -config file: JSON when its extension is .json, YAML otherwise.
+// Keys are flag names, either as on the command line (analyze-deps) or in camelCase
+// (analyzeDeps); values are scalars or lists of scalars.
+func loadConfigFile(path string) (configValues, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return parseJSONConfig(content)
+	}
+	return parseYAMLConfig(content)
+}
+
+// applyConfig sets every flag of config that wasn't given on the command line, so flags
+// override the file. Lists are joined with commas, except for the flags that may be
+// repeated, which are set once per element.
+func applyConfig(fs *flag.FlagSet, config configValues) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f := fs.Lookup(key)
+		if f == nil {
+			f = fs.Lookup(kebabCase(key))
+		}
+		if f == nil || f.Name == "config" {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if explicit[f.Name] {
+			continue
+		}
+		values := config[key]
+		if _, repeatable := f.Value.(*stringListFlag); !repeatable {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, value := range values {
+			if err := f.Value.Set(value); err != nil {
+				return fmt.Errorf("invalid %s %q: %v", key, value, err)
+			}
+		}
+	}
+	return nil
+}
+
+// kebabCase turns a camelCase setting such as analyzeDeps into the flag name analyze-deps.
+func kebabCase(key string) string {
+	var b strings.Builder
+	for _, r := range key {
+		if unicode.IsUpper(r) {
+			b.WriteByte('-')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// parseJSONConfig reads a JSON object of settings.
+func parseJSONConfig(content []byte) (configValues, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	config := make(configValues)
+	for key, value := range raw {
+		items, isList := value.([]any)
+		if !isList {
+			items = []any{value}
+		}
+		for _, item := range items {
+			var s string
+			switch v := item.(type) {
+			case string:
+				s = v
+			case float64:
+				s = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				s = strconv.FormatBool(v)
+			default:
+				return nil, fmt.Errorf("%s: expected a string, number, boolean or a list of them", key)
+			}
+			config[key] = append(config[key], s)
+		}
+	}
+	return config, nil
+}
+
+// parseYAMLConfig reads the subset of YAML a flat list of settings needs: "key: value"
+// lines, lists written as "key: [a, b]" or as "- item" lines below the key, quoted or plain
+// scalars and # comments.
+func parseYAMLConfig(content []byte) (configValues, error) {
+	config := make(configValues)
+	listKey := "" // The key whose "- item" lines are being read
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(stripYAMLComment(line), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if item, ok := strings.CutPrefix(trimmed, "-"); ok && (item == "" || item[0] == ' ') {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item without a key", i+1)
+			}
+			value, err := yamlScalar(strings.TrimSpace(item))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			config[listKey] = append(config[listKey], value)
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || line != trimmed || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", i+1)
+		}
+		value = strings.TrimSpace(value)
+		listKey = ""
+		switch {
+		case value == "":
+			listKey = key
+			config[key] = []string{}
+		case strings.HasPrefix(value, "["):
+			if !strings.HasSuffix(value, "]") {
+				return nil, fmt.Errorf("line %d: unterminated list", i+1)
+			}
+			config[key] = []string{}
+			if inner := strings.TrimSpace(value[1 : len(value)-1]); inner != "" {
+				for _, item := range strings.Split(inner, ",") {
+					s, err := yamlScalar(strings.TrimSpace(item))
+					if err != nil {
+						return nil, fmt.Errorf("line %d: %v", i+1, err)
+					}
+					config[key] = append(config[key], s)
+				}
+			}
+		default:
+			s, err := yamlScalar(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			config[key] = []string{s}
+		}
+	}
+	return config, nil
+}
+
+// yamlScalar returns the value of a plain, 'single-quoted' or "double-quoted" scalar.
+func yamlScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return s, nil
+}
+
+// stripYAMLComment removes a # comment, which starts a line or follows a space, outside quotes.
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+)
+
+// SCC is a strongly-connected component of the call graph: a set of definitions that can all
+// reach each other through calls, i.e. a cluster of mutually recursive functions.
+type SCC struct {
+	Size    int      `json:"size"`
+	Members []string `json:"members"`
+}
+
+// buildCallGraph returns the caller -> callees adjacency of the given mappings, with the
+// callee lists sorted so that traversals are deterministic.
+func buildCallGraph(maps []Mapping) map[string][]string {
+	seen := make(map[string]map[string]bool)
+	for _, m := range maps {
+		callee := m.Definition.ID
+		for _, cs := range m.CallSites {
+			if seen[cs.CallerID] == nil {
+				seen[cs.CallerID] = make(map[string]bool)
+			}
+			seen[cs.CallerID][callee] = true
+		}
+	}
+	graph := make(map[string][]string, len(seen))
+	for caller, callees := range seen {
+		for callee := range callees {
+			graph[caller] = append(graph[caller], callee)
+		}
+		sort.Strings(graph[caller])
+	}
+	return graph
+}
+
+// findSCCs runs Tarjan's algorithm over the call graph and returns every component with more
+// than one member, largest first. With selfRecursive, single functions that call themselves
+// are returned too, as components of size 1.
+func findSCCs(graph map[string][]string, selfRecursive bool) []SCC {
+	nodes := make([]string, 0, len(graph))
+	for node := range graph {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	index := 0
+	indices := make(map[string]int)
+	lowLinks := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+	var sccs []SCC
+
+	var strongConnect func(node string)
+	strongConnect = func(node string) {
+		indices[node] = index
+		lowLinks[node] = index
+		index++
+		stack = append(stack, node)
+		onStack[node] = true
+
+		for _, next := range graph[node] {
+			if _, visited := indices[next]; !visited {
+				strongConnect(next)
+				lowLinks[node] = min(lowLinks[node], lowLinks[next])
+			} else if onStack[next] {
+				lowLinks[node] = min(lowLinks[node], indices[next])
+			}
+		}
+
+		if lowLinks[node] != indices[node] {
+			return
+		}
+		var members []string
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			members = append(members, top)
+			if top == node {
+				break
+			}
+		}
+		if len(members) > 1 || selfRecursive && callsItself(graph, node) {
+			sort.Strings(members)
+			sccs = append(sccs, SCC{Size: len(members), Members: members})
+		}
+	}
+
+	for _, node := range nodes {
+		if _, visited := indices[node]; !visited {
+			strongConnect(node)
+		}
+	}
+
+	sort.Slice(sccs, func(i, j int) bool {
+		if sccs[i].Size != sccs[j].Size {
+			return sccs[i].Size > sccs[j].Size
+		}
+		return sccs[i].Members[0] < sccs[j].Members[0]
+	})
+	return sccs
+}
+
+// callsItself reports whether node is one of its own callees.
+func callsItself(graph map[string][]string, node string) bool {
+	callees := graph[node]
+	i := sort.SearchStrings(callees, node)
+	return i < len(callees) && callees[i] == node
+}
+
+// writeSCCReport writes the non-trivial strongly-connected components of the call graph as
+// JSON. With selfRecursive, directly recursive functions are listed as well.
+func writeSCCReport(path string, maps []Mapping, selfRecursive bool) error {
+	sccs := findSCCs(buildCallGraph(maps), selfRecursive)
+	if sccs == nil {
+		sccs = []SCC{}
+	}
+	data, err := json.MarshalIndent(sccs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal SCC report: %w", err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Graph is the node/edge form of the call map written by the "graph" output format.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphNode is a function, method or type in the call graph. Position is only set when a
+// server-side layout was requested.
+type GraphNode struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Package  string    `json:"package"`
+	Kind     string    `json:"kind,omitempty"` // The Definition kind, or "type" for type nodes
+	FilePath string    `json:"filePath,omitempty"`
+	Line     int       `json:"line,omitempty"`
+	Position *Position `json:"position,omitempty"`
+}
+
+// GraphEdge is a caller -> callee relationship, with the number of call sites backing it,
+// a constructor -> type relationship, or a type -> interface assertion or implementation.
+type GraphEdge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Kind   string `json:"kind"` // calls, constructs, asserts or implements
+	Count  int    `json:"count"`
+}
+
+// Graph edge kinds.
+const (
+	edgeCalls      = "calls"
+	edgeConstructs = "constructs"
+	edgeAsserts    = "asserts"
+	edgeImplements = "implements"
+)
+
+// Position is a node coordinate, in the same units the visualizer uses.
+type Position struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Spacing between layers (x) and between nodes of the same layer (y) in the server-side layout.
+const (
+	layoutLayerGap = 350
+	layoutNodeGap  = 180
+)
+
+// buildGraph converts the result's mappings into a deduplicated node/edge graph. Callers that
+// aren't mapped themselves are looked up in the definitions, falling back to splitting the ID.
+func buildGraph(result *Result) *Graph {
+	maps := result.Mappings
+	nodes := make(map[string]GraphNode)
+	edgeCounts := make(map[[3]string]int)
+	defNode := func(def Definition) GraphNode {
+		return GraphNode{ID: def.ID, Name: def.Name, Package: def.Package, Kind: def.Kind, FilePath: def.FilePath, Line: def.Line}
+	}
+	addNode := func(id string) {
+		if _, ok := nodes[id]; ok {
+			return
+		}
+		if def, ok := result.Definitions[id]; ok {
+			nodes[id] = defNode(def)
+			return
+		}
+		node := GraphNode{ID: id, Name: id}
+		if i := strings.LastIndex(id, "."); i >= 0 {
+			node.Package, node.Name = id[:i], id[i+1:]
+		}
+		nodes[id] = node
+	}
+	for _, m := range maps {
+		nodes[m.Definition.ID] = defNode(m.Definition)
+	}
+	for _, m := range maps {
+		for _, cs := range m.CallSites {
+			addNode(cs.CallerID)
+			edgeCounts[[3]string{cs.CallerID, m.Definition.ID, edgeCalls}]++
+		}
+	}
+
+	// Link constructors to the types they build, so the function graph connects to the types.
+	typeNode := func(td TypeDef) GraphNode {
+		return GraphNode{ID: td.ID, Name: td.Name, Package: td.Package, Kind: "type", FilePath: td.FilePath, Line: td.Line}
+	}
+	typesByID := make(map[string]TypeDef, len(result.Types))
+	for _, td := range result.Types {
+		typesByID[td.ID] = td
+	}
+	for _, node := range nodes {
+		def, ok := result.Definitions[node.ID]
+		if !ok || def.ConstructsTypeID == "" {
+			continue
+		}
+		if td, ok := typesByID[def.ConstructsTypeID]; ok {
+			nodes[td.ID] = typeNode(td)
+			edgeCounts[[3]string{def.ID, td.ID, edgeConstructs}] = 1
+		}
+	}
+	for _, td := range result.Types {
+		for _, ifaceID := range td.AssertedInterfaces {
+			iface, ok := typesByID[ifaceID]
+			if !ok {
+				continue
+			}
+			nodes[td.ID] = typeNode(td)
+			nodes[iface.ID] = typeNode(iface)
+			edgeCounts[[3]string{td.ID, iface.ID, edgeAsserts}] = 1
+		}
+		for _, ifaceID := range td.Implements {
+			iface, ok := typesByID[ifaceID]
+			if !ok {
+				continue
+			}
+			nodes[td.ID] = typeNode(td)
+			nodes[iface.ID] = typeNode(iface)
+			edgeCounts[[3]string{td.ID, iface.ID, edgeImplements}] = 1
+		}
+	}
+
+	g := &Graph{Nodes: make([]GraphNode, 0, len(nodes)), Edges: make([]GraphEdge, 0, len(edgeCounts))}
+	for _, node := range nodes {
+		g.Nodes = append(g.Nodes, node)
+	}
+	for edge, count := range edgeCounts {
+		g.Edges = append(g.Edges, GraphEdge{Source: edge[0], Target: edge[1], Kind: edge[2], Count: count})
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].ID < g.Nodes[j].ID })
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].Source != g.Edges[j].Source {
+			return g.Edges[i].Source < g.Edges[j].Source
+		}
+		if g.Edges[i].Target != g.Edges[j].Target {
+			return g.Edges[i].Target < g.Edges[j].Target
+		}
+		return g.Edges[i].Kind < g.Edges[j].Kind
+	})
+	return g
+}
+
+// layoutGraph assigns a position to every node using a layered (Sugiyama-style) layout:
+// callers are placed in columns to the left of their callees and each column is ordered by
+// the barycenter of its callers to reduce edge crossings. Cycles are broken at the back edges
+// of a depth-first search. The seed only shuffles the initial node order, so a given graph
+// and seed always produce the same coordinates.
+func layoutGraph(g *Graph, seed int64) {
+	ids := make([]string, len(g.Nodes))
+	for i, node := range g.Nodes {
+		ids[i] = node.ID
+	}
+	rand.New(rand.NewSource(seed)).Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+
+	callees := make(map[string][]string)
+	for _, e := range g.Edges {
+		callees[e.Source] = append(callees[e.Source], e.Target)
+	}
+
+	// Depth-first search to find a topological order of the graph without its back edges.
+	const (
+		unvisited = iota
+		active
+		done
+	)
+	state := make(map[string]int, len(ids))
+	forward := make(map[string][]string)
+	var postOrder []string
+	var visit func(id string)
+	visit = func(id string) {
+		state[id] = active
+		for _, next := range callees[id] {
+			switch state[next] {
+			case unvisited:
+				forward[id] = append(forward[id], next)
+				visit(next)
+			case done:
+				forward[id] = append(forward[id], next)
+			}
+		}
+		state[id] = done
+		postOrder = append(postOrder, id)
+	}
+	for _, id := range ids {
+		if state[id] == unvisited {
+			visit(id)
+		}
+	}
+
+	// Longest-path layering in topological order (reverse post-order).
+	layer := make(map[string]int, len(ids))
+	callers := make(map[string][]string)
+	maxLayer := 0
+	for i := len(postOrder) - 1; i >= 0; i-- {
+		id := postOrder[i]
+		for _, next := range forward[id] {
+			callers[next] = append(callers[next], id)
+			if layer[id]+1 > layer[next] {
+				layer[next] = layer[id] + 1
+			}
+		}
+		maxLayer = max(maxLayer, layer[id])
+	}
+
+	columns := make([][]string, maxLayer+1)
+	for i := len(postOrder) - 1; i >= 0; i-- {
+		id := postOrder[i]
+		columns[layer[id]] = append(columns[layer[id]], id)
+	}
+
+	// A few downward barycenter sweeps to pull callees next to their callers.
+	rowOf := make(map[string]float64, len(ids))
+	for _, col := range columns {
+		for row, id := range col {
+			rowOf[id] = float64(row)
+		}
+	}
+	for sweep := 0; sweep < 4; sweep++ {
+		for _, col := range columns[1:] {
+			center := make(map[string]float64, len(col))
+			for _, id := range col {
+				center[id] = rowOf[id]
+				if len(callers[id]) > 0 {
+					sum := 0.0
+					for _, c := range callers[id] {
+						sum += rowOf[c]
+					}
+					center[id] = sum / float64(len(callers[id]))
+				}
+			}
+			sort.SliceStable(col, func(i, j int) bool { return center[col[i]] < center[col[j]] })
+			for row, id := range col {
+				rowOf[id] = float64(row)
+			}
+		}
+	}
+
+	for i := range g.Nodes {
+		id := g.Nodes[i].ID
+		g.Nodes[i].Position = &Position{X: float64(layer[id] * layoutLayerGap), Y: rowOf[id] * layoutNodeGap}
+	}
+}
+
+// GraphFilter selects the part of a Graph served by /api/graph. Every set field must match
+// for a node to be kept.
+type GraphFilter struct {
+	Package  string // Keep the nodes of this package only
+	MinFanIn int    // Keep the nodes called from at least this many distinct callers
+}
+
+// filterGraph returns the nodes of g that match f and their incident edges, so the calls
+// into and out of a kept node stay visible even when the node at the other end is filtered out.
+func filterGraph(g *Graph, f GraphFilter) *Graph {
+	fanIn := make(map[string]int)
+	for _, e := range g.Edges {
+		if e.Kind == edgeCalls {
+			fanIn[e.Target]++
+		}
+	}
+	kept := make(map[string]bool)
+	out := &Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	for _, node := range g.Nodes {
+		if f.Package != "" && node.Package != f.Package {
+			continue
+		}
+		if fanIn[node.ID] < f.MinFanIn {
+			continue
+		}
+		kept[node.ID] = true
+		out.Nodes = append(out.Nodes, node)
+	}
+	for _, e := range g.Edges {
+		if kept[e.Source] || kept[e.Target] {
+			out.Edges = append(out.Edges, e)
+		}
+	}
+	return out
+}
+
+// reachableSubgraph returns the part of g reachable from root by following edges forward:
+// root, everything it transitively calls or constructs, and the edges between them.
+func reachableSubgraph(g *Graph, root string) *Graph {
+	out := make(map[string][]string)
+	for _, e := range g.Edges {
+		out[e.Source] = append(out[e.Source], e.Target)
+	}
+	seen := map[string]bool{root: true}
+	queue := []string{root}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, next := range out[id] {
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	sub := &Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	for _, node := range g.Nodes {
+		if seen[node.ID] {
+			sub.Nodes = append(sub.Nodes, node)
+		}
+	}
+	for _, e := range g.Edges {
+		if seen[e.Source] && seen[e.Target] {
+			sub.Edges = append(sub.Edges, e)
+		}
+	}
+	return sub
+}
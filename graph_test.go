@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReportSCCs(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/scc\n\ngo 1.23.0\n",
+		"main.go": `package main
+
+func a(n int) { b(n) }
+func b(n int) { c(n) }
+func c(n int) {
+	if n > 0 {
+		a(n - 1)
+	}
+}
+
+func main() { a(3) }
+`,
+	})
+	result := analyzeModule(t, dir, Options{})
+	path := filepath.Join(t.TempDir(), "sccs.json")
+	if err := writeSCCReport(path, result.Mappings, false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sccs []SCC
+	if err := json.Unmarshal(data, &sccs); err != nil {
+		t.Fatal(err)
+	}
+	want := []SCC{{Size: 3, Members: []string{"example.com/scc.a", "example.com/scc.b", "example.com/scc.c"}}}
+	if !reflect.DeepEqual(sccs, want) {
+		t.Errorf("got %+v, want %+v", sccs, want)
+	}
+}
+
+func TestLayoutIsReproducible(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/layout\n\ngo 1.23.0\n",
+		"main.go": `package main
+
+type Server struct{}
+
+func NewServer() *Server { return &Server{} }
+
+func (s *Server) Start() { listen(); serve() }
+
+func listen() {}
+func serve()  { handle(); handle() }
+func handle() {}
+
+func main() { NewServer().Start() }
+`,
+	})
+	var outputs [2][]byte
+	for i := range outputs {
+		result := analyzeModule(t, dir, Options{Layout: true, LayoutSeed: 42})
+		var buf bytes.Buffer
+		if err := writeJSONGraph(&buf, result); err != nil {
+			t.Fatal(err)
+		}
+		outputs[i] = buf.Bytes()
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Errorf("layouts with the same seed differ:\n%s\n%s", outputs[0], outputs[1])
+	}
+	var g Graph
+	if err := json.Unmarshal(outputs[0], &g); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Nodes) < 5 {
+		t.Fatalf("got %d nodes, want at least 5", len(g.Nodes))
+	}
+	for _, node := range g.Nodes {
+		if node.Position == nil {
+			t.Errorf("node %s has no position", node.ID)
+		}
+	}
+}
+
+func TestConstructorEdges(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/emp\n\ngo 1.23.0\n",
+		"handler/handler.go": `package handler
+
+type EmployeeHandler struct{}
+
+type Repo struct{}
+
+func NewEmployeeHandler(repo *Repo) *EmployeeHandler { return &EmployeeHandler{} }
+
+func NewRepo() (*Repo, error) { return &Repo{}, nil }
+`,
+		"main.go": `package main
+
+import "example.com/emp/handler"
+
+func main() {
+	repo, _ := handler.NewRepo()
+	handler.NewEmployeeHandler(repo)
+}
+`,
+	})
+	graph := buildGraph(analyzeModule(t, dir, Options{}))
+	var constructs [][2]string
+	for _, e := range graph.Edges {
+		if e.Kind == edgeConstructs {
+			constructs = append(constructs, [2]string{e.Source, e.Target})
+		}
+	}
+	want := [][2]string{
+		{"example.com/emp/handler.NewEmployeeHandler", "example.com/emp/handler.EmployeeHandler"},
+		{"example.com/emp/handler.NewRepo", "example.com/emp/handler.Repo"},
+	}
+	if !reflect.DeepEqual(constructs, want) {
+		t.Errorf("constructs edges = %v, want %v", constructs, want)
+	}
+	for _, n := range graph.Nodes {
+		if n.ID == "example.com/emp/handler.EmployeeHandler" && n.Kind != "type" {
+			t.Errorf("EmployeeHandler node has kind %q, want type", n.Kind)
+		}
+	}
+}
+
+func TestInterfaceAssertions(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/assert\n\ngo 1.23.0\n",
+		"store.go": `package main
+
+import "io"
+
+type Store interface{ Get(key string) string }
+
+type memStore struct{}
+
+func (m *memStore) Get(key string) string { return key }
+
+func (m *memStore) Close() error { return nil }
+
+var _ Store = (*memStore)(nil)
+
+var _ io.Closer = (*memStore)(nil)
+
+func main() {}
+`,
+	})
+	result := analyzeModule(t, dir, Options{TrackVars: true})
+	var mem TypeDef
+	for _, td := range result.Types {
+		if td.Name == "memStore" {
+			mem = td
+		}
+	}
+	// Both assertions are listed, but io.Closer isn't analyzed, so only Store is counted and linked.
+	if !reflect.DeepEqual(mem.AssertedInterfaces, []string{"example.com/assert.Store", "io.Closer"}) || mem.SatisfiesCount != 1 {
+		t.Errorf("memStore: asserted %v, satisfies %d; want Store and io.Closer, satisfying Store", mem.AssertedInterfaces, mem.SatisfiesCount)
+	}
+	var asserts []GraphEdge
+	for _, e := range buildGraph(result).Edges {
+		if e.Kind == edgeAsserts {
+			asserts = append(asserts, e)
+		}
+	}
+	if len(asserts) != 1 || asserts[0].Source != "example.com/assert.memStore" || asserts[0].Target != "example.com/assert.Store" {
+		t.Errorf("asserts edges = %+v, want memStore -> Store", asserts)
+	}
+	// The assertion is neither a call nor a variable.
+	if len(result.Mappings) != 0 || len(valueReport(result)) != 0 {
+		t.Errorf("the assertion was counted as usage: mappings %+v, values %+v", result.Mappings, valueReport(result))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ignoreFileName is the per-repository ignore file loaded from the root of every target.
+const ignoreFileName = ".codemapperignore"
+
+// ignoreRule is one line of a gitignore-style file.
+type ignoreRule struct {
+	base     string   // Slash-separated directory of the file the rule came from, "" for the root
+	segments []string // Pattern split on "/"; unanchored patterns start with "**"
+	negate   bool     // "!pattern" re-includes what an earlier rule excluded
+	dirOnly  bool     // "pattern/" only matches directories
+}
+
+// ignoreMatcher applies gitignore rules to paths relative to a target root. As in git, the
+// last matching rule decides, and a path below an excluded directory isn't visited at all, so
+// it can't be re-included.
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+// loadIgnoreFile adds the rules of the gitignore-style file at filePath, which lives in the
+// slash-separated directory base relative to the root. A missing file adds nothing.
+func (m *ignoreMatcher) loadIgnoreFile(filePath, base string) error {
+	f, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text(), base); ok {
+			m.rules = append(m.rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read %s: %w", filePath, err)
+	}
+	return nil
+}
+
+// parseIgnoreRule parses a single line, reporting false for blank lines and comments.
+func parseIgnoreRule(line, base string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:] // \# and \! match a literal leading character
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	// A pattern with a slash other than at the end is relative to the file's directory;
+	// anything else matches a name at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	rule.segments = strings.Split(line, "/")
+	if !anchored {
+		rule.segments = append([]string{"**"}, rule.segments...)
+	}
+	return rule, true
+}
+
+// Match reports whether the slash-separated path rel, relative to the root, is ignored.
+func (m *ignoreMatcher) Match(rel string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		name := rel
+		if rule.base != "" {
+			var ok bool
+			if name, ok = strings.CutPrefix(rel, rule.base+"/"); !ok {
+				continue
+			}
+		}
+		if matchIgnoreSegments(rule.segments, strings.Split(name, "/")) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matchIgnoreSegments matches path segments against pattern segments, where "**" stands for
+// any number of directories and the other segments use path.Match syntax.
+func matchIgnoreSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return len(name) > 0 // "dir/**" matches everything inside dir, not dir itself
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchIgnoreSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// skipPattern is one -skip pattern. A pattern prefixed with "re:" is a regular expression,
+// one containing *, ? or [ is a glob matched against the whole relative path with
+// path.Match, and anything else is a plain substring, as -skip has always accepted.
+type skipPattern struct {
+	raw    string
+	re     *regexp.Regexp
+	isGlob bool
+}
+
+// compileSkipPatterns parses the -skip patterns, ignoring empty ones.
+func compileSkipPatterns(patterns []string) ([]skipPattern, error) {
+	var compiled []skipPattern
+	for _, raw := range patterns {
+		if raw == "" {
+			continue
+		}
+		p := skipPattern{raw: raw}
+		if expr, ok := strings.CutPrefix(raw, "re:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid skip pattern %q: %w", raw, err)
+			}
+			p.re = re
+		} else if strings.ContainsAny(raw, "*?[") {
+			if _, err := path.Match(raw, ""); err != nil {
+				return nil, fmt.Errorf("invalid skip pattern %q: %w", raw, err)
+			}
+			p.isGlob = true
+		}
+		compiled = append(compiled, p)
+	}
+	return compiled, nil
+}
+
+// Match reports whether the slash-separated path rel, relative to the target root, is skipped.
+func (p skipPattern) Match(rel string) bool {
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(rel)
+	case p.isGlob:
+		ok, _ := path.Match(p.raw, rel)
+		return ok
+	default:
+		return strings.Contains(rel, p.raw)
+	}
+}
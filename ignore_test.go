@@ -0,0 +1,114 @@
+package main
+
+import "testing"
+
+func TestSkipPatternForms(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		want    bool
+	}{
+		{"models", "models/user.go", true},
+		{"models", "api/models_helper.go", true},
+		{"models", "api/handler.go", false},
+		{"models/*.go", "models/user.go", true},
+		{"models/*.go", "models/sub/user.go", false},
+		{"models/*.go", "api/models_helper.go", false},
+		{"*_helper.go", "api/models_helper.go", false},
+		{"api/*_helper.go", "api/models_helper.go", true},
+		{`re:^models/`, "models/user.go", true},
+		{`re:^models/`, "api/models_helper.go", false},
+		{`re:_helper\.go$`, "api/models_helper.go", true},
+	}
+	for _, tt := range tests {
+		patterns, err := compileSkipPatterns([]string{tt.pattern})
+		if err != nil {
+			t.Fatalf("compileSkipPatterns(%q): %v", tt.pattern, err)
+		}
+		if got := patterns[0].Match(tt.rel); got != tt.want {
+			t.Errorf("%q.Match(%q) = %v, want %v", tt.pattern, tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestSkipPatternsInvalid(t *testing.T) {
+	for _, pattern := range []string{"re:(", "models/[.go"} {
+		if _, err := compileSkipPatterns([]string{pattern}); err == nil {
+			t.Errorf("compileSkipPatterns(%q) succeeded, want an error", pattern)
+		}
+	}
+}
+
+func TestSkipPatternsApplyToAnalysis(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/skip\n\ngo 1.21\n",
+		"models/user.go": `package models
+
+func User() {}
+`,
+		"api/models_helper.go": `package api
+
+func Helper() {}
+`,
+		"main.go": `package main
+
+import (
+	"example.com/skip/api"
+	"example.com/skip/models"
+)
+
+func main() {
+	models.User()
+	api.Helper()
+}
+`,
+	})
+	tests := []struct {
+		pattern string
+		kept    []string
+	}{
+		{"models", nil},
+		{"models/*.go", []string{"example.com/skip/api.Helper"}},
+		{`re:^api/`, []string{"example.com/skip/models.User"}},
+	}
+	for _, tt := range tests {
+		result := analyzeModule(t, dir, Options{SkipPatterns: []string{tt.pattern}})
+		for _, id := range []string{"example.com/skip/api.Helper", "example.com/skip/models.User"} {
+			want := false
+			for _, k := range tt.kept {
+				want = want || k == id
+			}
+			if got := findMapping(result, id) != nil; got != want {
+				t.Errorf("-skip %q: mapping of %s present = %v, want %v", tt.pattern, id, got, want)
+			}
+		}
+	}
+}
+
+func TestIgnoreFileExcludesDirectory(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":            "module example.com/ign\n\ngo 1.21\n",
+		ignoreFileName:      "# Generated clients\nclients/\n",
+		"clients/client.go": "package clients\n\nfunc Call() {}\n",
+		"store/store.go":    "package store\n\nfunc Get() {}\n",
+		"main.go": `package main
+
+import (
+	"example.com/ign/clients"
+	"example.com/ign/store"
+)
+
+func main() {
+	clients.Call()
+	store.Get()
+}
+`,
+	})
+	result := analyzeModule(t, dir, Options{})
+	if _, ok := result.Definitions["example.com/ign/clients.Call"]; ok {
+		t.Error("clients/ was analyzed despite the ignore file")
+	}
+	if findMapping(result, "example.com/ign/store.Get") == nil {
+		t.Error("store/ wasn't analyzed")
+	}
+}
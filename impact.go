@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Impact describes a -impact-base run: the definitions touched between two git refs and how
+// many definitions transitively call them.
+type Impact struct {
+	Base     string   `json:"base"`
+	Head     string   `json:"head,omitempty"` // Empty when comparing against the working tree
+	Changed  []string `json:"changed"`
+	Impacted int      `json:"impacted"` // Changed definitions plus all their transitive callers
+}
+
+// lineRange is a span of lines in the new version of a file touched by a diff hunk. For a
+// pure deletion it is the pair of lines the removed code sat between.
+type lineRange struct {
+	start, end int
+	deletion   bool
+}
+
+// changedLines runs `git diff -U0` between base and head (the working tree when head is
+// empty) inside dir and returns the touched line ranges per file, keyed by the slash-separated
+// path relative to dir.
+func changedLines(dir, base, head string) (map[string][]lineRange, error) {
+	args := []string{"-C", dir, "diff", "-U0", "--no-color", "--no-ext-diff", "--relative", base}
+	if head != "" {
+		args = append(args, head)
+	}
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("git diff %s %s: %v: %s", base, head, err, bytes.TrimSpace(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("git diff %s %s: %w", base, head, err)
+	}
+
+	changes := make(map[string][]lineRange)
+	var file string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			file = ""
+			if name := strings.TrimPrefix(line, "+++ "); strings.HasPrefix(name, "b/") {
+				file = strings.TrimPrefix(name, "b/")
+			}
+		case strings.HasPrefix(line, "@@ ") && file != "":
+			if r, ok := parseHunkHeader(line); ok {
+				changes[file] = append(changes[file], r)
+			}
+		}
+	}
+	return changes, scanner.Err()
+}
+
+// parseHunkHeader reads the new-file side of a hunk header such as "@@ -10,2 +12,3 @@".
+func parseHunkHeader(header string) (lineRange, bool) {
+	fields := strings.Fields(header)
+	if len(fields) < 3 || !strings.HasPrefix(fields[2], "+") {
+		return lineRange{}, false
+	}
+	startStr, countStr, hasCount := strings.Cut(strings.TrimPrefix(fields[2], "+"), ",")
+	start, err := strconv.Atoi(startStr)
+	if err != nil {
+		return lineRange{}, false
+	}
+	count := 1
+	if hasCount {
+		if count, err = strconv.Atoi(countStr); err != nil {
+			return lineRange{}, false
+		}
+	}
+	if count == 0 {
+		// Lines were only removed, right after line start of the new file.
+		return lineRange{start: start, end: start + 1, deletion: true}, true
+	}
+	return lineRange{start: start, end: start + count - 1}, true
+}
+
+// changedDefinitions returns the IDs, sorted, of the definitions of target whose lines
+// overlap a change. A deletion counts only when it falls inside the definition, so removing a
+// whole function doesn't mark the one above it.
+func changedDefinitions(target AnalysisTarget, changes map[string][]lineRange) []string {
+	var changed []string
+	for id, def := range definitions {
+		ranges := changes[def.FilePath]
+		if len(ranges) == 0 || !inTarget(target, def) {
+			continue
+		}
+		end := def.EndLine
+		if end == 0 {
+			end = def.Line // Loaded from a definition index, which doesn't keep end lines.
+		}
+		for _, r := range ranges {
+			if (r.deletion && def.Line <= r.start && r.end <= end) || (!r.deletion && r.start <= end && def.Line <= r.end) {
+				changed = append(changed, id)
+				break
+			}
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// inTarget reports whether def was declared in target rather than in a dependency that
+// happens to have a file at the same relative path.
+func inTarget(target AnalysisTarget, def Definition) bool {
+	pkgDir := path.Dir(def.FilePath)
+	if pkgDir == "." {
+		return def.Package == target.ModulePath
+	}
+	return def.Package == path.Join(target.ModulePath, pkgDir)
+}
+
+// impactSet expands the changed definitions to everything that transitively calls them,
+// walking the call sites breadth-first.
+func impactSet(changed []string, maps map[string]*Mapping) map[string]bool {
+	impacted := make(map[string]bool, len(changed))
+	queue := append([]string(nil), changed...)
+	for _, id := range changed {
+		impacted[id] = true
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		m, ok := maps[id]
+		if !ok {
+			continue
+		}
+		for _, cs := range m.CallSites {
+			if !impacted[cs.CallerID] {
+				impacted[cs.CallerID] = true
+				queue = append(queue, cs.CallerID)
+			}
+		}
+	}
+	return impacted
+}
@@ -1,21 +1,36 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/parser"
 	"go/printer"
 	"go/token"
+	"go/types"
 	"io/fs"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
@@ -23,11 +38,45 @@ import (
 
 // Definition represents a declared function, method, or constructor.
 type Definition struct {
-	ID       string `json:"id"`
-	Name     string `json:"name"`
-	Package  string `json:"package"`
-	FilePath string `json:"filePath"`
-	Line     int    `json:"line"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Package string `json:"package"`
+	// PackageName is the name of the package clause, which can differ from the last element
+	// of the import path Package, e.g. main in cmd/foo or store_test in an external test.
+	PackageName string `json:"packageName"`
+	FilePath    string `json:"filePath"`
+	Line        int    `json:"line"`
+	EndLine     int    `json:"endLine"` // Last line of the declaration, the closing brace of a function
+	Kind        string `json:"kind"`    // function, method or constructor
+	// ReceiverTypeID is the TypeDef a method is declared on, without pointer or type
+	// parameters: the methods of *Stack[T] have the receiver type pkg.Stack.
+	ReceiverTypeID string `json:"receiverTypeId,omitempty"`
+	// ConstructsTypeID is the TypeDef a constructor returns (its first result, e.g. *T or (T, error)).
+	ConstructsTypeID string `json:"constructsTypeId,omitempty"`
+	// EntryPoint is set for definitions run without being called from the code: main in
+	// package main, init, and Test/Benchmark/Example/Fuzz functions of test files.
+	EntryPoint bool `json:"entryPoint,omitempty"`
+	// IsTestHelper is set for functions that call t.Helper() on a *testing.T/B/F or testing.TB parameter.
+	IsTestHelper bool `json:"isTestHelper,omitempty"`
+	// TestFile is set for the definitions of _test.go files, analyzed with -include-tests.
+	TestFile bool `json:"testFile,omitempty"`
+	// Deprecated is set when the doc comment has a "Deprecated:" paragraph, whose text is
+	// kept in DeprecationMessage.
+	Deprecated         bool   `json:"deprecated,omitempty"`
+	DeprecationMessage string `json:"deprecationMessage,omitempty"`
+	// Doc is the doc comment, cut to -doc-max characters.
+	Doc string `json:"doc,omitempty"`
+	// Source is the declaration as written, doc comment aside, recorded with -embed-source
+	// and cut to -source-max bytes.
+	Source string `json:"source,omitempty"`
+	// Signature is the declared signature without the func keyword and name, with type
+	// parameters, e.g. "(c *gin.Context) (int, error)".
+	Signature   string `json:"signature"`
+	ParamCount  int    `json:"paramCount"` // Variadic parameters count once
+	ReturnCount int    `json:"returnCount"`
+	// Offset is the zero-based byte offset of the declaration in its file, recorded with
+	// -with-offsets. A declaration never starts a file, so 0 means it wasn't recorded.
+	Offset int `json:"offset,omitempty"`
 }
 
 // CallSite represents where a Definition is called/used.
@@ -35,370 +84,2992 @@ type CallSite struct {
 	FilePath string `json:"filePath"`
 	Line     int    `json:"line"`
 	CallerID string `json:"callerId"`
+	// CalleeID is the ID of the called definition, i.e. of the Mapping holding the call site.
+	// It is redundant there but lets call sites be processed as a flat list.
+	CalleeID string `json:"calleeId"`
+	// Context is the innermost enclosing statement kind, recorded with -call-context.
+	Context  string `json:"context,omitempty"`
+	ArgCount int    `json:"argCount"`         // Number of arguments written at the call
+	Spread   bool   `json:"spread,omitempty"` // The last argument is spread into a variadic parameter (f(args...))
+	CallKind string `json:"callKind"`         // call, go (started as a goroutine), defer, or reference with -track-vars
+	Offset   int    `json:"offset,omitempty"` // Byte offset of the call expression, recorded with -with-offsets
+	// Resolved is "interface" for a call through an interface method linked to one of its
+	// implementations with -resolve-interfaces, and empty for a direct call.
+	Resolved string `json:"resolved,omitempty"`
 }
 
 // Mapping links a single Definition to all the places it's called.
 type Mapping struct {
-	Definition Definition `json:"definition"`
-	CallSites  []CallSite `json:"callSites"`
+	Definition     Definition `json:"definition"`
+	CallSites      []CallSite `json:"callSites"`
+	Truncated      bool       `json:"truncated,omitempty"`      // Set when CallSites was capped by -max-call-sites-per-def
+	TotalCallSites int        `json:"totalCallSites,omitempty"` // Number of call sites before capping
+	// CallerFileCount is the number of distinct files containing a call to the definition,
+	// a proxy for how widely spread a dependency is.
+	CallerFileCount int `json:"callerFileCount"`
+	// CallCount is the number of call sites and CallerCount the number of distinct callers:
+	// a function called 100 times from one place differs from one called from 100 places.
+	// Both are counted before -max-call-sites-per-def caps CallSites.
+	CallCount   int `json:"callCount"`
+	CallerCount int `json:"callerCount"`
+}
+
+// TypeDef represents a declared named type (struct, interface, alias, ...).
+type TypeDef struct {
+	ID             string   `json:"id"`
+	Name           string   `json:"name"`
+	Package        string   `json:"package"`
+	FilePath       string   `json:"filePath"`
+	Line           int      `json:"line"`
+	Kind           string   `json:"kind"`              // struct, interface, alias or defined
+	Methods        []string `json:"methods,omitempty"` // Method names declared by an interface
+	MethodCount    int      `json:"methodCount"`       // Methods declared on the type (or in the interface)
+	SatisfiesCount int      `json:"satisfiesCount"`    // Analyzed interfaces whose method names this type covers
+	// Implements lists those interfaces, which are compared by full method set, pointer
+	// receivers and embedded interfaces included, with -types.
+	Implements []string `json:"implements,omitempty"`
+	// AssertedInterfaces lists the interfaces the type is asserted to implement with the
+	// compile-time idiom `var _ Iface = (*T)(nil)`.
+	AssertedInterfaces []string `json:"assertedInterfaces,omitempty"`
 }
 
 // AnalysisTarget holds the filesystem path and module path for a codebase to be analyzed.
 type AnalysisTarget struct {
-	FSRoot     string // The absolute path on the filesystem
-	ModulePath string // The Go module path (e.g., "github.com/my/project")
+	FSRoot     string `json:"fsRoot,omitempty"` // The absolute path on the filesystem
+	ModulePath string `json:"modulePath"`       // The Go module path (e.g., "github.com/my/project")
+	// SinglePackage limits the walk to the files directly in FSRoot (-package without -recursive).
+	SinglePackage bool `json:"singlePackage,omitempty"`
+	// GoVersion is the language version from the module's go.mod `go` directive, if any.
+	GoVersion string `json:"goVersion,omitempty"`
+	// FileSet records the positions of the target's files. Both passes must use the same
+	// one, since Pass 2 reuses the ASTs parsed in Pass 1.
+	FileSet *token.FileSet `json:"-"`
+	// NestedRoots are the slash-separated paths, relative to FSRoot, of other targets below
+	// it, which the walk leaves to them.
+	NestedRoots []string `json:"-"`
+	// Dependency is set on the targets found by -analyze-deps, whose files are always
+	// selected by their build constraints.
+	Dependency bool `json:"dependency,omitempty"`
+	// state is the options and Pass 1 state of the run analyzing the target, which the
+	// analyzers read while scanning its files.
+	state *passState
+}
+
+// ResolutionStats summarizes how many call expressions Pass 2 could link to a known Definition.
+type ResolutionStats struct {
+	Total      int            `json:"total"`
+	Resolved   int            `json:"resolved"`
+	Unresolved int            `json:"unresolved"`
+	ByReason   map[string]int `json:"byReason"`
+	// ByPackage counts the call expressions of every calling package.
+	ByPackage map[string]PackageResolution `json:"byPackage"`
+}
+
+// PackageResolution counts the call expressions of one package and how many were linked.
+type PackageResolution struct {
+	Total    int `json:"total"`
+	Resolved int `json:"resolved"`
+}
+
+// record counts a call expression of pkg, linked to a definition or left out for reason.
+func (s *ResolutionStats) record(pkg string, resolved bool, reason string) {
+	p := s.ByPackage[pkg]
+	p.Total++
+	s.Total++
+	if resolved {
+		p.Resolved++
+		s.Resolved++
+	} else {
+		s.Unresolved++
+		s.ByReason[reason]++
+	}
+	s.ByPackage[pkg] = p
+}
+
+// UnresolvedCall is a call expression that wasn't linked to any definition, written to the
+// -unresolved report.
+type UnresolvedCall struct {
+	Reason   string
+	Expr     string // The called expression, as written
+	CallerID string
+	FilePath string
+	Line     int
+}
+
+// KindCounts tallies definitions by Kind.
+type KindCounts struct {
+	Functions    int `json:"functions"`
+	Methods      int `json:"methods"`
+	Constructors int `json:"constructors"`
+}
+
+// Metadata describes an analysis run: what was scanned and how complete the result is.
+type Metadata struct {
+	Targets    []AnalysisTarget `json:"targets"`
+	Resolution ResolutionStats  `json:"resolution"`
+	Kinds      KindCounts       `json:"kinds"`
+	// PackageKinds breaks Kinds down per package, filled with -per-package-kinds.
+	PackageKinds map[string]KindCounts `json:"packageKinds,omitempty"`
+	Impact       *Impact               `json:"impact,omitempty"` // Set with -impact-base
+}
+
+// CallSite.Resolved value of calls linked through an interface.
+const resolvedInterface = "interface"
+
+// CallSite.CallKind values.
+const (
+	callKindCall  = "call"
+	callKindGo    = "go"
+	callKindDefer = "defer"
+	// callKindReference marks a use of a package-level constant or variable, see -track-vars.
+	callKindReference = "reference"
+)
+
+// Reasons a call expression could not be linked to a Definition.
+const (
+	unresolvedStdlib   = "stdlib"           // selector on an imported standard library package
+	unresolvedExternal = "external"         // selector on an imported package that wasn't analyzed
+	unresolvedVariable = "variable"         // method call on a variable, field or interface value
+	unresolvedChained  = "chained selector" // a.b.C() or f().C()
+	unresolvedUnknown  = "unknown function" // bare identifier with no matching definition (builtins, func values)
+	unresolvedOther    = "other"            // function literals, index expressions, conversions, ...
+)
+
+// DefinitionIndex is the serialized result of Pass 1. Loading it rebuilds the definition
+// and mapping lookups so Pass 2 can run without rescanning definitions.
+type DefinitionIndex struct {
+	Definitions []Definition `json:"definitions"`
+	Types       []TypeDef    `json:"types"`
+	Methods     [][2]string  `json:"methods"`          // {type ID, method name}, see typeMethods
+	Assertions  [][2]string  `json:"assertions"`       // {type ID, interface ID}, see interfaceAssertions
+	Values      []Definition `json:"values,omitempty"` // Package-level constants and variables, with -track-vars
+}
+
+// Options holds the resolved configuration for an analysis run.
+type Options struct {
+	TargetPath string
+	// ModuleRoots are further module directories analyzed together with TargetPath, so that
+	// calls between the modules are recorded.
+	ModuleRoots []string
+	// Workspace also analyzes the modules listed in the go.work file of TargetPath, if there
+	// is one.
+	Workspace    bool
+	GoModCache   string // Filled from `go env GOMODCACHE` when not set explicitly
+	AnalyzeDeps  []string
+	DepDepth     int // Levels of -analyze-deps requirements to follow; 1 is direct dependencies only
+	SkipPatterns []string
+	// GeneratedDirs are directory names pruned wherever they appear (-skip-common-generated).
+	GeneratedDirs []string
+	BuildTags     []string // Extra build tags, as passed to `go build -tags`
+	Env           []string // KEY=VALUE overrides for GOOS, GOARCH and CGO_ENABLED
+	// BuildContext decides which files are active. It is nil unless BuildTags or Env are set,
+	// in which case every .go file is analyzed regardless of its build constraints.
+	BuildContext *build.Context
+	Layout       bool   // Compute node positions for the graph format
+	LayoutSeed   int64  // Seed for the layout's initial node order
+	Jobs         int    // Files parsed in parallel; 1 parses them one at a time
+	Root         string // Limit the graph, dot and mermaid formats to what this definition reaches
+	CallContext  bool   // Record the enclosing statement kind of every call site
+	LowMemory    bool   // Parse files again in Pass 2 instead of caching their ASTs
+	// Package restricts the main target to the package with this import path, and the
+	// packages below it when Recursive is set.
+	Package         string
+	Recursive       bool
+	DefIndexIn      string // Load the definition index from this file instead of running Pass 1
+	DefIndexOut     string // Write the Pass 1 definition index to this file
+	PerPackageKinds bool   // Fill Metadata.PackageKinds
+	ImpactBase      string // Git ref; keep only the definitions changed since then and their callers
+	ImpactHead      string // Git ref ImpactBase is compared with; the working tree when empty
+	Strict          bool   // Report files that fail to parse as an error instead of skipping them
+	WithOffsets     bool   // Record the byte offset of every definition and call site
+	WarnDeprecated  bool   // Log every call site of a deprecated definition
+	DocMax          int    // Keep doc comments on definitions, cut to this many characters; 0 omits them
+	// TypeCheck type-checks the analyzed packages with go/types so that method calls on
+	// variables and fields resolve to the receiver's method.
+	TypeCheck bool
+	// EmbedSource keeps the source of every definition, cut to SourceMax bytes when
+	// SourceMax is positive.
+	EmbedSource bool
+	SourceMax   int
+	// TrackVars records package-level constants and variables, and the references to them
+	// from functions, in valueMappings.
+	TrackVars bool
+	// ResolveInterfaces links calls through interface methods, found with TypeCheck, to the
+	// method of every analyzed type implementing the interface.
+	ResolveInterfaces bool
+	// Focus keeps only the called definitions of the packages at or below this import path,
+	// and their direct callers.
+	Focus string
+	// RecordUnresolved keeps the calls that couldn't be linked, with their expression, in
+	// unresolvedCalls.
+	RecordUnresolved bool
+	// ResolvePkgNames keys imports by the name in the imported package's clause instead of
+	// the last element of the import path, see packageNameResolver.
+	ResolvePkgNames bool
+	// IncludeTests analyzes _test.go files too: their functions become definitions marked
+	// TestFile, and external test packages get the import path of their directory + "_test".
+	IncludeTests bool
+	// CacheDir holds the per-file records of earlier runs, so unchanged files aren't parsed
+	// again. Caching is off when it is empty.
+	CacheDir  string
+	GitIgnore bool // Also skip the paths matched by the targets' .gitignore files
+	// Languages names the analyzers to run, see RegisterAnalyzer. Go alone when empty.
+	Languages []string
+}
+
+// defaultGeneratedDirs are directory names that conventionally hold generated code.
+var defaultGeneratedDirs = []string{"pb", "mocks", "mock", "ent", "zz_generated"}
+
+// stringListFlag collects the values of a flag that may be repeated.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
 var (
 	definitions = make(map[string]Definition)
 	mappings    = make(map[string]*Mapping)
-	fileSet     = token.NewFileSet()
+	typeDefs    = make(map[string]*TypeDef)
+	// typeMethods maps a type ID to the names of the methods declared on it.
+	typeMethods = make(map[string]map[string]bool)
+	// interfaceAssertions holds the {type ID, interface ID} pairs of `var _ I = (*T)(nil)` declarations.
+	interfaceAssertions [][2]string
+	// astCache holds the files parsed in Pass 1 for reuse in Pass 2, see parseGoFile.
+	astCache = make(map[string]*ast.File)
+	// initIDs maps initKey(pkg, file, line) to the ID assigned to that init function.
+	initIDs = make(map[string]string)
+	// packageImports maps each analyzed package to the import paths its files use, filled in Pass 2.
+	packageImports = make(map[string]map[string]bool)
+	resolution     = ResolutionStats{ByReason: make(map[string]int), ByPackage: make(map[string]PackageResolution)}
+	// unresolvedCalls holds the calls left out of the map, recorded with -unresolved.
+	unresolvedCalls []UnresolvedCall
+	// valueMappings holds the package-level constants and variables and their references,
+	// recorded with -track-vars apart from mappings so the call graph only has functions.
+	valueMappings = make(map[string]*Mapping)
+
+	// goEnvCache holds the output of `go env -json`, loaded once per process.
+	goEnvOnce  sync.Once
+	goEnvCache map[string]string
+	goEnvErr   error
+	// runGoEnv runs `go env -json`; tests replace it to count the invocations.
+	runGoEnv = func() ([]byte, error) { return exec.Command("go", "env", "-json").Output() }
 )
 
+// passState is what definitionsIn and callSitesIn read besides the file itself: the options
+// of a run, the types its Pass 1 found and its -resolve-pkg-names resolver. Analyze hands it
+// to the analyzers on every target and keeps it in the Result, so /api/analyze never reads
+// the globals a -watch rebuild resets.
+type passState struct {
+	opts         *Options
+	typeDefs     map[string]*TypeDef
+	packageNames *packageNameResolver
+}
+
+// exitFuncs are run, last registered first, when main returns or exits early through
+// fatalf or exit, which skip deferred calls.
+var exitFuncs []func()
+
+// atExit registers f to be run by runAtExit.
+func atExit(f func()) {
+	exitFuncs = append(exitFuncs, f)
+}
+
+// runAtExit runs and forgets the registered exit functions.
+func runAtExit() {
+	for len(exitFuncs) > 0 {
+		f := exitFuncs[len(exitFuncs)-1]
+		exitFuncs = exitFuncs[:len(exitFuncs)-1]
+		f()
+	}
+}
+
+// exit runs the exit functions and ends the process with code.
+func exit(code int) {
+	runAtExit()
+	os.Exit(code)
+}
+
+// fatalf logs like log.Fatalf, but runs the exit functions first, so that e.g. the sources
+// extracted by -path - are removed.
+func fatalf(format string, args ...any) {
+	log.Printf(format, args...)
+	exit(1)
+}
+
 func main() {
 	// --- 1. Flags and Configuration ---
-	targetPath := flag.String("path", ".", "Path to the Go application to analyze")
+	targetPath := flag.String("path", ".", "Path to the Go application to analyze; a comma-separated list analyzes several modules together")
+	workspace := flag.Bool("workspace", true, "If -path holds a go.work file, also analyze the modules it uses; -workspace=false analyzes only -path")
 	outputFile := flag.String("out", "codemap.json", "Output JSON file name")
+	outputFormat := flag.String("format", "json", fmt.Sprintf("Output format, one of %v", outputFormatNames()))
+	layout := flag.Bool("layout", false, "With -format graph, computes node positions server-side so the visualizer can skip its own layout")
+	root := flag.String("root", "", "With -format graph, dot or mermaid, only output what is reachable from this definition ID")
+	layoutSeed := flag.Int64("layout-seed", 1, "Seed for the -layout node ordering; the same seed always yields the same positions")
 	serveAddr := flag.String("serve", "", "If set, serves visualization on this address (e.g., ':8080')")
 	visualizerDir := flag.String("viz-dir", "./visualizer", "Path to the visualizer's static files (html, css, js)")
+	basePath := flag.String("base-path", "", "URL path prefix to mount the visualization server under (e.g., '/codemapper')")
 	goModCache := flag.String("gopath", "", "Path to Go's module cache (GOMODCACHE). If empty, will try to auto-detect.")
+	packagePath := flag.String("package", "", "Import path of a single package to analyze instead of the whole module at -path (e.g., 'github.com/me/proj/internal/foo')")
+	recursive := flag.Bool("recursive", false, "With -package, also analyze the packages below it")
 	analyzeDeps := flag.String("analyze-deps", "", "Comma-separated list of external dependency prefixes to analyze (e.g., 'bitbucket/ggwp,github.com/gin-gonic/gin')")
-	skipPatternsRaw := flag.String("skip", "", "Comma-separated list of path substrings to skip (e.g., 'ent,models,generated')") // <<< CHANGED
+	depDepth := flag.Int("dep-depth", 1, fmt.Sprintf("How many levels of requirements of the -analyze-deps matches to analyze too (1 = only the matches, max %d)", maxDepDepth))
+	skipPatternsRaw := flag.String("skip", "", "Comma-separated list of paths to skip: substrings, globs (e.g., 'internal/*/gen.go') or regexps prefixed with 're:'")
+	buildTags := flag.String("tags", "", "Comma-separated list of build tags; when set, files are selected by their //go:build constraints")
+	var envOverrides stringListFlag
+	flag.Var(&envOverrides, "env", "KEY=VALUE environment override (GOOS, GOARCH, CGO_ENABLED) used to select files by build constraints; may be repeated")
+	skipGenerated := flag.Bool("skip-common-generated", false, fmt.Sprintf("Skip directories that conventionally hold generated code: %s", strings.Join(defaultGeneratedDirs, ",")))
+	generatedDirs := flag.String("generated-dirs", "", "Comma-separated directory names to use instead of the -skip-common-generated defaults")
+	metaOut := flag.String("meta-out", "", "If set, writes run metadata (targets, resolution summary) as JSON to this file")
+	defIndexOut := flag.String("def-index-out", "", "If set, writes the Pass 1 definition index as JSON to this file")
+	defIndexIn := flag.String("def-index-in", "", "If set, loads the definition index from this file and skips Pass 1")
+	maxCallSites := flag.Int("max-call-sites-per-def", 0, "If > 0, keeps only the first N call sites (by file and line) of each definition")
+	callContext := flag.Bool("call-context", false, "Record on each call site the statement it appears in (if, loop, switch, select, return, assign, go, defer)")
+	sccReport := flag.String("report-sccs", "", "If set, writes the mutually recursive function clusters (strongly-connected components of the call graph) as JSON to this file")
+	cyclesReport := flag.String("cycles", "", "If set, writes every recursive function and mutually recursive cluster as JSON to this file")
+	perPackageKinds := flag.Bool("per-package-kinds", false, "Include per-package function/method/constructor counts in the metadata")
+	jobs := flag.Int("jobs", runtime.NumCPU(), "Number of files to parse in parallel")
+	gitIgnore := flag.Bool("gitignore", false, "Skip the paths matched by .gitignore files, including nested ones")
+	languages := flag.String("lang", strings.Join(defaultLanguages, ","), fmt.Sprintf("Comma-separated languages to analyze, from %v", analyzerNames()))
+	noCache := flag.Bool("no-cache", false, fmt.Sprintf("Don't read or write the per-file analysis cache in <path>/%s", cacheDirName))
+	includeTests := flag.Bool("include-tests", false, "Also analyze _test.go files, recording test functions as definitions and their calls as call sites")
+	lowMemory := flag.Bool("low-memory", false, "Don't keep parsed files between the two passes; lowers peak memory at the cost of parsing every file twice")
+	redactPaths := flag.Bool("redact-paths", false, "Replace file paths in the output with stable hashes and omit analyzed root directories")
+	typesOut := flag.String("types-out", "", "If set, writes the declared types with method set and interface-satisfaction counts as JSON to this file")
+	impactBase := flag.String("impact-base", "", "If set, only outputs the definitions changed since this git ref together with their transitive callers")
+	impactHead := flag.String("impact-head", "", "With -impact-base, the git ref to compare against instead of the working tree")
+	focus := flag.String("focus", "", "If set, only outputs the definitions of the packages at or below this import path, and the definitions calling them directly")
+	deadCode := flag.String("dead-code", "", "If set, writes the definitions that are never called (excluding main, init and test functions) as JSON to this file")
+	summaryReport := flag.String("summary", "", "If set, writes per-package definition, call site and file counts as JSON to this file, most called packages first")
+	unresolvedReport := flag.String("unresolved", "", "If set, writes every call expression that couldn't be linked to a definition to this text file, one per line: reason, expression, caller and position, tab-separated")
+	trackVars := flag.String("track-vars", "", "If set, records package-level constants and variables and writes them with their references from functions as JSON to this file")
+	entryPointsReport := flag.String("entrypoints", "", "If set, writes the entry points (main, init and test functions) as JSON to this file")
+	archRules := flag.String("arch-rules", "", "If set, reads chains of package layers such as 'handlers -> services -> repositories' from this YAML file and logs every call going up a chain")
+	archCheck := flag.Bool("arch-check", false, "With -arch-rules, exit with status 1 when a call violates the layering")
+	exportedAsUsed := flag.Bool("treat-exported-as-used", false, "With -dead-code, leave out exported functions and methods, which code outside the analysis may call")
+	var assertUnused, assertUsed stringListFlag
+	flag.Var(&assertUnused, "assert-unused", "Definition ID (e.g. 'github.com/me/proj/pkg.Func') that must have no call sites; exits with status 1 otherwise. May be repeated")
+	flag.Var(&assertUsed, "assert-used", "Definition ID that must have at least one call site; exits with status 1 otherwise. May be repeated")
+	strict := flag.Bool("strict", false, "Fail instead of skipping files that can't be parsed")
+	typeCheck := flag.Bool("types", false, "Type-check the analyzed packages to resolve method calls on variables and fields (slower, keeps every package in memory)")
+	resolveInterfaces := flag.Bool("resolve-interfaces", false, "With -types, link calls through interface methods to every implementing method (may over-connect the graph)")
+	resolvePkgNames := flag.Bool("resolve-pkg-names", false, "Look up the declared name of every imported package, for import paths like gopkg.in/yaml.v3 whose last element isn't the package name")
+	warnDeprecated := flag.Bool("warn-deprecated", false, "Log every call to a function whose doc comment marks it as Deprecated:")
+	embedSource := flag.Bool("embed-source", false, "Keep the source of every definition in the output, so it can be read without the repository (makes the output much larger)")
+	sourceMax := flag.Int("source-max", 20000, "With -embed-source, cut each definition's source to this many bytes; 0 keeps it whole")
+	docMax := flag.Int("doc-max", 500, "Keep each definition's doc comment in the output, cut to this many characters; 0 leaves doc comments out")
+	watch := flag.Bool("watch", false, "Keep running and analyze again, rewriting -out, whenever a source file under -path changes")
+	withOffsets := flag.Bool("with-offsets", false, "Record the zero-based byte offset of every definition and call site")
+	validatePath := flag.String("validate", "", "Check an existing json output file against the codemap JSON Schema and exit instead of analyzing")
+	cpuProfile := flag.String("cpuprofile", "", "If set, writes a CPU profile of the analysis and output to this file, for go tool pprof")
+	memProfile := flag.String("memprofile", "", "If set, writes a heap profile taken once the output is written to this file, for go tool pprof")
+	configPath := flag.String("config", "", "Read flag values from this YAML or JSON file (e.g., 'codemap.yaml'); flags given on the command line override it")
 	flag.Parse()
 
-	// <<< CHANGED: Process the skip patterns into a slice for easy use
-	var skipPatterns []string
-	if *skipPatternsRaw != "" {
-		skipPatterns = strings.Split(*skipPatternsRaw, ",")
-	}
-
-	if *goModCache == "" {
-		cmd := exec.Command("go", "env", "GOMODCACHE")
-		out, err := cmd.Output()
+	if *configPath != "" {
+		config, err := loadConfigFile(*configPath)
 		if err != nil {
-			log.Fatalf("Could not auto-detect GOMODCACHE. Please specify it with the -gopath flag. Error: %v", err)
+			fatalf("Could not read -config %s: %v", *configPath, err)
+		}
+		if err := applyConfig(flag.CommandLine, config); err != nil {
+			fatalf("Invalid -config %s: %v", *configPath, err)
 		}
-		*goModCache = strings.TrimSpace(string(out))
-		log.Printf("Auto-detected GOMODCACHE: %s", *goModCache)
 	}
 
-	mainModulePath, err := getModulePath(*targetPath)
-	if err != nil {
-		log.Fatalf("Error finding module path in %s: %v", *targetPath, err)
+	if *validatePath != "" {
+		violations, err := validateFile(*validatePath)
+		if err != nil {
+			fatalf("Could not validate %s: %v", *validatePath, err)
+		}
+		for i, violation := range violations {
+			if i == maxReportedViolations {
+				log.Printf("... and %d more", len(violations)-i)
+				break
+			}
+			log.Printf("Invalid: %s", violation)
+		}
+		if len(violations) > 0 {
+			fatalf("%s doesn't match the codemap schema: %d violations", *validatePath, len(violations))
+		}
+		log.Printf("%s matches the codemap schema", *validatePath)
+		return
 	}
-	log.Printf("Analyzing main module: %s\n", mainModulePath)
 
-	// --- 2. Identify all codebases to analyze (local project + dependencies) ---
-	analysisTargets := []AnalysisTarget{{FSRoot: *targetPath, ModulePath: mainModulePath}}
-	if *analyzeDeps != "" {
-		depPrefixes := strings.Split(*analyzeDeps, ",")
-		log.Printf("Finding specified dependencies to analyze: %v", depPrefixes)
-		dependencyTargets, err := findDependencyPaths(*targetPath, *goModCache, depPrefixes)
+	stopCPUProfile := func() {}
+	if *cpuProfile != "" {
+		stop, err := startCPUProfile(*cpuProfile)
 		if err != nil {
-			log.Fatalf("Could not resolve dependency paths: %v", err)
+			fatalf("Could not start the CPU profile: %v", err)
 		}
-		analysisTargets = append(analysisTargets, dependencyTargets...)
+		stopCPUProfile = stop
 	}
 
-	// --- 3. Run Analysis Passes ---
-	log.Println("Pass 1: Finding all function definitions...")
-	for _, target := range analysisTargets {
-		log.Printf("Scanning definitions in %s (%s)", target.ModulePath, target.FSRoot)
-		err := walkAndProcess(target, skipPatterns, findDefinitions) // <<< CHANGED
+	roots := strings.Split(*targetPath, ",")
+	if roots[0] == stdinPath {
+		if *watch {
+			fatalf("-watch can't be used with -path %s, which reads the sources from standard input", stdinPath)
+		}
+		moduleDir, tmpDir, err := extractSourceArchive(os.Stdin)
 		if err != nil {
-			log.Fatalf("Error during definition scan in %s: %v", target.FSRoot, err)
+			fatalf("Could not read the sources from standard input: %v", err)
 		}
+		atExit(func() { os.RemoveAll(tmpDir) })
+		defer runAtExit()
+		log.Printf("Extracted the sources from standard input into %s", moduleDir)
+		roots[0] = moduleDir
+		*noCache = true // The extracted tree is removed on exit, so its cache would never be reused
 	}
-
-	log.Println("Pass 2: Finding all call sites...")
-	for _, target := range analysisTargets {
-		log.Printf("Scanning call sites in %s (%s)", target.ModulePath, target.FSRoot)
-		err := walkAndProcess(target, skipPatterns, findCallSites) // <<< CHANGED
+	opts := Options{
+		TargetPath: roots[0], ModuleRoots: roots[1:], Workspace: *workspace, GoModCache: *goModCache, DepDepth: *depDepth,
+		Layout: *layout, LayoutSeed: *layoutSeed, Root: *root, Jobs: *jobs, CallContext: *callContext, LowMemory: *lowMemory,
+		Package: *packagePath, Recursive: *recursive, DefIndexIn: *defIndexIn, DefIndexOut: *defIndexOut,
+		PerPackageKinds: *perPackageKinds, ImpactBase: *impactBase, ImpactHead: *impactHead, Strict: *strict,
+		WithOffsets: *withOffsets, WarnDeprecated: *warnDeprecated, TypeCheck: *typeCheck, DocMax: *docMax,
+		ResolveInterfaces: *resolveInterfaces, TrackVars: *trackVars != "", EmbedSource: *embedSource, SourceMax: *sourceMax,
+		ResolvePkgNames: *resolvePkgNames, RecordUnresolved: *unresolvedReport != "", Focus: *focus,
+		IncludeTests: *includeTests,
+	}
+	opts.Languages = strings.Split(*languages, ",")
+	opts.GitIgnore = *gitIgnore
+	if opts.Focus != "" && opts.ImpactBase != "" {
+		fatalf("-focus can't be combined with -impact-base, which selects the definitions to output itself")
+	}
+	if *archCheck && *archRules == "" {
+		fatalf("-arch-check needs -arch-rules to know which calls are allowed")
+	}
+	var archChains []archLayers
+	if *archRules != "" {
+		chains, err := loadArchRules(*archRules)
 		if err != nil {
-			log.Fatalf("Error during call site scan in %s: %v", target.FSRoot, err)
+			fatalf("Invalid -arch-rules %s: %v", *archRules, err)
 		}
+		archChains = chains
 	}
-
-	// --- 4. Serialize and Output Results ---
-	var finalMappings []Mapping
-	// <<< CHANGED: Filter out mappings that have no call sites.
-	for _, m := range mappings {
-		if len(m.CallSites) > 0 {
-			finalMappings = append(finalMappings, *m)
+	if opts.ResolveInterfaces && !opts.TypeCheck {
+		fatalf("-resolve-interfaces needs -types to know which calls go through interfaces")
+	}
+	if _, err := enabledAnalyzers(opts.Languages); err != nil {
+		fatalf("Invalid -lang: %v", err)
+	}
+	if !*noCache {
+		opts.CacheDir = filepath.Join(opts.TargetPath, cacheDirName)
+	}
+	if _, err := lookupOutputWriter(*outputFormat); err != nil {
+		fatalf("Invalid -format: %v", err)
+	}
+	if *analyzeDeps != "" {
+		opts.AnalyzeDeps = strings.Split(*analyzeDeps, ",")
+	}
+	if *skipPatternsRaw != "" {
+		opts.SkipPatterns = strings.Split(*skipPatternsRaw, ",")
+		if _, err := compileSkipPatterns(opts.SkipPatterns); err != nil {
+			fatalf("Invalid -skip: %v", err)
 		}
 	}
-
-	jsonData, err := json.MarshalIndent(finalMappings, "", "  ")
-	if err != nil {
-		log.Fatalf("Error marshalling JSON: %v", err)
+	if *skipGenerated {
+		opts.GeneratedDirs = defaultGeneratedDirs
+		if *generatedDirs != "" {
+			opts.GeneratedDirs = strings.Split(*generatedDirs, ",")
+		}
 	}
-
-	err = os.WriteFile(*outputFile, jsonData, 0644)
+	if *buildTags != "" {
+		opts.BuildTags = strings.Split(*buildTags, ",")
+	}
+	opts.Env = envOverrides
+	if len(opts.BuildTags) > 0 || len(opts.Env) > 0 {
+		ctx, err := newBuildContext(opts.BuildTags, opts.Env)
+		if err != nil {
+			fatalf("Invalid build environment: %v", err)
+		}
+		opts.BuildContext = ctx
+		log.Printf("Selecting files for GOOS=%s GOARCH=%s CGO_ENABLED=%t tags=%v", ctx.GOOS, ctx.GOARCH, ctx.CgoEnabled, ctx.BuildTags)
+	}
+	// --- 2. Run the analysis ---
+	result, err := Analyze(opts)
 	if err != nil {
-		log.Fatalf("Error writing to %s: %v", err)
+		fatalf("Analysis failed: %v", err)
 	}
-	log.Printf("Successfully created mapping file: %s", *outputFile)
-
-	if *serveAddr != "" {
-		serveVisualization(*serveAddr, *outputFile, *visualizerDir)
+	outputStart := time.Now()
+	if *root != "" {
+		if _, ok := result.Definitions[*root]; !ok {
+			fatalf("Invalid -root: no definition with ID %s", *root)
+		}
 	}
-}
+	// Taken before -redact-paths removes the roots from the metadata.
+	watched := watchRoots(result.Metadata.Targets, opts.GoModCache)
 
-// <<< CHANGED: Function signature updated to accept skipPatterns
-// walkAndProcess abstracts the file walking logic for a given analysis target.
-func walkAndProcess(target AnalysisTarget, skipPatterns []string, processor func(filePath string, target AnalysisTarget)) error {
-	return filepath.WalkDir(target.FSRoot, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+	// --- 3. Serialize and Output Results ---
+	if *sccReport != "" {
+		if err := writeSCCReport(*sccReport, result.Mappings, false); err != nil {
+			fatalf("Error writing SCC report: %v", err)
+		}
+		log.Printf("Successfully created SCC report: %s", *sccReport)
+	}
+	if *cyclesReport != "" {
+		if err := writeSCCReport(*cyclesReport, result.Mappings, true); err != nil {
+			fatalf("Error writing cycles report: %v", err)
+		}
+		log.Printf("Successfully created cycles report: %s", *cyclesReport)
+	}
+	if *deadCode != "" {
+		dead := deadDefinitions(result, *exportedAsUsed)
+		if err := writeDeadCodeReport(*deadCode, dead); err != nil {
+			fatalf("Error writing dead code report: %v", err)
+		}
+		log.Printf("Successfully created dead code report with %d definitions: %s", len(dead), *deadCode)
+	}
+	if *entryPointsReport != "" {
+		entries := entryPoints(result)
+		if err := writeEntryPointsReport(*entryPointsReport, entries); err != nil {
+			fatalf("Error writing entry points report: %v", err)
+		}
+		log.Printf("Successfully created entry points report with %d definitions: %s", len(entries), *entryPointsReport)
+	}
+	if *trackVars != "" {
+		values := valueReport(result)
+		if err := writeValuesReport(*trackVars, values); err != nil {
+			fatalf("Error writing values report: %v", err)
+		}
+		log.Printf("Successfully created values report with %d constants and variables: %s", len(values), *trackVars)
+	}
+	if *unresolvedReport != "" {
+		if err := writeUnresolvedReport(*unresolvedReport, result.unresolved); err != nil {
+			fatalf("Error writing unresolved calls report: %v", err)
+		}
+		log.Printf("Successfully created unresolved calls report with %d calls: %s", len(result.unresolved), *unresolvedReport)
+	}
+	if *summaryReport != "" {
+		if err := writeSummaryReport(*summaryReport, packageSummaries(result)); err != nil {
+			fatalf("Error writing summary report: %v", err)
 		}
+		log.Printf("Successfully created summary report: %s", *summaryReport)
+	}
 
-		// <<< CHANGED: Check if the path should be skipped based on user-provided patterns.
-		for _, pattern := range skipPatterns {
-			// Ensure we don't match on empty strings from the split
-			if pattern != "" && strings.Contains(path, pattern) {
-				log.Printf("Skipping path due to skip pattern '%s': %s", pattern, path)
-				// If it's a directory, skip the whole directory.
-				if d.IsDir() {
-					return filepath.SkipDir
-				}
-				// If it's a file, just skip this file.
-				return nil
+	// writeResult writes the output file; -watch runs it again after every rebuild.
+	writeResult := func(result *Result) error {
+		if *maxCallSites > 0 {
+			for i := range result.Mappings {
+				capCallSites(&result.Mappings[i], *maxCallSites)
 			}
 		}
-
-		if !d.IsDir() && strings.HasSuffix(path, ".go") && !strings.HasSuffix(path, "_test.go") {
-			processor(path, target)
+		if *redactPaths {
+			redactOutput(result)
+		}
+		if err := writeOutputFile(*outputFile, *outputFormat, result); err != nil {
+			return fmt.Errorf("writing to %s: %w", *outputFile, err)
 		}
+		log.Printf("Successfully created mapping file: %s", *outputFile)
 		return nil
-	})
-}
-
-// getModulePath reads the module path from a go.mod file.
-func getModulePath(targetDir string) (string, error) {
-	goModPath := filepath.Join(targetDir, "go.mod")
-	content, err := os.ReadFile(goModPath)
-	if err != nil {
-		return "", fmt.Errorf("could not read go.mod in '%s': %w", targetDir, err)
 	}
-	return modfile.ModulePath(content), nil
-}
-
-// findDependencyPaths parses the go.mod file to find the filesystem paths of specified dependencies.
-func findDependencyPaths(projectRoot, goModCache string, depPrefixes []string) ([]AnalysisTarget, error) {
-	var targets []AnalysisTarget
-	goModPath := filepath.Join(projectRoot, "go.mod")
-	content, err := os.ReadFile(goModPath)
-	if err != nil {
-		return nil, fmt.Errorf("could not read go.mod in '%s': %w", projectRoot, err)
+	if err := writeResult(result); err != nil {
+		fatalf("Error %v", err)
 	}
 
-	modFile, err := modfile.Parse(goModPath, content, nil)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse go.mod: %w", err)
+	if *metaOut != "" {
+		metaData, err := json.MarshalIndent(result.Metadata, "", "  ")
+		if err != nil {
+			fatalf("Error marshalling metadata: %v", err)
+		}
+		if err := os.WriteFile(*metaOut, metaData, 0644); err != nil {
+			fatalf("Error writing to %s: %v", *metaOut, err)
+		}
+		log.Printf("Successfully created metadata file: %s", *metaOut)
 	}
 
-	for _, req := range modFile.Require {
-		for _, prefix := range depPrefixes {
-			trimmedPrefix := strings.TrimSpace(prefix)
-			if strings.HasPrefix(req.Mod.Path, trimmedPrefix) {
-				escapedPath, err := module.EscapePath(req.Mod.Path)
-				if err != nil {
-					log.Printf("Warning: could not escape module path %s: %v", req.Mod.Path, err)
-					continue
-				}
-				depPath := filepath.Join(goModCache, escapedPath+"@"+req.Mod.Version)
-				if _, err := os.Stat(depPath); os.IsNotExist(err) {
-					log.Printf("Warning: dependency path not found, skipping: %s", depPath)
-					continue
-				}
-				log.Printf("Found matching dependency: %s version %s at %s", req.Mod.Path, req.Mod.Version, depPath)
-				targets = append(targets, AnalysisTarget{
-					FSRoot:     depPath,
-					ModulePath: req.Mod.Path,
-				})
-				break
-			}
+	if *typesOut != "" {
+		if err := writeTypesReport(*typesOut, result.Types); err != nil {
+			fatalf("Error writing to %s: %v", *typesOut, err)
 		}
+		log.Printf("Successfully created types file: %s", *typesOut)
 	}
-	return targets, nil
-}
+	timings := append(result.Timings, PhaseTiming{Phase: "output", Duration: time.Since(outputStart)})
 
-// findDefinitions scans a single file for function and method definitions.
-func findDefinitions(filePath string, target AnalysisTarget) {
-	node, err := parser.ParseFile(fileSet, filePath, nil, 0)
-	if err != nil {
-		log.Printf("Warning: Could not parse %s: %v\n", filePath, err)
-		return
+	// Profiles cover the first analysis only; -watch and -serve keep running afterwards.
+	stopCPUProfile()
+	if *cpuProfile != "" {
+		log.Printf("Successfully created CPU profile: %s", *cpuProfile)
 	}
-
-	relPath, _ := filepath.Rel(target.FSRoot, filePath)
-	pkgDir := filepath.Dir(relPath)
-	if pkgDir == "." {
-		pkgDir = ""
+	if *memProfile != "" {
+		if err := writeMemProfile(*memProfile); err != nil {
+			fatalf("Error writing memory profile: %v", err)
+		}
+		log.Printf("Successfully created memory profile: %s", *memProfile)
 	}
-	fullPkgPath := filepath.ToSlash(filepath.Join(target.ModulePath, pkgDir))
 
-	ast.Inspect(node, func(n ast.Node) bool {
-		fn, ok := n.(*ast.FuncDecl)
-		if !ok {
-			return true
+	progress.Done()
+	log.Printf("Timings: %s", formatTimings(timings))
+
+	if failures := checkUsageAssertions(result, assertUnused, assertUsed); len(failures) > 0 {
+		for _, f := range failures {
+			log.Printf("Assertion failed: %s", f)
 		}
+		exit(1)
+	}
 
-		funcName := fn.Name.Name
-		def := Definition{
-			Name:     funcName,
-			FilePath: filepath.ToSlash(relPath),
-			Line:     fileSet.Position(fn.Pos()).Line,
-			Package:  fullPkgPath,
+	if archChains != nil {
+		violations := checkArchRules(archChains, result)
+		for _, v := range violations {
+			log.Printf("Layering violation: %s", v)
 		}
+		log.Printf("Layering check: %d violations of %s", len(violations), *archRules)
+		if *archCheck && len(violations) > 0 {
+			exit(1)
+		}
+	}
 
-		if fn.Recv != nil && len(fn.Recv.List) > 0 {
-			typeExpr := fn.Recv.List[0].Type
-			buf := new(bytes.Buffer)
-			if err := printer.Fprint(buf, fileSet, typeExpr); err != nil {
-				log.Printf("Warning: could not print receiver type for %s in %s: %v", funcName, filePath, err)
-				return true
+	handler := &liveHandler{}
+	handler.Store(newVizHandler(*outputFile, *visualizerDir, *basePath, result))
+	if *watch {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		// rebuild analyzes into a new Result, which the handlers only see once it is stored.
+		rebuild := func() {
+			log.Println("Change detected, analyzing again...")
+			result, err := Analyze(opts)
+			outputStart := time.Now()
+			if err == nil {
+				err = writeResult(result)
 			}
-			receiverType := buf.String()
-			def.ID = fmt.Sprintf("%s.%s.%s", fullPkgPath, receiverType, funcName)
-		} else {
-			def.ID = fmt.Sprintf("%s.%s", fullPkgPath, funcName)
+			if err != nil {
+				log.Printf("Rebuild failed, keeping the previous output: %v", err)
+				return
+			}
+			log.Printf("Timings: %s", formatTimings(append(result.Timings, PhaseTiming{Phase: "output", Duration: time.Since(outputStart)})))
+			handler.Store(newVizHandler(*outputFile, *visualizerDir, *basePath, result))
+			progress.Done()
+			progress.Reload()
+		}
+		if *serveAddr == "" {
+			if err := watchTargets(ctx, watched, &opts, rebuild); err != nil {
+				fatalf("Watch failed: %v", err)
+			}
+			return
 		}
+		go func() {
+			if err := watchTargets(ctx, watched, &opts, rebuild); err != nil {
+				log.Printf("Watch failed: %v", err)
+			}
+		}()
+	}
 
-		definitions[def.ID] = def
-		mappings[def.ID] = &Mapping{Definition: def, CallSites: []CallSite{}}
-		return true
-	})
+	if *serveAddr != "" {
+		serveVisualization(*serveAddr, *basePath, handler, result)
+	}
 }
 
-// callSiteVisitor implements ast.Visitor to find function calls with accurate caller context.
-type callSiteVisitor struct {
-	fileSet       *token.FileSet
-	target        AnalysisTarget
-	importMap     map[string]string
-	currentPkg    string
-	callerIDStack []string
+// startCPUProfile starts writing a CPU profile to path and returns the function that stops
+// it and closes the file.
+func startCPUProfile(path string) (func(), error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		if err := f.Close(); err != nil {
+			log.Printf("Warning: could not close the CPU profile %s: %v", path, err)
+		}
+	}, nil
 }
 
-// Visit traverses the AST. It's the core of the improved call site analysis.
-func (v *callSiteVisitor) Visit(n ast.Node) ast.Visitor {
-	if n == nil {
-		return nil
+// writeMemProfile writes a heap profile to path, after a garbage collection so it shows the
+// memory still held by the analysis rather than garbage waiting to be collected.
+func writeMemProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
 	}
+	return f.Close()
+}
 
-	if fn, ok := n.(*ast.FuncDecl); ok {
-		var callerID string
-		if fn.Recv != nil && len(fn.Recv.List) > 0 {
-			typeExpr := fn.Recv.List[0].Type
-			buf := new(bytes.Buffer)
-			if err := printer.Fprint(buf, v.fileSet, typeExpr); err != nil {
-				log.Printf("Warning: could not print receiver type for %s in %s: %v", fn.Name.Name, v.target.FSRoot, err)
-				callerID = fmt.Sprintf("%s.<?>%s", v.currentPkg, fn.Name.Name)
-			} else {
-				callerID = fmt.Sprintf("%s.%s.%s", v.currentPkg, buf.String(), fn.Name.Name)
-			}
-		} else {
-			callerID = fmt.Sprintf("%s.%s", v.currentPkg, fn.Name.Name)
+// checkUsageAssertions checks the -assert-unused and -assert-used definition IDs against the
+// complete call site index of result and describes every assertion that doesn't hold. An ID
+// that was never defined fails both kinds, since it is most likely a typo or a removed API.
+func checkUsageAssertions(result *Result, unused, used []string) []string {
+	var failures []string
+	check := func(id string, wantUsed bool) {
+		m, ok := result.index[id]
+		switch {
+		case !ok:
+			failures = append(failures, fmt.Sprintf("%s is not a known definition", id))
+		case wantUsed && len(m.CallSites) == 0:
+			failures = append(failures, fmt.Sprintf("%s has no call sites", id))
+		case !wantUsed && len(m.CallSites) > 0:
+			first := m.CallSites[0]
+			failures = append(failures, fmt.Sprintf("%s has %d call sites, e.g. %s at %s:%d", id, len(m.CallSites), first.CallerID, first.FilePath, first.Line))
 		}
-		v.callerIDStack = append(v.callerIDStack, callerID)
+	}
+	for _, id := range unused {
+		check(id, false)
+	}
+	for _, id := range used {
+		check(id, true)
+	}
+	return failures
+}
 
-		if fn.Body != nil {
-			ast.Walk(v, fn.Body)
+// deadDefinitions returns the definitions without a single call site in the complete call
+// site index of result, sorted by ID. Entry points (main, init) and test functions are never
+// called by the code itself and are left out, as are exported names when exportedAsUsed is set.
+func deadDefinitions(result *Result, exportedAsUsed bool) []Definition {
+	dead := []Definition{}
+	for _, m := range result.index {
+		def := m.Definition
+		if len(m.CallSites) > 0 || isEntryPoint(def) {
+			continue
 		}
-
-		v.callerIDStack = v.callerIDStack[:len(v.callerIDStack)-1]
-		return nil
+		if exportedAsUsed && token.IsExported(def.Name) {
+			continue
+		}
+		dead = append(dead, def)
 	}
+	sort.Slice(dead, func(i, j int) bool { return dead[i].ID < dead[j].ID })
+	return dead
+}
 
-	if call, ok := n.(*ast.CallExpr); ok {
-		if len(v.callerIDStack) > 0 {
-			calleeID := v.resolveCalleeID(call.Fun)
-			if m, found := mappings[calleeID]; found {
-				relPath, _ := filepath.Rel(v.target.FSRoot, v.fileSet.Position(call.Pos()).Filename)
-				m.CallSites = append(m.CallSites, CallSite{
-					FilePath: filepath.ToSlash(relPath),
-					Line:     v.fileSet.Position(call.Pos()).Line,
-					CallerID: v.callerIDStack[len(v.callerIDStack)-1],
-				})
-			}
+// isEntryPoint reports whether def is run without being called: main, init and test functions.
+func isEntryPoint(def Definition) bool {
+	if def.Kind == "method" {
+		return false
+	}
+	if def.Name == "main" || def.Name == "init" {
+		return true
+	}
+	if !strings.HasSuffix(def.FilePath, "_test.go") {
+		return false
+	}
+	for _, prefix := range []string{"Test", "Benchmark", "Example", "Fuzz"} {
+		if isTestFuncName(def.Name, prefix) {
+			return true
 		}
 	}
-
-	return v
+	return false
 }
 
-// resolveCalleeID determines the unique ID of the function being called.
-func (v *callSiteVisitor) resolveCalleeID(fun ast.Expr) string {
-	switch f := fun.(type) {
-	case *ast.SelectorExpr:
-		if pkgIdent, ok := f.X.(*ast.Ident); ok {
-			if fullPkgPath, found := v.importMap[pkgIdent.Name]; found {
-				return fmt.Sprintf("%s.%s", fullPkgPath, f.Sel.Name)
-			}
-		}
-	case *ast.Ident:
-		return fmt.Sprintf("%s.%s", v.currentPkg, f.Name)
+// isTestFuncName reports whether name is one `go test` runs for prefix: the prefix alone or
+// followed by anything but a lower-case letter, so TestAdd and Test_add count but Testable
+// doesn't.
+func isTestFuncName(name, prefix string) bool {
+	rest, ok := strings.CutPrefix(name, prefix)
+	if !ok {
+		return false
 	}
-	return ""
+	if rest == "" {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(rest)
+	return !unicode.IsLower(r)
 }
 
-// findCallSites prepares and runs the callSiteVisitor on a file.
-func findCallSites(filePath string, target AnalysisTarget) {
-	node, err := parser.ParseFile(fileSet, filePath, nil, 0)
+// writeDeadCodeReport writes the -dead-code definitions as JSON.
+func writeDeadCodeReport(path string, dead []Definition) error {
+	data, err := json.MarshalIndent(dead, "", "  ")
 	if err != nil {
-		log.Printf("Warning: Could not parse %s: %v\n", filePath, err)
-		return
+		return fmt.Errorf("could not marshal dead code report: %w", err)
 	}
+	return os.WriteFile(path, data, 0644)
+}
 
-	relPath, _ := filepath.Rel(target.FSRoot, filePath)
-	pkgDir := filepath.Dir(relPath)
-	if pkgDir == "." {
-		pkgDir = ""
+// entryPoints returns the definitions of result flagged as entry points, sorted by ID.
+func entryPoints(result *Result) []Definition {
+	entries := []Definition{}
+	for _, def := range result.Definitions {
+		if def.EntryPoint {
+			entries = append(entries, def)
+		}
 	}
-	currentFullPkgPath := filepath.ToSlash(filepath.Join(target.ModulePath, pkgDir))
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
 
-	importMap := make(map[string]string)
-	for _, imp := range node.Imports {
-		path := strings.Trim(imp.Path.Value, `"`)
-		if imp.Name != nil {
-			if imp.Name.Name == "_" {
-				continue
-			}
-			importMap[imp.Name.Name] = path
-		} else {
-			parts := strings.Split(path, "/")
-			importMap[parts[len(parts)-1]] = path
-		}
+// writeEntryPointsReport writes the -entrypoints definitions as JSON.
+func writeEntryPointsReport(path string, entries []Definition) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal entry points report: %w", err)
 	}
+	return os.WriteFile(path, data, 0644)
+}
 
-	visitor := &callSiteVisitor{
-		fileSet:       fileSet,
-		target:        target,
-		importMap:     importMap,
-		currentPkg:    currentFullPkgPath,
-		callerIDStack: []string{},
+// valueReport returns the package-level constants and variables of result recorded with
+// -track-vars and their references, sorted by ID.
+func valueReport(result *Result) []Mapping {
+	values := make([]Mapping, 0, len(result.values))
+	for _, m := range result.values {
+		sortCallSites(m.CallSites)
+		countCalls(m)
+		values = append(values, *m)
 	}
-	ast.Walk(visitor, node)
+	sort.Slice(values, func(i, j int) bool { return values[i].Definition.ID < values[j].Definition.ID })
+	return values
 }
 
-// serveVisualization starts a web server to display the results.
-func serveVisualization(addr, jsonFile, vizDir string) {
-	log.Printf("Starting visualization server at http://localhost%s", addr)
-	mux := http.NewServeMux()
-	mux.HandleFunc("/api/codemap", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		http.ServeFile(w, r, jsonFile)
-	})
-	fs := http.FileServer(http.Dir(vizDir))
-	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasSuffix(r.URL.Path, ".css") {
-			w.Header().Set("Content-Type", "text/css")
-		} else if strings.HasSuffix(r.URL.Path, ".js") || strings.HasSuffix(r.URL.Path, ".mjs") {
-			w.Header().Set("Content-Type", "application/javascript")
-		}
-		fs.ServeHTTP(w, r)
-	}))
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		log.Fatalf("Server failed: %v", err)
+// writeValuesReport writes the -track-vars constants and variables as JSON.
+func writeValuesReport(path string, values []Mapping) error {
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal values report: %w", err)
 	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// writeUnresolvedReport writes the calls that weren't linked as text, one per line with the
+// reason, expression, caller ID and file:line separated by tabs, so they can be grouped
+// with cut, sort and uniq to spot the patterns the analysis misses.
+func writeUnresolvedReport(path string, calls []UnresolvedCall) error {
+	var b strings.Builder
+	for _, c := range calls {
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s:%d\n", c.Reason, c.Expr, c.CallerID, c.FilePath, c.Line)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// PackageSummary aggregates the definitions of one package for -summary.
+type PackageSummary struct {
+	Package      string `json:"package"`
+	Definitions  int    `json:"definitions"`
+	Functions    int    `json:"functions"`
+	Methods      int    `json:"methods"`
+	Constructors int    `json:"constructors"`
+	// InboundCallSites is the number of call sites of the package's definitions, from any
+	// package including itself.
+	InboundCallSites int `json:"inboundCallSites"`
+	Files            int `json:"files"` // Files declaring at least one definition
+}
+
+// packageSummaries summarizes every package from the complete call site index of result,
+// sorted by inbound call sites so that the most depended-on packages come first.
+func packageSummaries(result *Result) []PackageSummary {
+	byPackage := make(map[string]*PackageSummary)
+	files := make(map[string]map[string]bool)
+	for _, m := range result.index {
+		def := m.Definition
+		s := byPackage[def.Package]
+		if s == nil {
+			s = &PackageSummary{Package: def.Package}
+			byPackage[def.Package] = s
+			files[def.Package] = make(map[string]bool)
+		}
+		s.Definitions++
+		switch def.Kind {
+		case "function":
+			s.Functions++
+		case "method":
+			s.Methods++
+		case "constructor":
+			s.Constructors++
+		}
+		s.InboundCallSites += len(m.CallSites)
+		files[def.Package][def.FilePath] = true
+	}
+	summaries := make([]PackageSummary, 0, len(byPackage))
+	for pkg, s := range byPackage {
+		s.Files = len(files[pkg])
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].InboundCallSites != summaries[j].InboundCallSites {
+			return summaries[i].InboundCallSites > summaries[j].InboundCallSites
+		}
+		return summaries[i].Package < summaries[j].Package
+	})
+	return summaries
+}
+
+// writeSummaryReport writes the -summary package summaries as JSON.
+func writeSummaryReport(path string, summaries []PackageSummary) error {
+	data, err := json.MarshalIndent(summaries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal summary report: %w", err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// countCallerFiles returns the number of distinct files the call sites are located in.
+func countCallerFiles(sites []CallSite) int {
+	files := make(map[string]bool)
+	for _, cs := range sites {
+		files[cs.FilePath] = true
+	}
+	return len(files)
+}
+
+// sortCallSites orders call sites by file, line and caller. Sites that compare equal are
+// left in the order they were found, which is the same on every run.
+func sortCallSites(sites []CallSite) {
+	sort.SliceStable(sites, func(i, j int) bool {
+		a, b := sites[i], sites[j]
+		if a.FilePath != b.FilePath {
+			return a.FilePath < b.FilePath
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.CallerID < b.CallerID
+	})
+}
+
+// countCalls fills in the call counts of m from its call sites.
+func countCalls(m *Mapping) {
+	callers := make(map[string]bool)
+	for _, cs := range m.CallSites {
+		callers[cs.CallerID] = true
+	}
+	m.CallerFileCount = countCallerFiles(m.CallSites)
+	m.CallCount = len(m.CallSites)
+	m.CallerCount = len(callers)
+}
+
+// capCallSites keeps the first max call sites of m, in sortCallSites order so that the
+// selection is the same on every run, and records the true count.
+func capCallSites(m *Mapping, max int) {
+	if len(m.CallSites) <= max {
+		return
+	}
+	sites := append([]CallSite(nil), m.CallSites...)
+	sortCallSites(sites)
+	m.TotalCallSites = len(sites)
+	m.Truncated = true
+	m.CallSites = sites[:max]
+}
+
+// sortedTypeDefs returns a copy of all recorded types ordered by ID.
+func sortedTypeDefs() []TypeDef {
+	types := make([]TypeDef, 0, len(typeDefs))
+	for _, td := range typeDefs {
+		types = append(types, *td)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].ID < types[j].ID })
+	return types
+}
+
+// writeTypesReport writes the -types-out file: the declared types as JSON.
+func writeTypesReport(path string, types []TypeDef) error {
+	data, err := json.MarshalIndent(types, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal types: %w", err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// redactPath replaces a file path with a stable, non-reversible token. The same path always
+// maps to the same token, so definitions and call sites in one file still line up.
+func redactPath(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	return hex.EncodeToString(sum[:6]) + path.Ext(p)
+}
+
+// redactOutput strips recognizable file system paths from everything that gets written out.
+func redactOutput(result *Result) {
+	for i := range result.Mappings {
+		m := &result.Mappings[i]
+		m.Definition.FilePath = redactPath(m.Definition.FilePath)
+		sites := make([]CallSite, len(m.CallSites))
+		for j, cs := range m.CallSites {
+			cs.FilePath = redactPath(cs.FilePath)
+			sites[j] = cs
+		}
+		m.CallSites = sites
+	}
+	redacted := make(map[string]Definition, len(result.Definitions))
+	for id, def := range result.Definitions {
+		def.FilePath = redactPath(def.FilePath)
+		redacted[id] = def
+	}
+	result.Definitions = redacted
+	for i := range result.Types {
+		result.Types[i].FilePath = redactPath(result.Types[i].FilePath)
+	}
+	targets := make([]AnalysisTarget, len(result.Metadata.Targets))
+	for i, target := range result.Metadata.Targets {
+		target.FSRoot = ""
+		targets[i] = target
+	}
+	result.Metadata.Targets = targets
+}
+
+// writeDefinitionIndex serializes the state Pass 1 leaves for Pass 2: the definitions and
+// types, the methods and interface assertions the type stats come from, and the constants
+// and variables of -track-vars.
+func writeDefinitionIndex(path string) error {
+	index := DefinitionIndex{
+		Definitions: make([]Definition, 0, len(definitions)),
+		Types:       sortedTypeDefs(),
+	}
+	for _, def := range definitions {
+		index.Definitions = append(index.Definitions, def)
+	}
+	sort.Slice(index.Definitions, func(i, j int) bool { return index.Definitions[i].ID < index.Definitions[j].ID })
+	index.Methods = [][2]string{}
+	for typeID, methods := range typeMethods {
+		for name := range methods {
+			index.Methods = append(index.Methods, [2]string{typeID, name})
+		}
+	}
+	sort.Slice(index.Methods, func(i, j int) bool { return pairLess(index.Methods[i], index.Methods[j]) })
+	index.Assertions = append([][2]string{}, interfaceAssertions...)
+	sort.Slice(index.Assertions, func(i, j int) bool { return pairLess(index.Assertions[i], index.Assertions[j]) })
+	for _, m := range valueMappings {
+		index.Values = append(index.Values, m.Definition)
+	}
+	sort.Slice(index.Values, func(i, j int) bool { return index.Values[i].ID < index.Values[j].ID })
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal definition index: %w", err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// pairLess orders {type ID, name} pairs.
+func pairLess(a, b [2]string) bool {
+	if a[0] != b[0] {
+		return a[0] < b[0]
+	}
+	return a[1] < b[1]
+}
+
+// loadDefinitionIndex restores the Pass 1 state from a file written by writeDefinitionIndex.
+func loadDefinitionIndex(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read definition index '%s': %w", path, err)
+	}
+	var index DefinitionIndex
+	if err := json.Unmarshal(content, &index); err != nil {
+		return fmt.Errorf("could not parse definition index '%s': %w", path, err)
+	}
+	for _, def := range index.Definitions {
+		definitions[def.ID] = def
+		mappings[def.ID] = &Mapping{Definition: def, CallSites: []CallSite{}}
+	}
+	for i := range index.Types {
+		typeDefs[index.Types[i].ID] = &index.Types[i]
+	}
+	for _, method := range index.Methods {
+		if typeMethods[method[0]] == nil {
+			typeMethods[method[0]] = make(map[string]bool)
+		}
+		typeMethods[method[0]][method[1]] = true
+	}
+	interfaceAssertions = index.Assertions
+	for _, def := range index.Values {
+		valueMappings[def.ID] = &Mapping{Definition: def, CallSites: []CallSite{}}
+	}
+	log.Printf("Loaded %d definitions and %d types from the index", len(index.Definitions), len(index.Types))
+	return nil
+}
+
+// resolveGoEnv fills in any Options derived from the Go toolchain environment.
+func (o *Options) resolveGoEnv() error {
+	if o.GoModCache != "" {
+		return nil
+	}
+	modCache, err := goEnv("GOMODCACHE")
+	if err != nil {
+		return err
+	}
+	o.GoModCache = modCache
+	log.Printf("Auto-detected GOMODCACHE: %s", o.GoModCache)
+	return nil
+}
+
+// goEnv returns a `go env` variable. The go command is invoked at most once per process;
+// every later lookup, across any number of analyses, is served from the cache.
+func goEnv(key string) (string, error) {
+	goEnvOnce.Do(func() {
+		out, err := runGoEnv()
+		if err != nil {
+			goEnvErr = fmt.Errorf("go env failed: %w", err)
+			return
+		}
+		if err := json.Unmarshal(out, &goEnvCache); err != nil {
+			goEnvErr = fmt.Errorf("could not parse go env output: %w", err)
+		}
+	})
+	if goEnvErr != nil {
+		return "", goEnvErr
+	}
+	value, ok := goEnvCache[key]
+	if !ok || value == "" {
+		return "", fmt.Errorf("go env %s is not set", key)
+	}
+	return value, nil
+}
+
+// newBuildContext returns a copy of the default build context adjusted by the given build tags
+// and KEY=VALUE environment overrides.
+func newBuildContext(tags, env []string) (*build.Context, error) {
+	ctx := build.Default
+	ctx.BuildTags = append([]string(nil), tags...)
+	for _, kv := range env {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected KEY=VALUE, got %q", kv)
+		}
+		switch key {
+		case "GOOS":
+			ctx.GOOS = value
+		case "GOARCH":
+			ctx.GOARCH = value
+		case "CGO_ENABLED":
+			ctx.CgoEnabled = value == "1"
+		default:
+			log.Printf("Warning: environment override %s does not affect file selection, ignoring", key)
+		}
+	}
+	return &ctx, nil
+}
+
+// walkAndProcess runs an analysis pass over the files of a target, each file going to the
+// enabled analyzer that matches it. Files whose record for the pass is in the cache are
+// replayed without being parsed.
+func walkAndProcess(target AnalysisTarget, pass analysisPass) error {
+	opts := target.state.opts
+	enabled, err := enabledAnalyzers(opts.Languages)
+	if err != nil {
+		return err
+	}
+	analyzerOf := make(map[string]Analyzer)
+	skipPatterns, err := compileSkipPatterns(opts.SkipPatterns)
+	if err != nil {
+		return err
+	}
+	ignore := &ignoreMatcher{}
+	if opts.GitIgnore {
+		if err := ignore.loadIgnoreFile(filepath.Join(target.FSRoot, ".gitignore"), ""); err != nil {
+			log.Printf("Warning: could not load .gitignore rules of %s: %v", target.FSRoot, err)
+		}
+	}
+	if err := ignore.loadIgnoreFile(filepath.Join(target.FSRoot, ignoreFileName), ""); err != nil {
+		log.Printf("Warning: could not load %s rules of %s: %v", ignoreFileName, target.FSRoot, err)
+	}
+	var files []string
+	excluded := 0 // Dependency files for another platform
+	err = filepath.WalkDir(target.FSRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() && path != target.FSRoot && target.SinglePackage {
+			return filepath.SkipDir
+		}
+		if d.IsDir() && len(target.NestedRoots) > 0 {
+			if rel, err := filepath.Rel(target.FSRoot, path); err == nil && slices.Contains(target.NestedRoots, filepath.ToSlash(rel)) {
+				log.Printf("Skipping module analyzed as its own target: %s", path)
+				return filepath.SkipDir
+			}
+		}
+		if d.IsDir() && path != target.FSRoot {
+			for _, name := range opts.GeneratedDirs {
+				if name != "" && d.Name() == name {
+					log.Printf("Skipping generated code directory: %s", path)
+					return filepath.SkipDir
+				}
+			}
+		}
+
+		if rel, err := filepath.Rel(target.FSRoot, path); err == nil && rel != "." && ignore.Match(filepath.ToSlash(rel), d.IsDir()) {
+			log.Printf("Skipping path matched by ignore rules: %s", path)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Check if the path should be skipped based on user-provided patterns.
+		rel, _ := filepath.Rel(target.FSRoot, path)
+		for _, pattern := range skipPatterns {
+			if rel != "." && pattern.Match(filepath.ToSlash(rel)) {
+				log.Printf("Skipping path due to skip pattern '%s': %s", pattern.raw, path)
+				// If it's a directory, skip the whole directory.
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				// If it's a file, just skip this file.
+				return nil
+			}
+		}
+
+		// A nested .gitignore applies to the directory it is in, on top of its parents' rules.
+		if d.IsDir() && path != target.FSRoot && opts.GitIgnore {
+			if err := ignore.loadIgnoreFile(filepath.Join(path, ".gitignore"), filepath.ToSlash(rel)); err != nil {
+				log.Printf("Warning: could not load .gitignore rules of %s: %v", path, err)
+			}
+		}
+
+		if !d.IsDir() {
+			for _, a := range enabled {
+				if a.Match(filepath.Dir(path), d.Name(), opts) {
+					if _, isGo := a.(goAnalyzer); isGo && target.Dependency && !matchesDefaultBuild(filepath.Dir(path), d.Name(), opts) {
+						excluded++
+						break
+					}
+					files = append(files, path)
+					analyzerOf[path] = a
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if excluded > 0 && pass.name == definitionsPass.name {
+		log.Printf("Skipped %d files of %s excluded by build constraints for %s/%s", excluded, target.ModulePath, build.Default.GOOS, build.Default.GOARCH)
+	}
+
+	cache := newAnalysisCache(opts)
+	keys := make(map[string]string, len(files))
+	cached := make(map[string]fileRecord)
+	var toParse []string
+	for _, path := range files {
+		if cache != nil {
+			keys[path] = cache.key(pass.name+"/"+analyzerOf[path].Name(), target, path)
+			if rec, ok := cache.get(keys[path], pass); ok {
+				cached[path] = rec
+				continue
+			}
+		}
+		if _, isGo := analyzerOf[path].(goAnalyzer); isGo {
+			toParse = append(toParse, path)
+		}
+	}
+	if cache != nil {
+		log.Printf("Reusing %d of %d files from the cache, parsing %d", len(cached), len(files), len(files)-len(cached))
+	}
+
+	prefetch := startPrefetch(toParse, target.FileSet, opts.Jobs)
+	for _, path := range files {
+		rec, ok := cached[path]
+		if ok {
+			if !pass.keepAST {
+				delete(astCache, path)
+			}
+		} else {
+			prefetch.wait(path)
+			start := time.Now()
+			if rec, ok = pass.scan(analyzerOf[path], path, target); ok && cache != nil && !hasParseError(path) {
+				cache.put(keys[path], rec)
+			}
+			if took := time.Since(start); took > slowFileThreshold {
+				log.Printf("Slow file: %s took %s in the %s pass", path, took.Round(time.Millisecond), pass.name)
+			}
+		}
+		if ok {
+			rec.apply(target)
+		}
+		progress.FileDone(target.ModulePath)
+	}
+	return nil
+}
+
+// parsedFile is the outcome of parsing one file ahead of its processor.
+type parsedFile struct {
+	node *ast.File
+	err  error
+}
+
+// prefetcher parses files on a pool of goroutines so that parsing, the bulk of the work,
+// runs in parallel while the processors still see the files one at a time and in walk
+// order. That keeps the shared maps single-threaded and the output identical to a serial
+// run. At most a few files per worker are parsed ahead of the processors.
+type prefetcher struct {
+	results map[string]chan parsedFile
+	window  chan struct{}
+}
+
+// prefetched holds the ASTs handed over by a prefetcher to parseGoFile.
+var prefetched = make(map[string]parsedFile)
+
+// startPrefetch starts parsing files on jobs goroutines. With one job, or nothing left to
+// parse, it returns a prefetcher that does nothing and files are parsed by the processors.
+func startPrefetch(files []string, fset *token.FileSet, jobs int) *prefetcher {
+	var todo []string
+	for _, path := range files {
+		if _, cached := astCache[path]; !cached {
+			todo = append(todo, path)
+		}
+	}
+	p := &prefetcher{results: make(map[string]chan parsedFile, len(todo))}
+	if jobs <= 1 || len(todo) == 0 {
+		return p
+	}
+	for _, path := range todo {
+		p.results[path] = make(chan parsedFile, 1)
+	}
+	p.window = make(chan struct{}, 4*jobs)
+	queue := make(chan string)
+	go func() {
+		for _, path := range todo {
+			p.window <- struct{}{}
+			queue <- path
+		}
+		close(queue)
+	}()
+	for i := 0; i < jobs; i++ {
+		go func() {
+			for path := range queue {
+				node, err := parseSourceFile(fset, path)
+				p.results[path] <- parsedFile{node, err}
+			}
+		}()
+	}
+	return p
+}
+
+// wait blocks until path has been parsed, if it is being prefetched, and hands its AST to
+// parseGoFile.
+func (p *prefetcher) wait(path string) {
+	ch, ok := p.results[path]
+	if !ok {
+		return
+	}
+	prefetched[path] = <-ch
+	<-p.window
+}
+
+// getModulePath reads the module path from a go.mod file.
+func getModulePath(targetDir string) (string, error) {
+	goModPath := filepath.Join(targetDir, "go.mod")
+	content, err := os.ReadFile(goModPath)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%w in '%s'", ErrNoGoMod, targetDir)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read go.mod in '%s': %w", targetDir, err)
+	}
+	return modfile.ModulePath(content), nil
+}
+
+// goModGoVersion returns the `go` directive of the go.mod in dir, or "" when there is no
+// go.mod or it declares no version (modules that predate the directive).
+func goModGoVersion(dir string) string {
+	goModPath := filepath.Join(dir, "go.mod")
+	content, err := os.ReadFile(goModPath)
+	if err != nil {
+		return ""
+	}
+	modFile, err := modfile.ParseLax(goModPath, content, nil)
+	if err != nil || modFile.Go == nil {
+		return ""
+	}
+	return modFile.Go.Version
+}
+
+// resolvePackageTarget maps an import path to the directory holding its sources using
+// `go list`, run from the module at moduleDir. If the go command fails, packages of the main
+// module are still found by joining their path below the module root.
+func resolvePackageTarget(moduleDir, mainModulePath, importPath string) (AnalysisTarget, error) {
+	cmd := exec.Command("go", "list", "-f", "{{.Dir}}", importPath)
+	cmd.Dir = moduleDir
+	out, err := cmd.Output()
+	if err == nil {
+		if dir := strings.TrimSpace(string(out)); dir != "" {
+			return AnalysisTarget{FSRoot: dir, ModulePath: importPath}, nil
+		}
+	}
+	log.Printf("Warning: go list could not resolve %s (%v), falling back to the main module layout", importPath, err)
+
+	rel, ok := strings.CutPrefix(importPath, mainModulePath)
+	if !ok || (rel != "" && !strings.HasPrefix(rel, "/")) {
+		return AnalysisTarget{}, fmt.Errorf("%s is not part of the main module %s", importPath, mainModulePath)
+	}
+	dir := filepath.Join(moduleDir, filepath.FromSlash(strings.TrimPrefix(rel, "/")))
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return AnalysisTarget{}, fmt.Errorf("package directory %s not found", dir)
+	}
+	return AnalysisTarget{FSRoot: dir, ModulePath: importPath}, nil
+}
+
+// maxDepDepth and maxTransitiveDeps bound -dep-depth so a popular dependency can't pull in
+// its whole ecosystem.
+const (
+	maxDepDepth       = 5
+	maxTransitiveDeps = 50
+)
+
+// findDependencyPaths parses the go.mod file to find the filesystem paths of specified dependencies.
+// With depth > 1, the requirements of every matched dependency are analyzed as well, down to
+// depth levels (1 means direct dependencies only). A project with a vendor/modules.txt is
+// built from vendor/, so its dependencies are read from there rather than the module cache.
+func findDependencyPaths(projectRoot, goModCache string, depPrefixes []string, depth int) ([]AnalysisTarget, error) {
+	var targets []AnalysisTarget
+	goModPath := filepath.Join(projectRoot, "go.mod")
+	content, err := os.ReadFile(goModPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read go.mod in '%s': %w", projectRoot, err)
+	}
+
+	modFile, err := modfile.Parse(goModPath, content, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse go.mod: %w", err)
+	}
+
+	locator := moduleCacheLocator(goModCache)
+	vendored, err := readVendorModules(projectRoot)
+	if err != nil {
+		return nil, err
+	}
+	if vendored != nil {
+		log.Printf("Found %s, reading dependencies from the vendor directory", filepath.Join(projectRoot, vendorModulesFile))
+		locator = vendorLocator(projectRoot, goModCache, vendored)
+	}
+
+	for _, req := range modFile.Require {
+		for _, prefix := range depPrefixes {
+			trimmedPrefix := strings.TrimSpace(prefix)
+			if strings.HasPrefix(req.Mod.Path, trimmedPrefix) {
+				if target, ok := locator.locate(req.Mod); ok {
+					log.Printf("Found matching dependency: %s version %s at %s", req.Mod.Path, req.Mod.Version, target.FSRoot)
+					targets = append(targets, target)
+				}
+				break
+			}
+		}
+	}
+
+	if depth > 1 {
+		targets = append(targets, findTransitiveDependencies(targets, modFile, locator, depth)...)
+	}
+	return targets, nil
+}
+
+// dependencyLocator finds the sources of required modules and the go.mod files that list
+// their own requirements.
+type dependencyLocator struct {
+	locate func(mod module.Version) (AnalysisTarget, bool)
+	goMod  func(target AnalysisTarget) string // Path of the go.mod of a located module
+}
+
+// moduleCacheLocator locates modules in the module cache, each with its go.mod at its root.
+func moduleCacheLocator(goModCache string) dependencyLocator {
+	return dependencyLocator{
+		locate: func(mod module.Version) (AnalysisTarget, bool) { return moduleCacheTarget(goModCache, mod) },
+		goMod:  func(target AnalysisTarget) string { return filepath.Join(target.FSRoot, "go.mod") },
+	}
+}
+
+// moduleCacheTarget locates a module version in the module cache.
+func moduleCacheTarget(goModCache string, mod module.Version) (AnalysisTarget, bool) {
+	escapedPath, err := module.EscapePath(mod.Path)
+	if err != nil {
+		log.Printf("Warning: could not escape module path %s: %v", mod.Path, err)
+		return AnalysisTarget{}, false
+	}
+	depPath := filepath.Join(goModCache, escapedPath+"@"+mod.Version)
+	if _, err := os.Stat(depPath); os.IsNotExist(err) {
+		log.Printf("Warning: dependency path not found, skipping: %s", depPath)
+		return AnalysisTarget{}, false
+	}
+	return AnalysisTarget{FSRoot: depPath, ModulePath: mod.Path, GoVersion: goModGoVersion(depPath), Dependency: true}, true
+}
+
+// vendorModulesFile lists the modules copied into vendor/ by `go mod vendor`.
+var vendorModulesFile = filepath.Join("vendor", "modules.txt")
+
+// vendoredModule is a module listed in vendor/modules.txt.
+type vendoredModule struct {
+	Version   string
+	GoVersion string // From the module's "## explicit; go 1.21" line, if any
+}
+
+// readVendorModules parses the vendor/modules.txt of projectRoot, keyed by module path. It
+// returns nil when the project isn't vendored.
+func readVendorModules(projectRoot string) (map[string]vendoredModule, error) {
+	content, err := os.ReadFile(filepath.Join(projectRoot, vendorModulesFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", vendorModulesFile, err)
+	}
+	modules := make(map[string]vendoredModule)
+	current := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		switch {
+		case strings.HasPrefix(line, "## "):
+			// Annotations of the module above, e.g. "## explicit; go 1.21".
+			for _, annotation := range strings.Split(strings.TrimPrefix(line, "## "), ";") {
+				if version, ok := strings.CutPrefix(strings.TrimSpace(annotation), "go "); ok && current != "" {
+					m := modules[current]
+					m.GoVersion = version
+					modules[current] = m
+				}
+			}
+		case strings.HasPrefix(line, "# "):
+			// "# path version", optionally followed by "=> replacement".
+			current = ""
+			if fields := strings.Fields(strings.TrimPrefix(line, "# ")); len(fields) >= 2 && fields[1] != "=>" {
+				current = fields[0]
+				modules[current] = vendoredModule{Version: fields[1]}
+			}
+		}
+	}
+	return modules, nil
+}
+
+// vendorLocator locates modules in the vendor directory of projectRoot, at the version
+// vendored, whatever version is asked for. vendor/ keeps no go.mod files, so the
+// requirements of a vendored module are read from the module cache's download of its
+// go.mod, when the cache has it.
+func vendorLocator(projectRoot, goModCache string, vendored map[string]vendoredModule) dependencyLocator {
+	return dependencyLocator{
+		locate: func(mod module.Version) (AnalysisTarget, bool) {
+			vm, ok := vendored[mod.Path]
+			if !ok {
+				log.Printf("Warning: %s is not listed in %s, skipping", mod.Path, vendorModulesFile)
+				return AnalysisTarget{}, false
+			}
+			dir := filepath.Join(projectRoot, "vendor", filepath.FromSlash(mod.Path))
+			if _, err := os.Stat(dir); os.IsNotExist(err) {
+				log.Printf("Warning: no package of %s is vendored, skipping: %s", mod.Path, dir)
+				return AnalysisTarget{}, false
+			}
+			if vm.Version != mod.Version {
+				log.Printf("Using vendored %s version %s instead of %s", mod.Path, vm.Version, mod.Version)
+			}
+			return AnalysisTarget{FSRoot: dir, ModulePath: mod.Path, GoVersion: vm.GoVersion, Dependency: true}, true
+		},
+		goMod: func(target AnalysisTarget) string {
+			escapedPath, err := module.EscapePath(target.ModulePath)
+			if err != nil {
+				return ""
+			}
+			return filepath.Join(goModCache, "cache", "download", escapedPath, "@v", vendored[target.ModulePath].Version+".mod")
+		},
+	}
+}
+
+// findTransitiveDependencies walks the go.mod requirements of the direct dependency targets
+// breadth-first, down to depth levels. A module is analyzed at the version the main module
+// selects when it lists it (which is what the build uses), otherwise at the version the
+// requiring module asks for.
+func findTransitiveDependencies(direct []AnalysisTarget, mainModFile *modfile.File, locator dependencyLocator, depth int) []AnalysisTarget {
+	if depth > maxDepDepth {
+		log.Printf("Warning: -dep-depth %d is capped to %d", depth, maxDepDepth)
+		depth = maxDepDepth
+	}
+	selected := make(map[string]string)
+	for _, req := range mainModFile.Require {
+		selected[req.Mod.Path] = req.Mod.Version
+	}
+	seen := map[string]bool{mainModFile.Module.Mod.Path: true}
+	for _, target := range direct {
+		seen[target.ModulePath] = true
+	}
+
+	var found []AnalysisTarget
+	level := direct
+	for d := 2; d <= depth && len(level) > 0; d++ {
+		var next []AnalysisTarget
+		for _, parent := range level {
+			goModPath := locator.goMod(parent)
+			content, err := os.ReadFile(goModPath)
+			if err != nil {
+				continue // Old modules without a go.mod, or vendored ones not in the cache, have no requirements to follow.
+			}
+			depModFile, err := modfile.Parse(goModPath, content, nil)
+			if err != nil {
+				log.Printf("Warning: could not parse %s: %v", goModPath, err)
+				continue
+			}
+			for _, req := range depModFile.Require {
+				if seen[req.Mod.Path] {
+					continue
+				}
+				seen[req.Mod.Path] = true
+				if len(found) >= maxTransitiveDeps {
+					log.Printf("Warning: reached the limit of %d transitive dependencies, not analyzing %s", maxTransitiveDeps, req.Mod.Path)
+					continue
+				}
+				mod := req.Mod
+				if version, ok := selected[mod.Path]; ok {
+					mod.Version = version
+				}
+				if target, ok := locator.locate(mod); ok {
+					log.Printf("Found transitive dependency (depth %d, via %s): %s version %s at %s", d, parent.ModulePath, mod.Path, mod.Version, target.FSRoot)
+					found = append(found, target)
+					next = append(next, target)
+				}
+			}
+		}
+		level = next
+	}
+	return found
+}
+
+// parseMode reports every syntax error of a file rather than the first ten, and keeps the
+// comments that deprecation notices and test helpers are read from.
+const parseMode = parser.AllErrors | parser.ParseComments
+
+// parseSourceFile parses a file of the walk, prefetched or not; tests replace it to see which
+// files are parsed.
+var parseSourceFile = func(fset *token.FileSet, filePath string) (*ast.File, error) {
+	return parser.ParseFile(fset, filePath, nil, parseMode)
+}
+
+// parseGoFile parses a source file. A file with syntax errors is recorded as a parse error,
+// but the AST the parser recovered is still returned along with the error. Unless lowMemory
+// (-low-memory) is set, the AST parsed in Pass 1 (keep=true) is cached and handed to Pass 2,
+// which takes it out of the cache so each file is only parsed once. With -low-memory nothing
+// is cached: every file is parsed again in Pass 2, trading CPU time for a lower peak memory
+// use.
+func parseGoFile(filePath string, fset *token.FileSet, keep, lowMemory bool) (*ast.File, error) {
+	if !lowMemory {
+		if node, ok := astCache[filePath]; ok {
+			if !keep {
+				delete(astCache, filePath)
+			}
+			return node, nil
+		}
+	}
+	var node *ast.File
+	var err error
+	if parsed, ok := prefetched[filePath]; ok {
+		delete(prefetched, filePath)
+		node, err = parsed.node, parsed.err
+	} else {
+		node, err = parseSourceFile(fset, filePath)
+	}
+	if err != nil {
+		recordParseError(filePath, err, node != nil)
+		if node == nil {
+			return nil, err
+		}
+	}
+	if keep && !lowMemory {
+		astCache[filePath] = node
+	}
+	return node, nil
+}
+
+// packagePathFor derives the import path of the package containing filePath, along with the
+// slash-separated path of the file relative to the target root. Both passes must use this so
+// that a definition in a.go and a call to it from b.go agree on the package they belong to.
+func packagePathFor(target AnalysisTarget, filePath string) (pkgPath, relPath string) {
+	rel, err := filepath.Rel(target.FSRoot, filePath)
+	if err != nil {
+		rel = filePath
+	}
+	relPath = filepath.ToSlash(rel)
+	pkgDir := path.Dir(relPath)
+	if pkgDir == "." {
+		return target.ModulePath, relPath
+	}
+	return path.Join(target.ModulePath, pkgDir), relPath
+}
+
+// filePackagePath returns the package path the IDs of a parsed file use: pkgPath, the one of
+// its directory, except for the _test.go files of an external test package (package foo_test),
+// which get pkgPath+"_test" so that their functions don't collide with those of package foo.
+func filePackagePath(pkgPath, relPath string, node *ast.File) string {
+	if strings.HasSuffix(relPath, "_test.go") && strings.HasSuffix(node.Name.Name, "_test") {
+		return pkgPath + "_test"
+	}
+	return pkgPath
+}
+
+// findDefinitions scans a single file for function, method and type definitions.
+func findDefinitions(filePath string, target AnalysisTarget) (fileRecord, bool) {
+	fset := target.FileSet
+	state := target.state
+	node, _ := parseGoFile(filePath, fset, true, state.opts.LowMemory)
+	if node == nil {
+		return nil, false
+	}
+	fullPkgPath, relPath := packagePathFor(target, filePath)
+	fullPkgPath = filePackagePath(fullPkgPath, relPath, node)
+	var src []byte
+	if state.opts.EmbedSource {
+		src, _ = os.ReadFile(filePath)
+	}
+	return definitionsIn(node, fset, src, fullPkgPath, relPath, state), true
+}
+
+// definitionsIn collects the definitions of a parsed file of package fullPkgPath, configured
+// by state. src is the content of the file, needed with -embed-source only.
+func definitionsIn(node *ast.File, fset *token.FileSet, src []byte, fullPkgPath, relPath string, state *passState) *fileDefinitions {
+	rec := &fileDefinitions{}
+	testingAlias := importAlias(node, "testing", state.packageNames)
+	importMap := buildImportMap(node, state.packageNames)
+	testFile := strings.HasSuffix(relPath, "_test.go")
+
+	for _, decl := range node.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok {
+			continue
+		}
+		switch gen.Tok {
+		case token.TYPE:
+			for _, spec := range gen.Specs {
+				rec.Types = append(rec.Types, newTypeDef(spec.(*ast.TypeSpec), fullPkgPath, relPath, fset.Position(spec.Pos()).Line))
+			}
+		case token.VAR:
+			for _, spec := range gen.Specs {
+				if typeID, ifaceID := interfaceAssertion(spec.(*ast.ValueSpec), fullPkgPath, importMap); typeID != "" {
+					rec.Assertions = append(rec.Assertions, [2]string{typeID, ifaceID})
+				}
+			}
+		}
+		if state.opts.TrackVars && (gen.Tok == token.CONST || gen.Tok == token.VAR) {
+			rec.Values = append(rec.Values, valueDefinitions(gen, fset, src, node.Name.Name, fullPkgPath, relPath, state.opts)...)
+		}
+	}
+
+	ast.Inspect(node, func(n ast.Node) bool {
+		fn, ok := n.(*ast.FuncDecl)
+		if !ok {
+			return true
+		}
+
+		funcName := fn.Name.Name
+		def := Definition{
+			Name:        funcName,
+			FilePath:    relPath,
+			Line:        fset.Position(fn.Pos()).Line,
+			EndLine:     fset.Position(fn.End()).Line,
+			Package:     fullPkgPath,
+			PackageName: node.Name.Name,
+			Kind:        "function",
+			TestFile:    testFile,
+		}
+		if state.opts.WithOffsets {
+			def.Offset = fset.Position(fn.Pos()).Offset
+		}
+		def.DeprecationMessage, def.Deprecated = deprecationNotice(fn.Doc)
+		def.Doc = docText(fn.Doc, state.opts.DocMax)
+		def.Source = sourceText(src, fset, fn.Pos(), fn.End(), state.opts.SourceMax)
+		def.Signature = signature(fn.Type)
+		def.ParamCount, def.ReturnCount = fn.Type.Params.NumFields(), fn.Type.Results.NumFields()
+		if testingAlias != "" {
+			def.IsTestHelper = callsTestingHelper(fn, testingAlias)
+		}
+
+		if fn.Recv != nil && len(fn.Recv.List) > 0 {
+			typeExpr := fn.Recv.List[0].Type
+			def.ID = methodID(fullPkgPath, typeExpr, funcName)
+			def.Kind = "method"
+			if base := receiverBaseName(typeExpr); base != "" {
+				def.ReceiverTypeID = fullPkgPath + "." + base
+				rec.Methods = append(rec.Methods, [2]string{def.ReceiverTypeID, funcName})
+			}
+		} else if funcName == "init" {
+			// A package may declare several init functions; numberInitFunctions gives each its final ID.
+			def.ID = initKey(fullPkgPath, relPath, def.Line)
+		} else {
+			def.ID = fmt.Sprintf("%s.%s", fullPkgPath, funcName)
+			if (strings.HasPrefix(funcName, "New") || strings.HasPrefix(funcName, "new")) && fn.Type.Results != nil && len(fn.Type.Results.List) > 0 {
+				// Confirmed by linkConstructors once every type is known.
+				def.ConstructsTypeID = resultTypeID(fn.Type.Results.List[0].Type, fullPkgPath, importMap)
+			}
+		}
+
+		def.EntryPoint = isEntryPoint(def) && (def.Name != "main" || node.Name.Name == "main")
+		rec.Definitions = append(rec.Definitions, def)
+		return true
+	})
+	return rec
+}
+
+// valueDefinitions returns a Definition of kind const or var for every name a package-level
+// const or var declaration declares, blank names aside.
+func valueDefinitions(gen *ast.GenDecl, fset *token.FileSet, src []byte, pkgName, fullPkgPath, relPath string, o *Options) []Definition {
+	var defs []Definition
+	for _, spec := range gen.Specs {
+		vs := spec.(*ast.ValueSpec)
+		doc := vs.Doc
+		if doc == nil && len(gen.Specs) == 1 {
+			doc = gen.Doc
+		}
+		for _, name := range vs.Names {
+			if name.Name == "_" {
+				continue
+			}
+			def := Definition{
+				ID:          fullPkgPath + "." + name.Name,
+				Name:        name.Name,
+				Package:     fullPkgPath,
+				PackageName: pkgName,
+				FilePath:    relPath,
+				Line:        fset.Position(name.Pos()).Line,
+				EndLine:     fset.Position(vs.End()).Line,
+				Kind:        gen.Tok.String(),
+				TestFile:    strings.HasSuffix(relPath, "_test.go"),
+				Doc:         docText(doc, o.DocMax),
+				Source:      sourceText(src, fset, vs.Pos(), vs.End(), o.SourceMax),
+			}
+			if o.WithOffsets {
+				def.Offset = fset.Position(name.Pos()).Offset
+			}
+			def.DeprecationMessage, def.Deprecated = deprecationNotice(doc)
+			defs = append(defs, def)
+		}
+	}
+	return defs
+}
+
+// methodID builds the ID of a method from its receiver type expression. Pass 1 (definitions)
+// and Pass 2 (callers) must both go through here so they can't disagree on an ID. Type
+// parameters are left out, so the methods of *List[K, V] are pkg.*List.Len and friends,
+// whatever the instantiation a call goes through.
+func methodID(pkgPath string, recv ast.Expr, name string) string {
+	base := receiverBaseName(recv)
+	if base == "" {
+		return fmt.Sprintf("%s.%s.%s", pkgPath, types.ExprString(recv), name)
+	}
+	if isPointerReceiver(recv) {
+		base = "*" + base
+	}
+	return fmt.Sprintf("%s.%s.%s", pkgPath, base, name)
+}
+
+// isPointerReceiver reports whether a receiver type expression is a pointer, parentheses aside.
+func isPointerReceiver(recv ast.Expr) bool {
+	for {
+		switch t := recv.(type) {
+		case *ast.ParenExpr:
+			recv = t.X
+		case *ast.StarExpr:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// isStdlibPath reports whether an import path belongs to the standard library, whose paths
+// have no dot in their first element (e.g. "net/http").
+func isStdlibPath(importPath string) bool {
+	return !strings.Contains(strings.Split(importPath, "/")[0], ".")
+}
+
+// importPaths returns the import paths of a file, blank and dot imports included.
+func importPaths(file *ast.File) []string {
+	var paths []string
+	for _, imp := range file.Imports {
+		if importPath, err := strconv.Unquote(imp.Path.Value); err == nil {
+			paths = append(paths, importPath)
+		}
+	}
+	return paths
+}
+
+// recordImports adds the imports of a file to its package.
+func recordImports(pkgPath string, imports []string) {
+	if packageImports[pkgPath] == nil {
+		packageImports[pkgPath] = make(map[string]bool)
+	}
+	for _, importPath := range imports {
+		packageImports[pkgPath][importPath] = true
+	}
+}
+
+// buildImportMap maps the names a file uses for its imports to their import paths.
+// Blank and dot imports are left out, see dotImportPaths.
+func buildImportMap(file *ast.File, names *packageNameResolver) map[string]string {
+	importMap := make(map[string]string)
+	for _, imp := range file.Imports {
+		path := strings.Trim(imp.Path.Value, `"`)
+		if imp.Name != nil {
+			if imp.Name.Name == "_" || imp.Name.Name == "." {
+				continue
+			}
+			importMap[imp.Name.Name] = path
+		} else {
+			importMap[names.importName(path)] = path
+		}
+	}
+	return importMap
+}
+
+// dotImportPaths returns the import paths a file imports with `import . "path"`, whose
+// exported names it uses unqualified.
+func dotImportPaths(file *ast.File) []string {
+	var paths []string
+	for _, imp := range file.Imports {
+		if imp.Name != nil && imp.Name.Name == "." {
+			paths = append(paths, strings.Trim(imp.Path.Value, `"`))
+		}
+	}
+	return paths
+}
+
+// resultTypeID returns the TypeDef ID a result type expression refers to, looking through
+// pointers and type arguments: *T, T[int] and pkg.T all name a type. It returns "" for
+// anything else (slices, maps, func types, ...).
+func resultTypeID(expr ast.Expr, pkgPath string, importMap map[string]string) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return resultTypeID(t.X, pkgPath, importMap)
+	case *ast.ParenExpr:
+		return resultTypeID(t.X, pkgPath, importMap)
+	case *ast.IndexExpr:
+		return resultTypeID(t.X, pkgPath, importMap)
+	case *ast.IndexListExpr:
+		return resultTypeID(t.X, pkgPath, importMap)
+	case *ast.Ident:
+		return pkgPath + "." + t.Name
+	case *ast.SelectorExpr:
+		if pkgIdent, ok := t.X.(*ast.Ident); ok {
+			if importPath, found := importMap[pkgIdent.Name]; found {
+				return importPath + "." + t.Sel.Name
+			}
+		}
+	}
+	return ""
+}
+
+// initKey identifies an init function by its position, since its name isn't unique.
+func initKey(pkgPath, relPath string, line int) string {
+	return fmt.Sprintf("%s.init@%s:%d", pkgPath, relPath, line)
+}
+
+// numberInitFunctions gives every init function its final ID: "pkg.init" when a package has
+// a single one, otherwise "pkg.init#1", "pkg.init#2", ... ordered by file and line. It also
+// fills initIDs so that Pass 2 can attribute calls inside each init to the right node.
+func numberInitFunctions() {
+	byPackage := make(map[string][]Definition)
+	for _, def := range definitions {
+		if def.Name == "init" && def.Kind == "function" {
+			byPackage[def.Package] = append(byPackage[def.Package], def)
+		}
+	}
+	for pkg, inits := range byPackage {
+		sort.Slice(inits, func(i, j int) bool {
+			if inits[i].FilePath != inits[j].FilePath {
+				return inits[i].FilePath < inits[j].FilePath
+			}
+			return inits[i].Line < inits[j].Line
+		})
+		for i, def := range inits {
+			id := pkg + ".init"
+			if len(inits) > 1 {
+				id = fmt.Sprintf("%s.init#%d", pkg, i+1)
+			}
+			initIDs[initKey(pkg, def.FilePath, def.Line)] = id
+			if def.ID == id {
+				continue
+			}
+			m := mappings[def.ID]
+			delete(definitions, def.ID)
+			delete(mappings, def.ID)
+			def.ID = id
+			definitions[id] = def
+			m.Definition = def
+			mappings[id] = m
+		}
+	}
+}
+
+// linkConstructors marks New*/new* functions whose first result is a known type as
+// constructors of that type, and drops the candidate link from all others.
+func linkConstructors() {
+	for id, def := range definitions {
+		if def.ConstructsTypeID == "" {
+			continue
+		}
+		if _, ok := typeDefs[def.ConstructsTypeID]; ok {
+			def.Kind = "constructor"
+		} else {
+			def.ConstructsTypeID = ""
+		}
+		definitions[id] = def
+		if m, ok := mappings[id]; ok {
+			m.Definition = def
+		}
+	}
+}
+
+// importAlias returns the name a file uses to refer to importPath, or "" if it isn't imported.
+func importAlias(file *ast.File, importPath string, names *packageNameResolver) string {
+	for _, imp := range file.Imports {
+		if strings.Trim(imp.Path.Value, `"`) != importPath {
+			continue
+		}
+		if imp.Name != nil {
+			if imp.Name.Name == "_" || imp.Name.Name == "." {
+				return ""
+			}
+			return imp.Name.Name
+		}
+		return names.importName(importPath)
+	}
+	return ""
+}
+
+// maxExprText caps the length of the expressions exprText renders.
+const maxExprText = 200
+
+// exprText renders expr as it would be printed by gofmt, on one line and cut to
+// maxExprText bytes, so a function literal doesn't spill its whole body.
+func exprText(fset *token.FileSet, expr ast.Expr) string {
+	var b strings.Builder
+	if err := printer.Fprint(&b, fset, expr); err != nil {
+		return types.ExprString(expr)
+	}
+	text := strings.Join(strings.Fields(b.String()), " ")
+	if len(text) > maxExprText {
+		cut := maxExprText
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut] + "…"
+	}
+	return text
+}
+
+// signature renders a function type without the func keyword, type parameters included.
+func signature(ft *ast.FuncType) string {
+	sig := strings.TrimPrefix(types.ExprString(ft), "func")
+	if ft.TypeParams == nil {
+		return sig
+	}
+	var params []string
+	for _, field := range ft.TypeParams.List {
+		names := make([]string, len(field.Names))
+		for i, name := range field.Names {
+			names[i] = name.Name
+		}
+		params = append(params, strings.Join(names, ", ")+" "+types.ExprString(field.Type))
+	}
+	return "[" + strings.Join(params, ", ") + "]" + sig
+}
+
+// docText returns the text of a doc comment cut to max characters, or "" when max is 0.
+func docText(doc *ast.CommentGroup, max int) string {
+	if doc == nil || max <= 0 {
+		return ""
+	}
+	text := strings.TrimSpace(doc.Text())
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	return string([]rune(text)[:max]) + "…"
+}
+
+// sourceText returns the source between start and end, cut to max bytes at a character
+// boundary and marked with "…" when longer, or "" when src is nil.
+func sourceText(src []byte, fset *token.FileSet, start, end token.Pos, max int) string {
+	if src == nil {
+		return ""
+	}
+	from, to := fset.Position(start).Offset, fset.Position(end).Offset
+	if from < 0 || to > len(src) || from > to {
+		return ""
+	}
+	text := src[from:to]
+	if max <= 0 || len(text) <= max {
+		return string(text)
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return string(text[:cut]) + "…"
+}
+
+// deprecationNotice returns the text of the "Deprecated:" paragraph of a doc comment, the
+// convention Go tools use to mark an identifier as deprecated.
+func deprecationNotice(doc *ast.CommentGroup) (string, bool) {
+	if doc == nil {
+		return "", false
+	}
+	for _, para := range strings.Split(doc.Text(), "\n\n") {
+		if msg, ok := strings.CutPrefix(para, "Deprecated:"); ok {
+			return strings.Join(strings.Fields(msg), " "), true
+		}
+	}
+	return "", false
+}
+
+// logDeprecatedCalls warns about every call site of a deprecated definition, so the
+// callers left to migrate are listed at the end of the run.
+func logDeprecatedCalls(maps map[string]*Mapping) {
+	var ids []string
+	for id, m := range maps {
+		if m.Definition.Deprecated && len(m.CallSites) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		m := maps[id]
+		log.Printf("Warning: %s is deprecated: %s", id, m.Definition.DeprecationMessage)
+		for _, cs := range m.CallSites {
+			log.Printf("  called by %s at %s:%d", cs.CallerID, cs.FilePath, cs.Line)
+		}
+	}
+}
+
+// callsTestingHelper reports whether fn calls Helper() on one of its *testing.T, *testing.B,
+// *testing.F or testing.TB parameters.
+func callsTestingHelper(fn *ast.FuncDecl, testingAlias string) bool {
+	if fn.Body == nil {
+		return false
+	}
+	testingParams := make(map[string]bool)
+	for _, field := range fn.Type.Params.List {
+		typ := field.Type
+		if star, ok := typ.(*ast.StarExpr); ok {
+			typ = star.X
+		}
+		sel, ok := typ.(*ast.SelectorExpr)
+		if !ok {
+			continue
+		}
+		if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != testingAlias {
+			continue
+		}
+		switch sel.Sel.Name {
+		case "T", "B", "F", "TB":
+			for _, name := range field.Names {
+				testingParams[name.Name] = true
+			}
+		}
+	}
+	if len(testingParams) == 0 {
+		return false
+	}
+
+	found := false
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		if found {
+			return false
+		}
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 0 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Helper" {
+			return true
+		}
+		if recv, ok := sel.X.(*ast.Ident); ok && testingParams[recv.Name] {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// newTypeDef describes a top-level type declaration found at line.
+func newTypeDef(spec *ast.TypeSpec, pkgPath, relPath string, line int) TypeDef {
+	td := TypeDef{
+		ID:       pkgPath + "." + spec.Name.Name,
+		Name:     spec.Name.Name,
+		Package:  pkgPath,
+		FilePath: relPath,
+		Line:     line,
+	}
+	switch t := spec.Type.(type) {
+	case *ast.StructType:
+		td.Kind = "struct"
+	case *ast.InterfaceType:
+		td.Kind = "interface"
+		for _, field := range t.Methods.List {
+			// Embedded interfaces have no names and are not expanded.
+			for _, name := range field.Names {
+				td.Methods = append(td.Methods, name.Name)
+			}
+		}
+	default:
+		td.Kind = "defined"
+	}
+	if spec.Assign.IsValid() {
+		td.Kind = "alias"
+	}
+	return td
+}
+
+// interfaceAssertion recognizes the compile-time interface check `var _ I = (*T)(nil)`
+// (or `T{}`, `&T{}`, `new(T)`) and returns the IDs of T and I. Such declarations reference
+// the type without using it, so they're recorded as an assertion rather than a call.
+func interfaceAssertion(spec *ast.ValueSpec, pkgPath string, importMap map[string]string) (typeID, ifaceID string) {
+	if len(spec.Names) != 1 || spec.Names[0].Name != "_" || spec.Type == nil || len(spec.Values) != 1 {
+		return "", ""
+	}
+	ifaceID = resultTypeID(spec.Type, pkgPath, importMap)
+	if ifaceID == "" {
+		return "", ""
+	}
+	var typeExpr ast.Expr
+	switch v := spec.Values[0].(type) {
+	case *ast.CallExpr:
+		if ident, ok := v.Fun.(*ast.Ident); ok && ident.Name == "new" && len(v.Args) == 1 {
+			typeExpr = v.Args[0] // new(T)
+		} else if len(v.Args) == 1 {
+			if nilIdent, ok := v.Args[0].(*ast.Ident); ok && nilIdent.Name == "nil" {
+				typeExpr = v.Fun // (*T)(nil)
+			}
+		}
+	case *ast.CompositeLit:
+		typeExpr = v.Type // T{}
+	case *ast.UnaryExpr:
+		if lit, ok := v.X.(*ast.CompositeLit); ok && v.Op == token.AND {
+			typeExpr = lit.Type // &T{}
+		}
+	}
+	if typeExpr == nil {
+		return "", ""
+	}
+	if typeID = resultTypeID(typeExpr, pkgPath, importMap); typeID == "" {
+		return "", ""
+	}
+	return typeID, ifaceID
+}
+
+// receiverBaseName returns the bare type name of a receiver expression: *Stack[T] -> Stack.
+func receiverBaseName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.StarExpr:
+		return receiverBaseName(t.X)
+	case *ast.ParenExpr:
+		return receiverBaseName(t.X)
+	case *ast.IndexExpr:
+		return receiverBaseName(t.X)
+	case *ast.IndexListExpr:
+		return receiverBaseName(t.X)
+	}
+	return ""
+}
+
+// computeTypeStats fills in method counts and interface-satisfaction counts once all types
+// and methods are known. Satisfaction is structural and by method name only, since no type
+// information is available: a type satisfies an interface when it declares every method the
+// interface lists, or when the code asserts it does with `var _ I = (*T)(nil)`.
+func computeTypeStats() {
+	asserted := make(map[string]map[string]bool)
+	for _, pair := range interfaceAssertions {
+		typeID, ifaceID := pair[0], pair[1]
+		td, ok := typeDefs[typeID]
+		if !ok {
+			continue
+		}
+		if asserted[typeID] == nil {
+			asserted[typeID] = make(map[string]bool)
+		}
+		if !asserted[typeID][ifaceID] {
+			asserted[typeID][ifaceID] = true
+			td.AssertedInterfaces = append(td.AssertedInterfaces, ifaceID)
+			sort.Strings(td.AssertedInterfaces)
+		}
+	}
+
+	var interfaces []*TypeDef
+	for _, td := range typeDefs {
+		if td.Kind == "interface" && len(td.Methods) > 0 {
+			interfaces = append(interfaces, td)
+		}
+	}
+	for id, td := range typeDefs {
+		if td.Kind == "interface" {
+			td.MethodCount = len(td.Methods)
+			continue
+		}
+		methods := typeMethods[id]
+		td.MethodCount = len(methods)
+		td.Implements = nil
+		for _, iface := range interfaces {
+			satisfied := true
+			for _, name := range iface.Methods {
+				if !methods[name] {
+					satisfied = false
+					break
+				}
+			}
+			if satisfied || asserted[id][iface.ID] {
+				td.Implements = append(td.Implements, iface.ID)
+			}
+		}
+		// Asserted interfaces that CodeMapper couldn't compare structurally (embedded method
+		// sets, empty lists) still count when they're part of the analyzed code.
+		for ifaceID := range asserted[id] {
+			if iface, ok := typeDefs[ifaceID]; ok && iface.Kind == "interface" && len(iface.Methods) == 0 {
+				td.Implements = append(td.Implements, ifaceID)
+			}
+		}
+		sort.Strings(td.Implements)
+		td.SatisfiesCount = len(td.Implements)
+	}
+}
+
+// callSiteVisitor implements ast.Visitor to find function calls with accurate caller context.
+type callSiteVisitor struct {
+	fileSet       *token.FileSet
+	target        AnalysisTarget
+	importMap     map[string]string
+	dotImports    []string // Packages imported with `import .`, searched for unqualified calls
+	currentPkg    string
+	callerIDStack []string
+	// initKeyStack parallels callerIDStack with the initKey of init callers, whose final ID
+	// is only looked up when the call is applied.
+	initKeyStack []string
+	context      string      // Innermost enclosing statement kind, see withContext
+	info         *types.Info // Type information from -types, nil without it
+	state        *passState
+	calls        *[]fileCall // Calls found so far, shared with the copies made by withContext
+	// references collects the uses of package-level constants and variables with
+	// -track-vars; nil without it.
+	references *[]fileCall
+	// fileScope holds the package-level objects the parser declared for the file, which tell
+	// the identifiers resolved to them from those bound to a local declaration.
+	fileScope *ast.Scope
+	// declName and litCount name the function literals of a package-level declaration,
+	// which have no enclosing function to attribute their calls to, see Visit.
+	declName string
+	litCount *int
+	// stmtCall is the call of the go or defer statement being walked, recorded with stmtKind.
+	stmtCall *ast.CallExpr
+	stmtKind string
+	// methodValues collects the method expressions used as values, such as the (*T).Less
+	// passed to a sort function; called tells them from the ones that are called.
+	methodValues *[]fileCall
+	called       map[*ast.SelectorExpr]bool
+	// switchTypes maps the variables of the enclosing type switch cases to the case's type,
+	// with -types, see walkTypeSwitch.
+	switchTypes map[string]ast.Expr
+}
+
+// withContext returns a copy of the visitor to walk the children of a statement of the given
+// kind, so that calls below it are tagged with that context.
+func (v *callSiteVisitor) withContext(kind string) *callSiteVisitor {
+	child := *v
+	child.context = kind
+	return &child
+}
+
+// withStmtCall returns a copy of the visitor to walk a go or defer statement, so that its
+// call, and only that one, is recorded with the statement's kind.
+func (v *callSiteVisitor) withStmtCall(call *ast.CallExpr, kind string) *callSiteVisitor {
+	child := *v
+	child.stmtCall, child.stmtKind = call, kind
+	return &child
+}
+
+// statementContext returns the call-site context introduced by a node, or "" if it doesn't change it.
+func statementContext(n ast.Node) string {
+	switch n := n.(type) {
+	case *ast.IfStmt:
+		return "if"
+	case *ast.ForStmt, *ast.RangeStmt:
+		return "loop"
+	case *ast.SwitchStmt, *ast.TypeSwitchStmt:
+		return "switch"
+	case *ast.SelectStmt:
+		return "select"
+	case *ast.ReturnStmt:
+		return "return"
+	case *ast.AssignStmt:
+		return "assign"
+	case *ast.ValueSpec:
+		if len(n.Values) > 0 {
+			return "assign"
+		}
+	case *ast.GoStmt:
+		return "go"
+	case *ast.DeferStmt:
+		return "defer"
+	}
+	return ""
+}
+
+// Visit traverses the AST. It's the core of the improved call site analysis.
+func (v *callSiteVisitor) Visit(n ast.Node) ast.Visitor {
+	if n == nil {
+		return nil
+	}
+
+	if fn, ok := n.(*ast.FuncDecl); ok {
+		var callerID, key string
+		if fn.Recv != nil && len(fn.Recv.List) > 0 {
+			callerID = methodID(v.currentPkg, fn.Recv.List[0].Type, fn.Name.Name)
+		} else if fn.Name.Name == "init" {
+			relPath, _ := filepath.Rel(v.target.FSRoot, v.fileSet.Position(fn.Pos()).Filename)
+			key = initKey(v.currentPkg, filepath.ToSlash(relPath), v.fileSet.Position(fn.Pos()).Line)
+			callerID = v.currentPkg + ".init"
+		} else {
+			callerID = fmt.Sprintf("%s.%s", v.currentPkg, fn.Name.Name)
+		}
+		v.callerIDStack = append(v.callerIDStack, callerID)
+		v.initKeyStack = append(v.initKeyStack, key)
+
+		if fn.Body != nil {
+			ast.Walk(v, fn.Body)
+		}
+
+		v.callerIDStack = v.callerIDStack[:len(v.callerIDStack)-1]
+		v.initKeyStack = v.initKeyStack[:len(v.initKeyStack)-1]
+		return nil
+	}
+
+	// Function literals in package-level declarations, like `var handler = func() { ... }`,
+	// become callers of their own named after the declaration: pkg.handler$func1. Literals
+	// inside functions keep being attributed to the enclosing function.
+	if spec, ok := n.(*ast.ValueSpec); ok && len(v.callerIDStack) == 0 {
+		child := *v
+		child.declName = "_"
+		for _, name := range spec.Names {
+			if name.Name != "_" {
+				child.declName = name.Name
+				break
+			}
+		}
+		child.litCount = new(int)
+		return &child
+	}
+	if lit, ok := n.(*ast.FuncLit); ok && len(v.callerIDStack) == 0 && v.litCount != nil {
+		*v.litCount++
+		v.callerIDStack = append(v.callerIDStack, fmt.Sprintf("%s.%s$func%d", v.currentPkg, v.declName, *v.litCount))
+		v.initKeyStack = append(v.initKeyStack, "")
+		ast.Walk(v, lit.Body)
+		v.callerIDStack = v.callerIDStack[:len(v.callerIDStack)-1]
+		v.initKeyStack = v.initKeyStack[:len(v.initKeyStack)-1]
+		return nil
+	}
+
+	if call, ok := n.(*ast.CallExpr); ok {
+		if len(v.callerIDStack) > 0 {
+			pos := v.fileSet.Position(call.Pos())
+			relPath, _ := filepath.Rel(v.target.FSRoot, pos.Filename)
+			fun := withoutTypeArgs(call.Fun)
+			c := fileCall{
+				Callee:        v.resolveCalleeID(fun),
+				Alternatives:  v.dotImportCallees(fun),
+				Reason:        v.unresolvedReason(fun),
+				CallerInitKey: v.initKeyStack[len(v.initKeyStack)-1],
+				Site: CallSite{
+					FilePath: filepath.ToSlash(relPath),
+					Line:     pos.Line,
+					CallerID: v.callerIDStack[len(v.callerIDStack)-1],
+					Context:  v.context,
+					ArgCount: len(call.Args),
+					Spread:   call.Ellipsis.IsValid(),
+					CallKind: callKindCall,
+				},
+			}
+			if call == v.stmtCall {
+				c.Site.CallKind = v.stmtKind
+			}
+			if sel, ok := fun.(*ast.SelectorExpr); ok {
+				v.called[sel] = true
+				if ids := v.methodExpressionIDs(sel); len(ids) > 1 {
+					c.Alternatives = append(c.Alternatives, ids[1:]...)
+				} else if ids := v.assertedMethodIDs(sel); len(ids) > 1 {
+					c.Alternatives = append(c.Alternatives, ids[1:]...)
+				}
+			}
+			if c.Callee == "" && v.state.opts.ResolveInterfaces {
+				c.Interface, c.Method = v.interfaceMethod(fun)
+			}
+			if v.state.opts.RecordUnresolved {
+				c.Expr = exprText(v.fileSet, fun)
+			}
+			if v.state.opts.WithOffsets {
+				c.Site.Offset = pos.Offset
+			}
+			*v.calls = append(*v.calls, c)
+		}
+	}
+
+	if sel, ok := n.(*ast.SelectorExpr); ok && len(v.callerIDStack) > 0 && !v.called[sel] {
+		if ids := v.methodExpressionIDs(sel); len(ids) > 0 {
+			pos := v.fileSet.Position(sel.Pos())
+			relPath, _ := filepath.Rel(v.target.FSRoot, pos.Filename)
+			ref := fileCall{
+				Callee:        ids[0],
+				Alternatives:  ids[1:],
+				CallerInitKey: v.initKeyStack[len(v.initKeyStack)-1],
+				Site: CallSite{
+					FilePath: filepath.ToSlash(relPath),
+					Line:     pos.Line,
+					CallerID: v.callerIDStack[len(v.callerIDStack)-1],
+					Context:  v.context,
+					CallKind: callKindReference,
+				},
+			}
+			if v.state.opts.WithOffsets {
+				ref.Site.Offset = pos.Offset
+			}
+			*v.methodValues = append(*v.methodValues, ref)
+		}
+	}
+
+	if v.references != nil && len(v.callerIDStack) > 0 {
+		switch e := n.(type) {
+		case *ast.SelectorExpr:
+			// Only pkg.Name can refer to a package-level value; in x.Name, Name is a field or
+			// method, so it isn't walked.
+			if pkgIdent, ok := e.X.(*ast.Ident); ok {
+				if importPath, found := v.importMap[pkgIdent.Name]; found {
+					v.addReference(importPath+"."+e.Sel.Name, e.Sel)
+					return nil
+				}
+			}
+			ast.Walk(v, e.X)
+			return nil
+		case *ast.KeyValueExpr:
+			// Without type information, a bare key is taken for the field name of a struct
+			// literal, the common case, rather than a value used as a map key.
+			if _, ok := e.Key.(*ast.Ident); ok && v.info == nil {
+				ast.Walk(v, e.Value)
+				return nil
+			}
+		case *ast.Ident:
+			v.addReference(v.currentPkg+"."+e.Name, e)
+		}
+	}
+
+	next := v
+	if v.state.opts.CallContext {
+		if kind := statementContext(n); kind != "" {
+			next = v.withContext(kind)
+		}
+	}
+	switch stmt := n.(type) {
+	case *ast.GoStmt:
+		next = next.withStmtCall(stmt.Call, callKindGo)
+	case *ast.DeferStmt:
+		next = next.withStmtCall(stmt.Call, callKindDefer)
+	case *ast.TypeSwitchStmt:
+		if _, binds := stmt.Assign.(*ast.AssignStmt); binds && v.info != nil && len(v.callerIDStack) > 0 {
+			next.walkTypeSwitch(stmt)
+			return nil
+		}
+	}
+	return next
+}
+
+// resolveCalleeID determines the unique ID of the function being called.
+func (v *callSiteVisitor) resolveCalleeID(fun ast.Expr) string {
+	switch f := fun.(type) {
+	case *ast.SelectorExpr:
+		if pkgIdent, ok := f.X.(*ast.Ident); ok {
+			if fullPkgPath, found := v.importMap[pkgIdent.Name]; found {
+				return fmt.Sprintf("%s.%s", fullPkgPath, f.Sel.Name)
+			}
+		}
+		if v.info != nil {
+			if fn, ok := v.info.Uses[f.Sel].(*types.Func); ok {
+				return typesMethodID(fn)
+			}
+		}
+		if ids := v.methodExpressionIDs(f); len(ids) > 0 {
+			return ids[0]
+		}
+		if ids := v.assertedMethodIDs(f); len(ids) > 0 {
+			return ids[0]
+		}
+		// pkg.T.Method(recv) is a method expression on an imported type. Without type
+		// information that's the only chain that can be resolved: pkg.Var.Method() names
+		// the same ID but Var's type is unknown, so it only matches by accident, and
+		// deeper chains such as cfg.DB.Connect() are counted as chained selectors.
+		if inner, ok := withoutTypeArgs(f.X).(*ast.SelectorExpr); ok {
+			if pkgIdent, ok := inner.X.(*ast.Ident); ok {
+				if fullPkgPath, found := v.importMap[pkgIdent.Name]; found {
+					return fmt.Sprintf("%s.%s.%s", fullPkgPath, inner.Sel.Name, f.Sel.Name)
+				}
+			}
+		}
+	case *ast.Ident:
+		return fmt.Sprintf("%s.%s", v.currentPkg, f.Name)
+	}
+	return ""
+}
+
+// methodExpressionIDs returns the IDs of the method a method expression such as
+// (*T).Less, T.String or (*pkg.T).Close refers to, most likely first, or nothing when sel
+// isn't one. (*T).M may name a method declared on *T or on T, so both are returned. T must
+// be a type found in Pass 1, since x.M and (*x).M are also how a method value or a field of
+// a variable is written. Method values, like `f := x.Less`, are left out: which method they
+// name depends on the type of x.
+func (v *callSiteVisitor) methodExpressionIDs(sel *ast.SelectorExpr) []string {
+	x, pointer := sel.X, false
+	if paren, ok := x.(*ast.ParenExpr); ok {
+		star, ok := paren.X.(*ast.StarExpr)
+		if !ok {
+			return nil
+		}
+		x, pointer = star.X, true
+	}
+	pkgPath, typeName := v.analyzedType(x)
+	if typeName == "" {
+		return nil
+	}
+	if v.info != nil {
+		if fn, ok := v.info.Uses[sel.Sel].(*types.Func); ok {
+			if id := typesMethodID(fn); id != "" {
+				return []string{id}
+			}
+		}
+	}
+	return concreteMethodIDs(pkgPath, typeName, sel.Sel.Name, pointer)
+}
+
+// analyzedType returns the package path and name of the type a type expression such as T,
+// pkg.T or T[int] names, or "" for typeName when it isn't a type found in Pass 1.
+func (v *callSiteVisitor) analyzedType(expr ast.Expr) (pkgPath, typeName string) {
+	switch t := withoutTypeArgs(expr).(type) {
+	case *ast.Ident:
+		pkgPath, typeName = v.currentPkg, t.Name
+	case *ast.SelectorExpr:
+		pkgIdent, ok := t.X.(*ast.Ident)
+		if !ok {
+			return "", ""
+		}
+		importPath, found := v.importMap[pkgIdent.Name]
+		if !found {
+			return "", ""
+		}
+		pkgPath, typeName = importPath, t.Sel.Name
+	default:
+		return "", ""
+	}
+	if _, isType := v.state.typeDefs[pkgPath+"."+typeName]; !isType {
+		return "", ""
+	}
+	return pkgPath, typeName
+}
+
+// concreteMethodIDs returns the IDs the method of a type may have, most likely first: a
+// method called on *T may be declared on *T or on T.
+func concreteMethodIDs(pkgPath, typeName, method string, pointer bool) []string {
+	valueID := fmt.Sprintf("%s.%s.%s", pkgPath, typeName, method)
+	if pointer {
+		return []string{fmt.Sprintf("%s.*%s.%s", pkgPath, typeName, method), valueID}
+	}
+	return []string{valueID}
+}
+
+// assertedMethodIDs returns the IDs of the method called on the concrete type of a type
+// assertion, like x.(*Foo).Bar(), or on the variable of a type switch case naming a single
+// type, like v.Bar() under `case *Foo:`. It only applies with -types, when the checker
+// couldn't resolve the call itself, which is the case when the asserted value comes from a
+// package that wasn't analyzed, such as c.MustGet("user").(*User).Name().
+func (v *callSiteVisitor) assertedMethodIDs(sel *ast.SelectorExpr) []string {
+	if v.info == nil {
+		return nil
+	}
+	var typ ast.Expr
+	switch x := ast.Unparen(sel.X).(type) {
+	case *ast.TypeAssertExpr:
+		typ = x.Type
+	case *ast.Ident:
+		typ = v.switchTypes[x.Name]
+	}
+	if typ == nil {
+		return nil
+	}
+	pointer := false
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ, pointer = star.X, true
+	}
+	pkgPath, typeName := v.analyzedType(typ)
+	if typeName == "" {
+		return nil
+	}
+	return concreteMethodIDs(pkgPath, typeName, sel.Sel.Name, pointer)
+}
+
+// walkTypeSwitch walks a type switch binding a variable, as in `switch u := x.(type)`,
+// binding u to the type of each case naming a single type for assertedMethodIDs.
+func (v *callSiteVisitor) walkTypeSwitch(stmt *ast.TypeSwitchStmt) {
+	if stmt.Init != nil {
+		ast.Walk(v, stmt.Init)
+	}
+	ast.Walk(v, stmt.Assign)
+	name := stmt.Assign.(*ast.AssignStmt).Lhs[0].(*ast.Ident).Name
+	for _, clause := range stmt.Body.List {
+		cc := clause.(*ast.CaseClause)
+		child := *v
+		child.switchTypes = make(map[string]ast.Expr, len(v.switchTypes)+1)
+		for n, t := range v.switchTypes {
+			child.switchTypes[n] = t
+		}
+		if len(cc.List) == 1 && name != "_" {
+			child.switchTypes[name] = cc.List[0]
+		} else {
+			delete(child.switchTypes, name) // The variable has the type of x
+		}
+		ast.Walk(&child, cc)
+	}
+}
+
+// addReference records a use of the package-level value id by ident. Without type
+// information an identifier with the value's name counts unless the parser bound it to a
+// local declaration, such as a variable or parameter shadowing the value; with it, only
+// identifiers denoting a package-level constant or variable are kept, under the ID of the
+// value they denote.
+func (v *callSiteVisitor) addReference(id string, ident *ast.Ident) {
+	if ident.Name == "_" {
+		return
+	}
+	// The parser binds an identifier to the declaration it resolves to within the file; one
+	// bound to anything but a package-level object is a local, parameter or label.
+	if v.info == nil && ident.Obj != nil && v.fileScope != nil && v.fileScope.Lookup(ident.Name) != ident.Obj {
+		return
+	}
+	if v.info != nil {
+		obj := v.info.Uses[ident]
+		switch obj.(type) {
+		case *types.Var, *types.Const:
+		default:
+			return
+		}
+		if obj.Pkg() == nil || obj.Parent() != obj.Pkg().Scope() {
+			return
+		}
+		id = obj.Pkg().Path() + "." + obj.Name()
+	}
+	pos := v.fileSet.Position(ident.Pos())
+	relPath, _ := filepath.Rel(v.target.FSRoot, pos.Filename)
+	ref := fileCall{
+		Callee:        id,
+		CallerInitKey: v.initKeyStack[len(v.initKeyStack)-1],
+		Site: CallSite{
+			FilePath: filepath.ToSlash(relPath),
+			Line:     pos.Line,
+			CallerID: v.callerIDStack[len(v.callerIDStack)-1],
+			Context:  v.context,
+			CallKind: callKindReference,
+		},
+	}
+	if v.state.opts.WithOffsets {
+		ref.Site.Offset = pos.Offset
+	}
+	*v.references = append(*v.references, ref)
+}
+
+// withoutTypeArgs strips the type arguments of an explicitly instantiated function or type,
+// so that Map[int] and pkg.Stack[string] name the generic definitions Map and pkg.Stack.
+func withoutTypeArgs(expr ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.IndexExpr:
+		return e.X
+	case *ast.IndexListExpr:
+		return e.X
+	}
+	return expr
+}
+
+// interfaceMethod returns the interface type ID and method name of a call through an
+// interface method, known with type information only. The interface is the declared type
+// of the variable called on when there is one, like Store for `var s Store; s.Get()`,
+// rather than the embedded Reader declaring Get, so that only Store's implementations
+// are linked.
+func (v *callSiteVisitor) interfaceMethod(fun ast.Expr) (ifaceID, method string) {
+	sel, ok := fun.(*ast.SelectorExpr)
+	if !ok || v.info == nil {
+		return "", ""
+	}
+	fn, ok := v.info.Uses[sel.Sel].(*types.Func)
+	if !ok {
+		return "", ""
+	}
+	sig, ok := fn.Type().(*types.Signature)
+	if !ok || sig.Recv() == nil {
+		return "", ""
+	}
+	ifaceID = typesInterfaceID(sig.Recv().Type())
+	if ifaceID == "" {
+		return "", ""
+	}
+	if x, ok := sel.X.(*ast.Ident); ok {
+		if obj, ok := v.info.Uses[x].(*types.Var); ok {
+			if id := typesInterfaceID(obj.Type()); id != "" {
+				ifaceID = id
+			}
+		}
+	}
+	return ifaceID, fn.Name()
+}
+
+// selectorRoot returns the identifier a chain of selectors starts from, e.g. cfg for
+// cfg.DB.Connect, or nil when the chain starts with a call, index or other expression.
+func selectorRoot(expr ast.Expr) *ast.Ident {
+	for {
+		switch e := expr.(type) {
+		case *ast.Ident:
+			return e
+		case *ast.SelectorExpr:
+			expr = e.X
+		default:
+			return nil
+		}
+	}
+}
+
+// dotImportCallees returns the IDs an unqualified call could also refer to through the
+// file's dot imports. They are tried in order when the calling package doesn't declare the function.
+func (v *callSiteVisitor) dotImportCallees(fun ast.Expr) []string {
+	ident, ok := fun.(*ast.Ident)
+	if !ok {
+		return nil
+	}
+	var ids []string
+	for _, pkgPath := range v.dotImports {
+		ids = append(ids, fmt.Sprintf("%s.%s", pkgPath, ident.Name))
+	}
+	return ids
+}
+
+// unresolvedReason classifies why a call expression did not match any known Definition.
+func (v *callSiteVisitor) unresolvedReason(fun ast.Expr) string {
+	switch f := fun.(type) {
+	case *ast.SelectorExpr:
+		pkgIdent, ok := f.X.(*ast.Ident)
+		if !ok {
+			// A chain on a standard library package, like http.DefaultClient.Do(), is a
+			// standard library call whatever the member in between.
+			if root := selectorRoot(f.X); root != nil {
+				if rootPath, found := v.importMap[root.Name]; found && isStdlibPath(rootPath) {
+					return unresolvedStdlib
+				}
+			}
+			return unresolvedChained
+		}
+		fullPkgPath, found := v.importMap[pkgIdent.Name]
+		if !found {
+			return unresolvedVariable
+		}
+		if isStdlibPath(fullPkgPath) {
+			return unresolvedStdlib
+		}
+		return unresolvedExternal
+	case *ast.Ident:
+		return unresolvedUnknown
+	}
+	return unresolvedOther
+}
+
+// countKinds tallies definitions by Kind, overall and per package.
+func countKinds(defs map[string]Definition) (KindCounts, map[string]KindCounts) {
+	var total KindCounts
+	perPackage := make(map[string]KindCounts)
+	for _, def := range defs {
+		pkg := perPackage[def.Package]
+		for _, counts := range []*KindCounts{&total, &pkg} {
+			switch def.Kind {
+			case "function":
+				counts.Functions++
+			case "method":
+				counts.Methods++
+			case "constructor":
+				counts.Constructors++
+			}
+		}
+		perPackage[def.Package] = pkg
+	}
+	return total, perPackage
+}
+
+// logResolutionSummary prints how many call expressions were linked and why the rest were
+// not; typeChecked (-types) selects the note on the method calls that couldn't be.
+func logResolutionSummary(stats ResolutionStats, typeChecked bool) {
+	if stats.Total == 0 {
+		log.Println("Resolution summary: no call expressions found")
+		return
+	}
+	log.Printf("Resolution summary: %d call expressions, %d resolved (%.1f%%), %d unresolved",
+		stats.Total, stats.Resolved, 100*float64(stats.Resolved)/float64(stats.Total), stats.Unresolved)
+	reasons := make([]string, 0, len(stats.ByReason))
+	for reason := range stats.ByReason {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if stats.ByReason[reasons[i]] != stats.ByReason[reasons[j]] {
+			return stats.ByReason[reasons[i]] > stats.ByReason[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	for _, reason := range reasons {
+		log.Printf("  unresolved (%s): %d", reason, stats.ByReason[reason])
+	}
+	// Packages are listed least covered first, where missing edges are most likely.
+	packages := make([]string, 0, len(stats.ByPackage))
+	for pkg := range stats.ByPackage {
+		packages = append(packages, pkg)
+	}
+	coverage := func(p PackageResolution) float64 { return 100 * float64(p.Resolved) / float64(p.Total) }
+	sort.Slice(packages, func(i, j int) bool {
+		ci, cj := coverage(stats.ByPackage[packages[i]]), coverage(stats.ByPackage[packages[j]])
+		if ci != cj {
+			return ci < cj
+		}
+		return packages[i] < packages[j]
+	})
+	log.Println("Coverage per package:")
+	for _, pkg := range packages {
+		p := stats.ByPackage[pkg]
+		log.Printf("  %s: %d of %d calls resolved (%.1f%%)", pkg, p.Resolved, p.Total, coverage(p))
+	}
+	if stats.ByReason[unresolvedVariable] > 0 {
+		if typeChecked {
+			log.Println("Note: method calls on interface values and on values of packages that weren't analyzed can't be resolved, so their edges are missing from the map.")
+		} else {
+			log.Println("Note: method calls on variables and interface values can't be resolved from syntax alone, so their edges are missing from the map; -types resolves the ones on concrete types.")
+		}
+	}
+}
+
+// findCallSites prepares and runs the callSiteVisitor on a file.
+func findCallSites(filePath string, target AnalysisTarget) (fileRecord, bool) {
+	// The package is checked before parseGoFile takes the file out of the cache, so the
+	// checker reuses the Pass 1 ASTs of the whole package.
+	var checked *checkedPackage
+	if typesChecker != nil {
+		checked = typesChecker.packageFor(target, filePath)
+	}
+	node, _ := parseGoFile(filePath, target.FileSet, false, target.state.opts.LowMemory)
+	if node == nil {
+		return nil, false
+	}
+	var info *types.Info
+	if checked != nil && checked.files[filePath] != nil {
+		// The types.Info is keyed by the nodes that were checked, which differ from a fresh parse with -low-memory.
+		node, info = checked.files[filePath], checked.info
+	}
+
+	currentFullPkgPath, relPath := packagePathFor(target, filePath)
+	currentFullPkgPath = filePackagePath(currentFullPkgPath, relPath, node)
+	return callSitesIn(node, target.FileSet, target, currentFullPkgPath, info, target.state), true
+}
+
+// callSitesIn collects the calls of a parsed file of package pkgPath, configured by state,
+// with the type information of its package when info isn't nil.
+func callSitesIn(node *ast.File, fset *token.FileSet, target AnalysisTarget, pkgPath string, info *types.Info, state *passState) *fileCallSites {
+	rec := &fileCallSites{Package: pkgPath, Imports: importPaths(node)}
+	visitor := &callSiteVisitor{
+		fileSet:       fset,
+		target:        target,
+		importMap:     buildImportMap(node, state.packageNames),
+		dotImports:    dotImportPaths(node),
+		currentPkg:    pkgPath,
+		callerIDStack: []string{},
+		info:          info,
+		calls:         &rec.Calls,
+		methodValues:  &rec.MethodValues,
+		called:        make(map[*ast.SelectorExpr]bool),
+		state:         state,
+	}
+	if state.opts.TrackVars {
+		visitor.references = &rec.References
+		visitor.fileScope = node.Scope
+	}
+	ast.Walk(visitor, node)
+	return rec
 }
@@ -0,0 +1,1463 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// runMainEnv makes the test binary run main instead of the tests, with the arguments that
+// follow "--", see runCommand.
+const runMainEnv = "CODEMAPPER_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		for i, arg := range os.Args {
+			if arg == "--" {
+				os.Args = append([]string{os.Args[0]}, os.Args[i+1:]...)
+				break
+			}
+		}
+		main()
+		os.Exit(0)
+	}
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// runCommand runs codemapper with args in a child process and returns its combined output.
+func runCommand(t *testing.T, args ...string) ([]byte, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	return cmd.CombinedOutput()
+}
+
+// writeModule writes files, keyed by slash-separated path, below a temporary directory and
+// returns it. A go.mod must be among them for the directory to be analyzed.
+func writeModule(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// analyzeModule runs Analyze on the module in dir with o.
+func analyzeModule(t *testing.T, dir string, o Options) *Result {
+	t.Helper()
+	o.TargetPath = dir
+	result, err := Analyze(o)
+	if err != nil {
+		t.Fatalf("Analyze: %v", err)
+	}
+	return result
+}
+
+// findMapping returns the mapping of id in result, or nil.
+func findMapping(result *Result, id string) *Mapping {
+	for i := range result.Mappings {
+		if result.Mappings[i].Definition.ID == id {
+			return &result.Mappings[i]
+		}
+	}
+	return nil
+}
+
+// callers returns the caller IDs of the call sites of id, in output order.
+func callers(t *testing.T, result *Result, id string) []string {
+	t.Helper()
+	m := findMapping(result, id)
+	if m == nil {
+		t.Fatalf("no mapping for %s", id)
+	}
+	var ids []string
+	for _, cs := range m.CallSites {
+		ids = append(ids, cs.CallerID)
+	}
+	return ids
+}
+
+func TestResolutionStats(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/stats\n\ngo 1.23.0\n",
+		"main.go": `package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func helper() {}
+
+func main() {
+	helper()
+	fmt.Println()
+	var b strings.Builder
+	b.WriteString("x")
+	f := func() {}
+	f()
+}
+`,
+	})
+	stats := analyzeModule(t, dir, Options{}).Metadata.Resolution
+	if stats.Total != 4 || stats.Resolved != 1 || stats.Unresolved != 3 {
+		t.Errorf("got %d calls, %d resolved, %d unresolved; want 4, 1, 3", stats.Total, stats.Resolved, stats.Unresolved)
+	}
+	for _, reason := range []string{unresolvedStdlib, unresolvedVariable, unresolvedUnknown} {
+		if stats.ByReason[reason] != 1 {
+			t.Errorf("ByReason[%q] = %d, want 1", reason, stats.ByReason[reason])
+		}
+	}
+	if p := stats.ByPackage["example.com/stats"]; p.Total != 4 || p.Resolved != 1 {
+		t.Errorf("ByPackage = %+v, want 4 calls, 1 resolved", p)
+	}
+}
+
+func TestGoEnvRunsOnce(t *testing.T) {
+	saved := runGoEnv
+	t.Cleanup(func() { runGoEnv = saved })
+	goEnvOnce, goEnvCache, goEnvErr = sync.Once{}, nil, nil
+	runs := 0
+	runGoEnv = func() ([]byte, error) {
+		runs++
+		return saved()
+	}
+	dir := writeModule(t, map[string]string{
+		"go.mod":  "module example.com/env\n\ngo 1.23.0\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	})
+	for i := 0; i < 2; i++ {
+		if result := analyzeModule(t, dir, Options{}); result.Options.GoModCache == "" {
+			t.Fatal("GoModCache wasn't resolved")
+		}
+	}
+	if _, err := goEnv("GOROOT"); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 1 {
+		t.Errorf("go env ran %d times, want 1", runs)
+	}
+}
+
+// indexFixture declares types, methods, an interface assertion, two init functions and a
+// constant, so a definition index has all of Pass 1's state to carry.
+var indexFixture = map[string]string{
+	"go.mod": "module example.com/idx\n\ngo 1.23.0\n",
+	"store/store.go": `package store
+
+type Getter interface{ Get(k string) string }
+
+type Store struct{}
+
+var _ Getter = (*Store)(nil)
+
+const DefaultKey = "k"
+
+func New() *Store { return &Store{} }
+
+func (s *Store) Get(k string) string { return k }
+
+func init() {}
+`,
+	"main.go": `package main
+
+import "example.com/idx/store"
+
+func init() { setup() }
+
+func init() {}
+
+func setup() {}
+
+func main() {
+	s := store.New()
+	s.Get(store.DefaultKey)
+}
+`,
+}
+
+// runOutput is what a run writes: the mappings, the values of -track-vars, the types and
+// the resolution summary.
+func runOutput(t *testing.T, result *Result) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeJSONMappings(&buf, result); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []any{valueReport(result), result.Types, result.Metadata.Resolution} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(data)
+	}
+	return buf.String()
+}
+
+func TestDefinitionIndexRoundTrip(t *testing.T) {
+	dir := writeModule(t, indexFixture)
+	index := filepath.Join(t.TempDir(), "defs.json")
+	combined := runOutput(t, analyzeModule(t, dir, Options{TrackVars: true, DefIndexOut: index}))
+	resumed := runOutput(t, analyzeModule(t, dir, Options{TrackVars: true, DefIndexIn: index}))
+	if combined != resumed {
+		t.Errorf("run from the index differs from the combined run:\ncombined: %s\nresumed:  %s", combined, resumed)
+	}
+	if !bytes.Contains([]byte(combined), []byte(`"example.com/idx.init#1"`)) || !bytes.Contains([]byte(combined), []byte("DefaultKey")) {
+		t.Errorf("fixture isn't exercised: %s", combined)
+	}
+}
+
+func TestCrossFileCalls(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":    "module example.com/cross\n\ngo 1.23.0\n",
+		"util/a.go": "package util\n\nfunc Helper() {}\n\nfunc local() {}\n",
+		"util/b.go": "package util\n\nfunc Run() {\n\tHelper()\n\tlocal()\n}\n",
+		"main.go":   "package main\n\nimport \"example.com/cross/util\"\n\nfunc main() { util.Run() }\n",
+	})
+	result := analyzeModule(t, dir, Options{})
+	for _, id := range []string{"example.com/cross/util.Helper", "example.com/cross/util.local"} {
+		got := callers(t, result, id)
+		if len(got) != 1 || got[0] != "example.com/cross/util.Run" {
+			t.Errorf("callers of %s = %v, want [example.com/cross/util.Run]", id, got)
+		}
+	}
+	if m := findMapping(result, "example.com/cross/util.Helper"); m.CallSites[0].FilePath != "util/b.go" {
+		t.Errorf("call site in %s, want util/b.go", m.CallSites[0].FilePath)
+	}
+}
+
+// filePaths collects the values of every "filePath" key in decoded JSON.
+func filePaths(v any, found []string) []string {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if s, ok := value.(string); ok && key == "filePath" {
+				found = append(found, s)
+				continue
+			}
+			found = filePaths(value, found)
+		}
+	case []any:
+		for _, item := range v {
+			found = filePaths(item, found)
+		}
+	}
+	return found
+}
+
+func TestRedactPaths(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":                 "module example.com/redact\n\ngo 1.23.0\n",
+		"internal/secret/api.go": "package secret\n\ntype Key struct{}\n\nfunc Get() Key { return Key{} }\n",
+		"main.go":                "package main\n\nimport \"example.com/redact/internal/secret\"\n\nfunc main() { secret.Get() }\n",
+	})
+	result := analyzeModule(t, dir, Options{})
+	redactOutput(result)
+	var buf bytes.Buffer
+	if err := writeJSONMappings(&buf, result); err != nil {
+		t.Fatal(err)
+	}
+	out := []byte("[" + buf.String())
+	for _, v := range []any{result.Definitions, result.Types, result.Metadata} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(append(out, ','), data...)
+	}
+	out = append(out, ']')
+	var decoded any
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	paths := filePaths(decoded, nil)
+	if len(paths) == 0 {
+		t.Fatal("no filePath in the output")
+	}
+	for _, p := range paths {
+		if filepath.IsAbs(p) || strings.HasPrefix(p, "/") || strings.Contains(p, "secret") {
+			t.Errorf("filePath %q isn't redacted", p)
+		}
+	}
+	if strings.Contains(string(out), dir) || strings.Contains(string(out), "internal/secret/api.go") {
+		t.Errorf("output still names the analyzed directory or a file path: %s", out)
+	}
+}
+
+func TestCapCallSites(t *testing.T) {
+	m := Mapping{CallSites: []CallSite{
+		{FilePath: "b.go", Line: 3, CallerID: "p.b"},
+		{FilePath: "a.go", Line: 9, CallerID: "p.z"},
+		{FilePath: "a.go", Line: 9, CallerID: "p.y"},
+		{FilePath: "a.go", Line: 2, CallerID: "p.a"},
+	}}
+	capCallSites(&m, 2)
+	if !m.Truncated || m.TotalCallSites != 4 || len(m.CallSites) != 2 {
+		t.Fatalf("got truncated=%t total=%d kept=%d, want true, 4, 2", m.Truncated, m.TotalCallSites, len(m.CallSites))
+	}
+	// The two calls on a.go:9 are told apart by caller, whatever their order was.
+	if got := m.CallSites[0].CallerID + "," + m.CallSites[1].CallerID; got != "p.a,p.y" {
+		t.Errorf("kept %s, want p.a,p.y", got)
+	}
+
+	under := Mapping{CallSites: []CallSite{{FilePath: "a.go", Line: 1}}}
+	capCallSites(&under, 2)
+	if under.Truncated || under.TotalCallSites != 0 {
+		t.Errorf("a mapping under the cap was marked truncated")
+	}
+}
+
+func TestBuildTagsSelectFiles(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":  "module example.com/tags\n\ngo 1.23.0\n",
+		"free.go": "//go:build !pro\n\npackage main\n\nfunc edition() { freeFeatures() }\n\nfunc freeFeatures() {}\n",
+		"pro.go":  "//go:build pro\n\npackage main\n\nfunc edition() { proFeatures() }\n\nfunc proFeatures() {}\n",
+		"main.go": "package main\n\nfunc main() { edition() }\n",
+	})
+	for _, tc := range []struct {
+		tags          []string
+		want, dropped string
+	}{
+		{nil, "example.com/tags.freeFeatures", "example.com/tags.proFeatures"},
+		{[]string{"pro"}, "example.com/tags.proFeatures", "example.com/tags.freeFeatures"},
+	} {
+		ctx, err := newBuildContext(tc.tags, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := analyzeModule(t, dir, Options{BuildTags: tc.tags, BuildContext: ctx})
+		if _, ok := result.Definitions[tc.want]; !ok {
+			t.Errorf("tags %v: %s wasn't analyzed", tc.tags, tc.want)
+		}
+		if _, ok := result.Definitions[tc.dropped]; ok {
+			t.Errorf("tags %v: %s was analyzed", tc.tags, tc.dropped)
+		}
+		if got := callers(t, result, "example.com/tags.edition"); len(got) != 1 {
+			t.Errorf("tags %v: edition has %d call sites, want 1", tc.tags, len(got))
+		}
+	}
+}
+
+func TestMultipleInitFunctions(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/inits\n\ngo 1.23.0\n",
+		"main.go": `package main
+
+func init() { first() }
+
+func init() { second() }
+
+func first()  {}
+func second() {}
+
+func main() {}
+`,
+		"other.go": "package main\n\nfunc init() { third() }\n\nfunc third() {}\n",
+	})
+	result := analyzeModule(t, dir, Options{})
+	want := map[string]string{
+		"example.com/inits.first":  "example.com/inits.init#1",
+		"example.com/inits.second": "example.com/inits.init#2",
+		"example.com/inits.third":  "example.com/inits.init#3",
+	}
+	for callee, initID := range want {
+		def, ok := result.Definitions[initID]
+		if !ok || def.Name != "init" {
+			t.Errorf("no init definition %s", initID)
+		}
+		if got := callers(t, result, callee); len(got) != 1 || got[0] != initID {
+			t.Errorf("callers of %s = %v, want [%s]", callee, got, initID)
+		}
+	}
+	if _, ok := result.Definitions["example.com/inits.init"]; ok {
+		t.Error("an init function kept the undisambiguated ID")
+	}
+}
+
+func TestDotImportCalls(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":           "module example.com/tm\n\ngo 1.23.0\n",
+		"helper/helper.go": "package helper\n\nfunc Help() {}\n",
+		"main.go": `package main
+
+import . "example.com/tm/helper"
+
+func local() {}
+
+func main() {
+	Help()
+	local()
+}
+`,
+	})
+	result := analyzeModule(t, dir, Options{})
+	for _, id := range []string{"example.com/tm/helper.Help", "example.com/tm.local"} {
+		if got := callers(t, result, id); len(got) != 1 || got[0] != "example.com/tm.main" {
+			t.Errorf("callers of %s = %v, want [example.com/tm.main]", id, got)
+		}
+	}
+	if _, ok := result.Definitions["example.com/tm.Help"]; ok {
+		t.Error("Help was taken for a function of the calling package")
+	}
+}
+
+func TestGenericIDs(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/gen\n\ngo 1.23.0\n",
+		"main.go": `package main
+
+type Stack[T any] struct{ items []T }
+
+func (s *Stack[T]) Push(v T) { s.items = append(s.items, v) }
+
+func (s Stack[T]) Len() int { return len(s.items) }
+
+func Map[T, U any](xs []T, f func(T) U) []U { return nil }
+
+func main() {
+	s := &Stack[int]{}
+	s.Push(1)
+	(*Stack[int]).Push(s, 2)
+	Stack[string]{}.Len()
+	Map[int, string](nil, nil)
+	Map([]int{1}, func(int) string { return "" })
+}
+`,
+	})
+	tests := []struct {
+		types bool
+		calls map[string]int
+	}{
+		// Without -types only the calls naming the type or function resolve.
+		{false, map[string]int{"example.com/gen.*Stack.Push": 1, "example.com/gen.Map": 2}},
+		{true, map[string]int{"example.com/gen.*Stack.Push": 2, "example.com/gen.Stack.Len": 1, "example.com/gen.Map": 2}},
+	}
+	for _, tt := range tests {
+		result := analyzeModule(t, dir, Options{TypeCheck: tt.types})
+		for id := range result.Definitions {
+			if strings.Contains(id, "[") {
+				t.Errorf("-types=%v: ID %s keeps type parameters", tt.types, id)
+			}
+		}
+		for id, want := range tt.calls {
+			if got := callers(t, result, id); len(got) != want {
+				t.Errorf("-types=%v: %s has %d call sites, want %d", tt.types, id, len(got), want)
+			}
+		}
+	}
+}
+
+// orderFixture is a module whose functions call each other from several files, so that an
+// output built from map iteration comes out in a different order on almost every run.
+func orderFixture() map[string]string {
+	files := map[string]string{"go.mod": "module example.com/order\n\ngo 1.23.0\n"}
+	for f := 0; f < 3; f++ {
+		var src strings.Builder
+		src.WriteString("package main\n")
+		for i := 0; i < 10; i++ {
+			fmt.Fprintf(&src, "\nfunc f%d_%d() {\n", f, i)
+			for j := 0; j < 10; j++ {
+				fmt.Fprintf(&src, "\tf%d_%d()\n", (f+j)%3, (i+j)%10)
+			}
+			src.WriteString("}\n")
+		}
+		files[fmt.Sprintf("file%d.go", f)] = src.String()
+	}
+	files["main.go"] = "package main\n\nfunc main() { f0_0() }\n"
+	return files
+}
+
+func TestOutputIsReproducible(t *testing.T) {
+	dir := writeModule(t, orderFixture())
+	var outputs [2][]byte
+	for i := range outputs {
+		out := filepath.Join(t.TempDir(), "codemap.json")
+		if cmdOut, err := runCommand(t, "-path", dir, "-out", out); err != nil {
+			t.Fatalf("run %d: %v\n%s", i, err, cmdOut)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs[i] = data
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Errorf("two runs on the same input wrote different output:\n%s\n%s", outputs[0], outputs[1])
+	}
+}
+
+func TestMethodExpressionAsValue(t *testing.T) {
+	// The fixture isn't type-checked: sort.Slice's less function takes no receiver, but the
+	// method expression is resolved from syntax alone.
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/sorted\n\ngo 1.23.0\n",
+		"main.go": `package main
+
+import "sort"
+
+type ByName []string
+
+func (s *ByName) Less(i, j int) bool { return (*s)[i] < (*s)[j] }
+
+func main() {
+	s := ByName{"b", "a"}
+	sort.Slice(s, (*ByName).Less)
+	(*ByName).Less(&s, 0, 1)
+	sort.Slice(s, (&s).Less)
+}
+`,
+	})
+	result := analyzeModule(t, dir, Options{})
+	less := findMapping(result, "example.com/sorted.*ByName.Less")
+	if less == nil {
+		t.Fatal("no mapping for *ByName.Less")
+	}
+	// The method value (&s).Less isn't linked; both method expressions are.
+	var got []string
+	for _, cs := range less.CallSites {
+		got = append(got, fmt.Sprintf("%s@%d by %s", cs.CallKind, cs.Line, cs.CallerID))
+	}
+	want := []string{"reference@11 by example.com/sorted.main", "call@12 by example.com/sorted.main"}
+	if !slices.Equal(got, want) {
+		t.Errorf("call sites of *ByName.Less = %v, want %v", got, want)
+	}
+}
+
+func TestFocusSortsCallSites(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":     "module example.com/focus\n\ngo 1.23.0\n",
+		"lib/lib.go": "package lib\n\nfunc Run() {}\n",
+		"app/app.go": `package app
+
+import "example.com/focus/lib"
+
+type T struct{}
+
+func (T) Helper() { lib.Run() }
+`,
+		"main.go": `package main
+
+import (
+	"example.com/focus/app"
+	"example.com/focus/lib"
+)
+
+func both() {
+	f := app.T.Helper
+	app.T.Helper(app.T{})
+	lib.Run()
+	f(app.T{})
+}
+
+func main() {
+	app.T.Helper(app.T{})
+	both()
+}
+`,
+	})
+	result := analyzeModule(t, dir, Options{Focus: "example.com/focus/lib"})
+	// Helper is kept as a caller of lib, with only the calls from both, which calls lib too;
+	// the reference is found after the calls, but comes first in the file.
+	helper := findMapping(result, "example.com/focus/app.T.Helper")
+	if helper == nil {
+		t.Fatal("no mapping for T.Helper")
+	}
+	var got []string
+	for _, cs := range helper.CallSites {
+		got = append(got, fmt.Sprintf("%s@%d by %s", cs.CallKind, cs.Line, cs.CallerID))
+	}
+	want := []string{"reference@9 by example.com/focus.both", "call@10 by example.com/focus.both"}
+	if !slices.Equal(got, want) {
+		t.Errorf("call sites of T.Helper = %v, want %v", got, want)
+	}
+}
+
+func TestDependencyBuildConstraints(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fixture's excluded file is the windows one")
+	}
+	dir := writeModule(t, map[string]string{
+		"app/go.mod": "module example.com/app\n\ngo 1.23.0\n\nrequire example.com/dep v1.0.0\n",
+		"app/main.go": `package main
+
+import "example.com/dep"
+
+func main() {
+	dep.Portable()
+	dep.Platform()
+}
+`,
+		"cache/example.com/dep@v1.0.0/go.mod":      "module example.com/dep\n\ngo 1.23.0\n",
+		"cache/example.com/dep@v1.0.0/dep.go":      "package dep\n\nfunc Portable() {}\n",
+		"cache/example.com/dep@v1.0.0/platform.go": "//go:build windows\n\npackage dep\n\nfunc Platform() {}\n\nfunc WindowsOnly() {}\n",
+	})
+	result, err := Analyze(Options{
+		TargetPath:  filepath.Join(dir, "app"),
+		GoModCache:  filepath.Join(dir, "cache"),
+		AnalyzeDeps: []string{"example.com/dep"},
+	})
+	if err != nil {
+		t.Fatalf("Analyze: %v", err)
+	}
+	if _, ok := result.Definitions["example.com/dep.Portable"]; !ok {
+		t.Error("the dependency's untagged file wasn't analyzed")
+	}
+	for _, id := range []string{"example.com/dep.Platform", "example.com/dep.WindowsOnly"} {
+		if _, ok := result.Definitions[id]; ok {
+			t.Errorf("%s of the windows-only file was analyzed on %s", id, runtime.GOOS)
+		}
+	}
+}
+
+func TestIncludeTests(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":     "module example.com/tt\n\ngo 1.23.0\n",
+		"lib/lib.go": "package lib\n\nfunc Add(a, b int) int { return a + b }\n",
+		"lib/lib_test.go": `package lib
+
+import "testing"
+
+func setup() {}
+
+func TestAdd(t *testing.T) {
+	setup()
+	Add(1, 2)
+}
+`,
+		"lib/ext_test.go": `package lib_test
+
+import (
+	"testing"
+
+	"example.com/tt/lib"
+)
+
+func setup() {}
+
+func TestExt(t *testing.T) {
+	setup()
+	lib.Add(1, 2)
+}
+`,
+	})
+	if result := analyzeModule(t, dir, Options{}); len(result.Definitions) != 1 {
+		t.Errorf("without -include-tests: %d definitions, want only Add", len(result.Definitions))
+	}
+
+	result := analyzeModule(t, dir, Options{IncludeTests: true})
+	for id, want := range map[string]Definition{
+		"example.com/tt/lib.Add":          {Package: "example.com/tt/lib", TestFile: false},
+		"example.com/tt/lib.setup":        {Package: "example.com/tt/lib", TestFile: true},
+		"example.com/tt/lib.TestAdd":      {Package: "example.com/tt/lib", TestFile: true},
+		"example.com/tt/lib_test.setup":   {Package: "example.com/tt/lib_test", TestFile: true},
+		"example.com/tt/lib_test.TestExt": {Package: "example.com/tt/lib_test", TestFile: true},
+	} {
+		def, ok := result.Definitions[id]
+		if !ok {
+			t.Errorf("no definition %s", id)
+			continue
+		}
+		if def.Package != want.Package || def.TestFile != want.TestFile {
+			t.Errorf("%s: package %s, testFile %v; want %s, %v", id, def.Package, def.TestFile, want.Package, want.TestFile)
+		}
+	}
+	// In file order: ext_test.go, then lib_test.go.
+	want := []string{"example.com/tt/lib_test.TestExt", "example.com/tt/lib.TestAdd"}
+	if got := callers(t, result, "example.com/tt/lib.Add"); !slices.Equal(got, want) {
+		t.Errorf("callers of Add = %v, want %v", got, want)
+	}
+	for _, pkg := range []string{"example.com/tt/lib", "example.com/tt/lib_test"} {
+		if got := callers(t, result, pkg+".setup"); len(got) != 1 || !strings.HasPrefix(got[0], pkg+".Test") {
+			t.Errorf("callers of %s.setup = %v, want the test of its own package", pkg, got)
+		}
+	}
+}
+
+func TestTestHelpers(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":     "module example.com/th\n\ngo 1.23.0\n",
+		"lib/lib.go": "package lib\n\nfunc Add(a, b int) int { return a + b }\n",
+		"lib/lib_test.go": `package lib
+
+import "testing"
+
+func checkSum(t *testing.T, got, want int) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func other(t *testing.T) { t.Log("no helper") }
+
+func TestAdd(t *testing.T) {
+	checkSum(t, Add(1, 2), 3)
+	other(t)
+}
+`,
+	})
+	result := analyzeModule(t, dir, Options{IncludeTests: true})
+	for id, want := range map[string]bool{
+		"example.com/th/lib.checkSum": true,
+		"example.com/th/lib.other":    false,
+		"example.com/th/lib.TestAdd":  false,
+	} {
+		def, ok := result.Definitions[id]
+		if !ok {
+			t.Errorf("no definition %s", id)
+		} else if def.IsTestHelper != want {
+			t.Errorf("%s: isTestHelper = %v, want %v", id, def.IsTestHelper, want)
+		}
+	}
+}
+
+func TestCallerFileCount(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":  "module example.com/spread\n\ngo 1.23.0\n",
+		"util.go": "package main\n\nfunc util() {}\n",
+		"a.go":    "package main\n\nfunc a() {\n\tutil()\n\tutil()\n}\n",
+		"main.go": "package main\n\nfunc main() {\n\ta()\n\tutil()\n}\n",
+	})
+	result := analyzeModule(t, dir, Options{})
+	m := findMapping(result, "example.com/spread.util")
+	if m == nil {
+		t.Fatal("no mapping for util")
+	}
+	if m.CallerFileCount != 2 || m.CallCount != 3 {
+		t.Errorf("util: callerFileCount %d, callCount %d; want 2 and 3", m.CallerFileCount, m.CallCount)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/ctx\n\ngo 1.23.0\n",
+		"main.go": `package main
+
+func step(i int) int { return i }
+
+func done() bool { return true }
+
+func run() bool {
+	for i := 0; i < 3; i++ {
+		step(i)
+	}
+	return done()
+}
+
+func main() { run() }
+`,
+	})
+	contexts := func(result *Result, id string) []string {
+		var got []string
+		for _, cs := range findMapping(result, id).CallSites {
+			got = append(got, cs.Context)
+		}
+		return got
+	}
+	result := analyzeModule(t, dir, Options{CallContext: true})
+	if got := contexts(result, "example.com/ctx.step"); !slices.Equal(got, []string{"loop"}) {
+		t.Errorf("contexts of step = %v, want [loop]", got)
+	}
+	if got := contexts(result, "example.com/ctx.done"); !slices.Equal(got, []string{"return"}) {
+		t.Errorf("contexts of done = %v, want [return]", got)
+	}
+	if got := contexts(analyzeModule(t, dir, Options{}), "example.com/ctx.step"); !slices.Equal(got, []string{""}) {
+		t.Errorf("contexts of step without the option = %v, want none recorded", got)
+	}
+}
+
+func TestSkipCommonGenerated(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":            "module example.com/gen\n\ngo 1.23.0\n",
+		"mocks/store.go":    "package mocks\n\nfunc NewStore() {}\n",
+		"internal/proto.go": "package internal\n\nfunc Decode() {}\n",
+		"main.go": `package main
+
+import (
+	"example.com/gen/internal"
+	"example.com/gen/mocks"
+)
+
+func main() {
+	mocks.NewStore()
+	internal.Decode()
+}
+`,
+	})
+	definitions := func(args ...string) map[string]bool {
+		out := filepath.Join(t.TempDir(), "codemap.json")
+		if cmdOut, err := runCommand(t, append([]string{"-path", dir, "-out", out}, args...)...); err != nil {
+			t.Fatalf("%v: %v\n%s", args, err, cmdOut)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mappings []Mapping
+		if err := json.Unmarshal(data, &mappings); err != nil {
+			t.Fatal(err)
+		}
+		ids := make(map[string]bool)
+		for _, m := range mappings {
+			ids[m.Definition.ID] = true
+		}
+		return ids
+	}
+	tests := []struct {
+		args  []string
+		store bool // Whether mocks/ is analyzed
+		proto bool // Whether internal/ is analyzed
+	}{
+		{nil, true, true},
+		{[]string{"-skip-common-generated"}, false, true},
+		{[]string{"-skip-common-generated", "-generated-dirs", "internal"}, true, false},
+	}
+	for _, tt := range tests {
+		ids := definitions(tt.args...)
+		if ids["example.com/gen/mocks.NewStore"] != tt.store || ids["example.com/gen/internal.Decode"] != tt.proto {
+			t.Errorf("%v: got %v, want mocks analyzed %v and internal analyzed %v", tt.args, ids, tt.store, tt.proto)
+		}
+	}
+}
+
+func TestKindCounts(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/kinds\n\ngo 1.23.0\n",
+		"store/store.go": `package store
+
+type Store struct{}
+
+func NewStore() *Store { return &Store{} }
+
+func (s *Store) Get() {}
+
+func helper() {}
+`,
+		"main.go": "package main\n\nfunc main() {}\n",
+	})
+	result := analyzeModule(t, dir, Options{PerPackageKinds: true})
+	want := KindCounts{Functions: 1, Methods: 1, Constructors: 1}
+	if got := result.Metadata.PackageKinds["example.com/kinds/store"]; got != want {
+		t.Errorf("kinds of store = %+v, want %+v", got, want)
+	}
+	want.Functions++ // main
+	if got := result.Metadata.Kinds; got != want {
+		t.Errorf("kinds = %+v, want %+v", got, want)
+	}
+	if result := analyzeModule(t, dir, Options{}); result.Metadata.PackageKinds != nil {
+		t.Errorf("per-package kinds without the option: %v", result.Metadata.PackageKinds)
+	}
+}
+
+func TestLowMemoryMatchesDefault(t *testing.T) {
+	dir := writeModule(t, indexFixture)
+	parsed := recordParses(t)
+	for _, o := range []Options{{}, {TypeCheck: true}} {
+		def := runOutput(t, analyzeModule(t, dir, o))
+		files := len(parsed())
+		o.LowMemory = true
+		low := runOutput(t, analyzeModule(t, dir, o))
+		if def != low {
+			t.Errorf("-types=%v: -low-memory output differs:\ndefault:    %s\nlow-memory: %s", o.TypeCheck, def, low)
+		}
+		// Without the AST cache, Pass 2 parses every file again.
+		if got := len(parsed()); !o.TypeCheck && got != 2*files {
+			t.Errorf("-low-memory parsed %d files, want %d", got, 2*files)
+		}
+	}
+}
+
+func TestAnalyzePackageByImportPath(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":                  "module example.com/pk\n\ngo 1.23.0\n",
+		"main.go":                 "package main\n\nimport \"example.com/pk/internal/foo\"\n\nfunc main() { foo.Run() }\n",
+		"internal/foo/foo.go":     "package foo\n\nimport \"example.com/pk/internal/foo/bar\"\n\nfunc Run() { bar.Do(); local() }\n\nfunc local() {}\n",
+		"internal/foo/bar/bar.go": "package bar\n\nfunc Do() {}\n",
+	})
+	target, err := resolvePackageTarget(dir, "example.com/pk", "example.com/pk/internal/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := filepath.EvalSymlinks(filepath.Join(dir, "internal", "foo"))
+	if got, _ := filepath.EvalSymlinks(target.FSRoot); got != want || target.ModulePath != "example.com/pk/internal/foo" {
+		t.Errorf("target = %+v, want %s at %s", target, target.ModulePath, want)
+	}
+
+	for _, recursive := range []bool{false, true} {
+		result := analyzeModule(t, dir, Options{Package: "example.com/pk/internal/foo", Recursive: recursive})
+		if _, ok := result.Definitions["example.com/pk/internal/foo.Run"]; !ok {
+			t.Errorf("recursive=%v: Run of the package wasn't analyzed", recursive)
+		}
+		if _, ok := result.Definitions["example.com/pk.main"]; ok {
+			t.Errorf("recursive=%v: main, outside the package, was analyzed", recursive)
+		}
+		if _, ok := result.Definitions["example.com/pk/internal/foo/bar.Do"]; ok != recursive {
+			t.Errorf("recursive=%v: subpackage analyzed = %v", recursive, ok)
+		}
+	}
+}
+
+// depFixture is a module requiring example.com/a, which requires example.com/b, both in the
+// module cache at cache/; a declares go 1.21 and b go 1.22.
+var depFixture = map[string]string{
+	"app/go.mod": "module example.com/app\n\ngo 1.23.0\n\nrequire example.com/a v1.0.0\n",
+	"app/main.go": `package main
+
+import "example.com/a"
+
+func main() { a.A() }
+`,
+	"cache/example.com/a@v1.0.0/go.mod": "module example.com/a\n\ngo 1.21\n\nrequire example.com/b v1.2.0\n",
+	"cache/example.com/a@v1.0.0/a.go":   "package a\n\nimport \"example.com/b\"\n\nfunc A() { b.B() }\n",
+	"cache/example.com/b@v1.2.0/go.mod": "module example.com/b\n\ngo 1.22\n",
+	"cache/example.com/b@v1.2.0/b.go":   "package b\n\nfunc B() {}\n",
+}
+
+func TestDependencyDepth(t *testing.T) {
+	dir := writeModule(t, depFixture)
+	for _, depth := range []int{1, 2} {
+		result, err := Analyze(Options{
+			TargetPath:  filepath.Join(dir, "app"),
+			GoModCache:  filepath.Join(dir, "cache"),
+			AnalyzeDeps: []string{"example.com/a"},
+			DepDepth:    depth,
+		})
+		if err != nil {
+			t.Fatalf("depth %d: %v", depth, err)
+		}
+		if got := callers(t, result, "example.com/a.A"); !slices.Equal(got, []string{"example.com/app.main"}) {
+			t.Errorf("depth %d: callers of a.A = %v", depth, got)
+		}
+		// b is only reached through a's go.mod, one level further.
+		if _, ok := result.Definitions["example.com/b.B"]; ok != (depth == 2) {
+			t.Errorf("depth %d: b analyzed = %v", depth, ok)
+		} else if ok {
+			if got := callers(t, result, "example.com/b.B"); !slices.Equal(got, []string{"example.com/a.A"}) {
+				t.Errorf("depth %d: callers of b.B = %v", depth, got)
+			}
+		}
+	}
+}
+
+func TestReceiverIDsMatchAcrossPasses(t *testing.T) {
+	const src = `package gen
+
+func touch() {}
+
+type Stack[T any] struct{}
+
+func (s *Stack[T]) Push(v T) { touch() }
+
+type Map[K comparable, V any] map[K]V
+
+func (m Map[K, V]) Get(k K) V { touch(); var v V; return v }
+
+type Pair[K comparable, V any] struct{}
+
+func (p (*Pair[K, V])) Key() { touch() }
+`
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, "gen.go", src, parseMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &passState{opts: &Options{}}
+	var defined []string
+	for _, def := range definitionsIn(node, fset, nil, "example.com/gen", "gen.go", state).Definitions {
+		if def.Kind == "method" {
+			defined = append(defined, def.ID)
+		}
+	}
+	var callers []string
+	for _, c := range callSitesIn(node, fset, AnalysisTarget{}, "example.com/gen", nil, state).Calls {
+		callers = append(callers, c.Site.CallerID)
+	}
+	want := []string{"example.com/gen.*Stack.Push", "example.com/gen.Map.Get", "example.com/gen.*Pair.Key"}
+	if !slices.Equal(defined, want) {
+		t.Errorf("Pass 1 method IDs = %v, want %v", defined, want)
+	}
+	if !slices.Equal(callers, want) {
+		t.Errorf("Pass 2 caller IDs = %v, want %v", callers, want)
+	}
+}
+
+func TestImpactIncludesUpstreamCallers(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/imp\n\ngo 1.21\n",
+		"main.go": `package main
+
+func leaf() int { return 1 }
+
+func mid() int { return leaf() }
+
+func top() int { return mid() }
+
+func other() {}
+
+func unrelated() { other() }
+
+func main() { top(); unrelated() }
+`,
+	})
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-q", "-m", "base")
+	path := filepath.Join(dir, "main.go")
+	src, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, bytes.Replace(src, []byte("return 1"), []byte("return 2"), 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result := analyzeModule(t, dir, Options{ImpactBase: "HEAD"})
+	impact := result.Metadata.Impact
+	if impact == nil || !slices.Equal(impact.Changed, []string{"example.com/imp.leaf"}) {
+		t.Fatalf("impact = %+v, want only leaf changed", impact)
+	}
+	// leaf, mid, top and main, which calls top.
+	if impact.Impacted != 4 {
+		t.Errorf("impacted = %d, want 4", impact.Impacted)
+	}
+	var got []string
+	for _, m := range result.Mappings {
+		got = append(got, m.Definition.ID)
+	}
+	want := []string{"example.com/imp.leaf", "example.com/imp.main", "example.com/imp.mid", "example.com/imp.top"}
+	if !slices.Equal(got, want) {
+		t.Errorf("mappings = %v, want %v", got, want)
+	}
+	if got := callers(t, result, "example.com/imp.leaf"); !slices.Equal(got, []string{"example.com/imp.mid"}) {
+		t.Errorf("callers of leaf = %v", got)
+	}
+}
+
+func TestTargetGoVersions(t *testing.T) {
+	dir := writeModule(t, depFixture)
+	result, err := Analyze(Options{
+		TargetPath:  filepath.Join(dir, "app"),
+		GoModCache:  filepath.Join(dir, "cache"),
+		AnalyzeDeps: []string{"example.com/a"},
+		DepDepth:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, target := range result.Metadata.Targets {
+		got[target.ModulePath] = target.GoVersion
+	}
+	want := map[string]string{"example.com/app": "1.23.0", "example.com/a": "1.21", "example.com/b": "1.22"}
+	if !maps.Equal(got, want) {
+		t.Errorf("target Go versions = %v, want %v", got, want)
+	}
+}
+
+func TestUsageAssertions(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/use\n\ngo 1.21\n",
+		"main.go": `package main
+
+func Used() {}
+
+func Legacy() {}
+
+func main() { Used() }
+`,
+	})
+	tests := []struct {
+		args    []string
+		failure string // Expected assertion failure; empty when the run should succeed
+	}{
+		{[]string{"-assert-unused", "example.com/use.Legacy", "-assert-used", "example.com/use.Used"}, ""},
+		{[]string{"-assert-unused", "example.com/use.Used"}, "example.com/use.Used has 1 call sites, e.g. example.com/use.main at main.go:7"},
+		{[]string{"-assert-used", "example.com/use.Legacy"}, "example.com/use.Legacy has no call sites"},
+		{[]string{"-assert-used", "example.com/use.Gone"}, "example.com/use.Gone is not a known definition"},
+	}
+	for _, tt := range tests {
+		out := filepath.Join(t.TempDir(), "codemap.json")
+		cmdOut, err := runCommand(t, append([]string{"-path", dir, "-out", out}, tt.args...)...)
+		if tt.failure == "" {
+			if err != nil {
+				t.Errorf("%v: %v\n%s", tt.args, err, cmdOut)
+			}
+			continue
+		}
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+			t.Errorf("%v: err = %v, want exit status 1", tt.args, err)
+		}
+		if !strings.Contains(string(cmdOut), "Assertion failed: "+tt.failure) {
+			t.Errorf("%v: output doesn't report %q:\n%s", tt.args, tt.failure, cmdOut)
+		}
+	}
+}
+
+func TestVariadicArguments(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/args\n\ngo 1.21\n",
+		"main.go": `package main
+
+func sum(base int, xs ...int) int { return base + len(xs) }
+
+func main() {
+	sum(1)
+	sum(1, 2, 3)
+	xs := []int{2, 3}
+	sum(1, xs...)
+}
+`,
+	})
+	m := findMapping(analyzeModule(t, dir, Options{}), "example.com/args.sum")
+	if m == nil {
+		t.Fatal("no mapping for sum")
+	}
+	type args struct {
+		count  int
+		spread bool
+	}
+	var got []args
+	for _, cs := range m.CallSites {
+		got = append(got, args{cs.ArgCount, cs.Spread})
+	}
+	want := []args{{1, false}, {3, false}, {2, true}}
+	if !slices.Equal(got, want) {
+		t.Errorf("call site arguments = %+v, want %+v", got, want)
+	}
+}
+
+func TestWithOffsets(t *testing.T) {
+	const src = `package main
+
+// helper does nothing.
+func helper() {}
+
+func main() {
+	x := 1
+	_ = x
+	helper()
+}
+`
+	dir := writeModule(t, map[string]string{"go.mod": "module example.com/off\n\ngo 1.21\n", "main.go": src})
+	result := analyzeModule(t, dir, Options{WithOffsets: true})
+	m := findMapping(result, "example.com/off.helper")
+	if m == nil || len(m.CallSites) != 1 {
+		t.Fatalf("mapping of helper = %+v", m)
+	}
+	if want := strings.Index(src, "func helper"); m.Definition.Offset != want {
+		t.Errorf("definition offset = %d, want %d", m.Definition.Offset, want)
+	}
+	if want := strings.Index(src, "helper()\n}"); m.CallSites[0].Offset != want {
+		t.Errorf("call site offset = %d, want %d", m.CallSites[0].Offset, want)
+	}
+
+	result = analyzeModule(t, dir, Options{})
+	if m := findMapping(result, "example.com/off.helper"); m.Definition.Offset != 0 || m.CallSites[0].Offset != 0 {
+		t.Errorf("offsets recorded without -with-offsets: %+v", m)
+	}
+}
+
+func TestWarnDeprecated(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/dep\n\ngo 1.21\n",
+		"main.go": `package main
+
+// Old does the work.
+//
+// Deprecated: use New instead.
+func Old() {}
+
+func New() {}
+
+func legacy() { Old() }
+
+func main() {
+	legacy()
+	New()
+}
+`,
+	})
+	result := analyzeModule(t, dir, Options{})
+	if def := result.Definitions["example.com/dep.Old"]; !def.Deprecated || def.DeprecationMessage != "use New instead." {
+		t.Errorf("Old = %+v, want it deprecated", def)
+	}
+
+	out := filepath.Join(t.TempDir(), "codemap.json")
+	cmdOut, err := runCommand(t, "-path", dir, "-out", out, "-warn-deprecated")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, cmdOut)
+	}
+	for _, want := range []string{
+		"Warning: example.com/dep.Old is deprecated: use New instead.",
+		"  called by example.com/dep.legacy at main.go:10",
+	} {
+		if !strings.Contains(string(cmdOut), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, cmdOut)
+		}
+	}
+	if strings.Contains(string(cmdOut), "example.com/dep.New is deprecated") {
+		t.Errorf("New reported as deprecated:\n%s", cmdOut)
+	}
+}
+
+// BenchmarkAnalyzeJobs analyzes a generated module of 2,000 files, parsing them one at a
+// time and on a pool of four workers.
+func BenchmarkAnalyzeJobs(b *testing.B) {
+	dir := b.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/bench\n\ngo 1.21\n"), 0644); err != nil {
+		b.Fatal(err)
+	}
+	for p := 0; p < 40; p++ {
+		pkgDir := filepath.Join(dir, fmt.Sprintf("pkg%d", p))
+		if err := os.Mkdir(pkgDir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for f := 0; f < 50; f++ {
+			var src strings.Builder
+			fmt.Fprintf(&src, "package pkg%d\n\n", p)
+			for fn := 0; fn < 10; fn++ {
+				fmt.Fprintf(&src, "func F%d_%d(n int) int {\n\tif n > 0 {\n\t\treturn F%d_%d(n - 1)\n\t}\n\treturn n\n}\n\n", f, fn, (f+1)%50, fn)
+			}
+			if err := os.WriteFile(filepath.Join(pkgDir, fmt.Sprintf("f%d.go", f)), []byte(src.String()), 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	for _, jobs := range []int{1, 4} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := Analyze(Options{TargetPath: dir, Jobs: jobs}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPackageLevelFuncLitCalls(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/lit\n\ngo 1.21\n",
+		"main.go": `package main
+
+func foo() {}
+
+func bar() {}
+
+var handler = func() { foo() }
+
+var _, hooks = 0, []func(){func() { bar() }, func() { foo() }}
+
+func main() {
+	handler()
+	func() { bar() }()
+}
+`,
+	})
+	result := analyzeModule(t, dir, Options{})
+	if got, want := callers(t, result, "example.com/lit.foo"), []string{"example.com/lit.handler$func1", "example.com/lit.hooks$func2"}; !slices.Equal(got, want) {
+		t.Errorf("callers of foo = %v, want %v", got, want)
+	}
+	// A literal inside a function is attributed to that function.
+	if got, want := callers(t, result, "example.com/lit.bar"), []string{"example.com/lit.hooks$func1", "example.com/lit.main"}; !slices.Equal(got, want) {
+		t.Errorf("callers of bar = %v, want %v", got, want)
+	}
+}
+
+func TestSelectorChains(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/chain\n\ngo 1.21\n",
+		"db/db.go": `package db
+
+type Conn struct{ Pool *Pool }
+
+func (c Conn) Connect() {}
+
+type Pool struct{}
+
+func (p *Pool) Close() {}
+
+var Default Conn
+`,
+		"main.go": `package main
+
+import (
+	"net/http"
+
+	"example.com/chain/db"
+)
+
+type config struct{ DB db.Conn }
+
+func main() {
+	var cfg config
+	db.Conn.Connect(cfg.DB)
+	cfg.DB.Connect()
+	db.Default.Pool.Close()
+	http.DefaultClient.Transport.RoundTrip(nil)
+}
+`,
+	})
+	result := analyzeModule(t, dir, Options{})
+	// Two levels rooted at an import: a method expression on the imported type.
+	if got := callers(t, result, "example.com/chain/db.Conn.Connect"); !slices.Equal(got, []string{"example.com/chain.main"}) {
+		t.Errorf("callers of db.Conn.Connect = %v, want only the method expression in main", got)
+	}
+	if m := findMapping(result, "example.com/chain/db.*Pool.Close"); m != nil {
+		t.Errorf("three-level chain resolved to %+v", m)
+	}
+	// cfg.DB.Connect() and db.Default.Pool.Close() are chained selectors; the http chain
+	// starts from the standard library.
+	byReason := result.Metadata.Resolution.ByReason
+	if byReason[unresolvedChained] != 2 || byReason[unresolvedStdlib] != 1 {
+		t.Errorf("unresolved by reason = %v, want 2 %s and 1 %s", byReason, unresolvedChained, unresolvedStdlib)
+	}
+}
+
+func TestIsEntryPoint(t *testing.T) {
+	tests := []struct {
+		name, file string
+		want       bool
+	}{
+		{"main", "main.go", true},
+		{"init", "setup.go", true},
+		{"TestAdd", "add_test.go", true},
+		{"Test_add", "add_test.go", true},
+		{"Test", "add_test.go", true},
+		{"Testable", "add_test.go", false},
+		{"BenchmarkSort", "sort_test.go", true},
+		{"Benchmarker", "sort_test.go", false},
+		{"ExampleStore_Get", "store_test.go", true},
+		{"Examples", "store_test.go", false},
+		{"FuzzParse", "parse_test.go", true},
+		{"Fuzzy", "parse_test.go", false},
+		{"TestAdd", "add.go", false},
+	}
+	for _, tt := range tests {
+		def := Definition{Name: tt.name, FilePath: tt.file, Kind: "function"}
+		if got := isEntryPoint(def); got != tt.want {
+			t.Errorf("isEntryPoint(%s in %s) = %v, want %v", tt.name, tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestValueReferencesSkipLocalsAndKeys(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/vars\n\ngo 1.21\n",
+		"main.go": `package main
+
+const Limit = 10
+
+var Name = "x"
+
+type config struct {
+	Limit int
+	Name  string
+}
+
+func use(any) {}
+
+func shadow() {
+	Limit := 3
+	use(Limit)
+}
+
+func param(Name string) { use(Name) }
+
+func literal() config { return config{Limit: Limit, Name: "n"} }
+
+func main() {
+	use(Limit)
+	use(Name)
+}
+`,
+		"other.go": "package main\n\nfunc other() { use(Limit) }\n",
+	})
+	for _, typeCheck := range []bool{false, true} {
+		result := analyzeModule(t, dir, Options{TrackVars: true, TypeCheck: typeCheck})
+		refs := make(map[string][]string)
+		for _, m := range valueReport(result) {
+			for _, cs := range m.CallSites {
+				refs[m.Definition.ID] = append(refs[m.Definition.ID], cs.CallerID)
+			}
+		}
+		want := map[string][]string{
+			"example.com/vars.Limit": {"example.com/vars.literal", "example.com/vars.main", "example.com/vars.other"},
+			"example.com/vars.Name":  {"example.com/vars.main"},
+		}
+		if !reflect.DeepEqual(refs, want) {
+			t.Errorf("types %v: references = %v, want %v", typeCheck, refs, want)
+		}
+	}
+}
+
+func TestStdinSourcesRemovedOnFatalExit(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for name, content := range map[string]string{
+		"go.mod":  "module example.com/stdin\n\ngo 1.21\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := t.TempDir()
+	// -focus and -impact-base are rejected after the sources were extracted.
+	cmd := exec.Command(os.Args[0], "-test.run=^$", "--", "-path", "-", "-focus", "example.com/stdin", "-impact-base", "HEAD")
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", "TMPDIR="+tmp)
+	cmd.Stdin = &archive
+	out, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("err = %v, want exit status 1\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Extracted the sources") {
+		t.Fatalf("exited before extracting the sources:\n%s", out)
+	}
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s left behind in the temporary directory", e.Name())
+	}
+}
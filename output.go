@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Result is everything an analysis run produced. It is handed to an OutputWriter to be
+// serialized in the format chosen with -format.
+type Result struct {
+	Mappings    []Mapping             // Definitions with at least one call site
+	Definitions map[string]Definition // Every definition found, keyed by ID
+	Types       []TypeDef
+	Imports     map[string]map[string]bool // Import paths used by each analyzed package
+	Metadata    Metadata
+	Options     *Options
+	Timings     []PhaseTiming // How long the phases of Analyze took, in order
+
+	// passes is the state of the run that produced the result, which /api/analyze runs the
+	// passes with; nil for a result that wasn't produced by Analyze.
+	passes *passState
+	// index is the complete call site index: every definition with all its call sites,
+	// whatever -focus or -impact-base leave in Mappings. The reports are computed from it.
+	index map[string]*Mapping
+	// values holds the constants and variables of -track-vars with their references.
+	values map[string]*Mapping
+	// unresolved holds the calls left out of the map, recorded with -unresolved.
+	unresolved []UnresolvedCall
+}
+
+// OutputWriter serializes a Result in one output format.
+type OutputWriter interface {
+	Write(w io.Writer, result *Result) error
+}
+
+// OutputWriterFunc adapts an ordinary function to the OutputWriter interface.
+type OutputWriterFunc func(w io.Writer, result *Result) error
+
+// Write calls f(w, result).
+func (f OutputWriterFunc) Write(w io.Writer, result *Result) error {
+	return f(w, result)
+}
+
+// DescribedOutputWriter is optionally implemented by an OutputWriter to tell the server how
+// to label what it produces when the format is downloaded from /api/export.
+type DescribedOutputWriter interface {
+	OutputWriter
+	ContentType() string   // e.g. "text/vnd.graphviz"
+	FileExtension() string // e.g. ".dot"
+}
+
+// formatWriter is an OutputWriter with a fixed content type and file extension.
+type formatWriter struct {
+	write       func(w io.Writer, result *Result) error
+	contentType string
+	extension   string
+}
+
+func (f formatWriter) Write(w io.Writer, result *Result) error { return f.write(w, result) }
+func (f formatWriter) ContentType() string                     { return f.contentType }
+func (f formatWriter) FileExtension() string                   { return f.extension }
+
+// outputWriters is the registry of formats selectable with -format.
+var outputWriters = make(map[string]OutputWriter)
+
+func init() {
+	RegisterOutputWriter("json", formatWriter{writeJSONMappings, "application/json", ".json"})
+	RegisterOutputWriter("jsonl", formatWriter{writeJSONLines, "application/jsonl", ".jsonl"})
+	RegisterOutputWriter("json-v2", formatWriter{writeJSONv2, "application/json", ".json"})
+	RegisterOutputWriter("graph", formatWriter{writeJSONGraph, "application/json", ".json"})
+	RegisterOutputWriter("reverse", formatWriter{writeJSONReverse, "application/json", ".json"})
+	RegisterOutputWriter("imports", formatWriter{writeJSONImports, "application/json", ".json"})
+	RegisterOutputWriter("fileindex", formatWriter{writeJSONFileIndex, "application/json", ".json"})
+	RegisterOutputWriter("dot", formatWriter{writeDOT, "text/vnd.graphviz", ".dot"})
+	RegisterOutputWriter("mermaid", formatWriter{writeMermaid, "text/vnd.mermaid", ".mmd"})
+	RegisterOutputWriter("csv", formatWriter{writeCSV, "text/csv", ".csv"})
+	RegisterOutputWriter("package-matrix", formatWriter{writePackageMatrix, "text/csv", ".csv"})
+}
+
+// RegisterOutputWriter makes an output format available under name. Custom formats can be
+// added by registering them from an init function. Registering the same name twice panics.
+func RegisterOutputWriter(name string, w OutputWriter) {
+	if _, exists := outputWriters[name]; exists {
+		panic(fmt.Sprintf("output writer %q registered twice", name))
+	}
+	outputWriters[name] = w
+}
+
+// lookupOutputWriter returns the writer registered for a format name.
+func lookupOutputWriter(name string) (OutputWriter, error) {
+	w, ok := outputWriters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format %q (available: %v)", name, outputFormatNames())
+	}
+	return w, nil
+}
+
+// outputFormatNames lists the registered format names in sorted order.
+func outputFormatNames() []string {
+	names := make([]string, 0, len(outputWriters))
+	for name := range outputWriters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// outputMediaType returns the content type and file extension for a registered writer,
+// defaulting to a generic binary download for writers that don't describe themselves.
+func outputMediaType(w OutputWriter) (contentType, extension string) {
+	if described, ok := w.(DescribedOutputWriter); ok {
+		return described.ContentType(), described.FileExtension()
+	}
+	return "application/octet-stream", ""
+}
+
+// writeOutputFile serializes result into path using the writer registered for format. The
+// output goes to a temporary file in the same directory that is then renamed over path, so
+// the visualizer serving path during a -watch rebuild reads either the old or the new file,
+// never a truncated one.
+func writeOutputFile(path, format string, result *Result) error {
+	writer, err := lookupOutputWriter(format)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not create %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once the file was renamed.
+	buf := bufio.NewWriter(tmp)
+	if err := writer.Write(buf, result); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write %s output: %w", format, err)
+	}
+	if err := buf.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	// CreateTemp makes the file private; the output is as readable as os.Create made it.
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeJSONMappings writes the array of mappings, the format the visualizer reads.
+func writeJSONMappings(w io.Writer, result *Result) error {
+	return streamJSONArray(w, result.Mappings, jsonIndent)
+}
+
+// CodemapV2 is the document of the json-v2 format: the mappings of the json format and the
+// declared types as separate top-level arrays, so the types of the code are listed even
+// when no method of theirs is called.
+type CodemapV2 struct {
+	Version  int       `json:"version"` // Always 2
+	Mappings []Mapping `json:"mappings"`
+	Types    []TypeDef `json:"types"`
+}
+
+// writeJSONv2 writes the mappings and the types as a CodemapV2 document.
+func writeJSONv2(w io.Writer, result *Result) error {
+	doc := CodemapV2{Version: 2, Mappings: result.Mappings, Types: result.Types}
+	if doc.Mappings == nil {
+		doc.Mappings = []Mapping{}
+	}
+	if doc.Types == nil {
+		doc.Types = []TypeDef{}
+	}
+	return writeIndentedJSON(w, doc)
+}
+
+// writeJSONLines writes one mapping per line, unindented, so a consumer such as jq can
+// process each record as it arrives rather than parse the whole array.
+func writeJSONLines(w io.Writer, result *Result) error {
+	enc := json.NewEncoder(w)
+	for i := range result.Mappings {
+		if err := enc.Encode(result.Mappings[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resultGraph builds the node/edge graph of the result for the graph-shaped formats,
+// limited to what is reachable from -root when it is set.
+func resultGraph(result *Result) *Graph {
+	g := buildGraph(result)
+	if result.Options != nil && result.Options.Root != "" {
+		g = reachableSubgraph(g, result.Options.Root)
+	}
+	return g
+}
+
+// writeJSONGraph writes the deduplicated node/edge graph, laid out when -layout is set.
+func writeJSONGraph(w io.Writer, result *Result) error {
+	graph := resultGraph(result)
+	if result.Options != nil && result.Options.Layout {
+		layoutGraph(graph, result.Options.LayoutSeed)
+	}
+	return writeIndentedJSON(w, graph)
+}
+
+// ReverseEntry is one record of the "reverse" format: a definition and everything that calls it.
+type ReverseEntry struct {
+	Definition Definition      `json:"definition"`
+	Callers    []ReverseCaller `json:"callers"`
+}
+
+// ReverseCaller is a caller -> callee edge seen from the callee.
+type ReverseCaller struct {
+	CallerID string `json:"callerId"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// writeJSONReverse writes the callee -> callers edge list, sorted by definition ID, for impact
+// analysis tools that start from a changed function and look for its dependents.
+func writeJSONReverse(w io.Writer, result *Result) error {
+	entries := make([]ReverseEntry, 0, len(result.Mappings))
+	for _, m := range result.Mappings {
+		entry := ReverseEntry{Definition: m.Definition, Callers: make([]ReverseCaller, 0, len(m.CallSites))}
+		for _, cs := range m.CallSites {
+			entry.Callers = append(entry.Callers, ReverseCaller{CallerID: cs.CallerID, File: cs.FilePath, Line: cs.Line})
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Definition.ID < entries[j].Definition.ID })
+	return writeIndentedJSON(w, entries)
+}
+
+// Kinds of an import in the "imports" format.
+const (
+	importAnalyzed = "analyzed" // a package that was part of the analysis
+	importStdlib   = "stdlib"
+	importExternal = "external" // any other package, e.g. a dependency not selected with -analyze-deps
+)
+
+// ImportEntry is one record of the "imports" format: a package and the packages it imports.
+type ImportEntry struct {
+	Package string       `json:"package"`
+	Imports []ImportEdge `json:"imports"`
+}
+
+// ImportEdge is a single import of a package.
+type ImportEdge struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"` // analyzed, stdlib or external
+}
+
+// writeJSONImports writes the package import graph, sorted by package and import path.
+func writeJSONImports(w io.Writer, result *Result) error {
+	entries := make([]ImportEntry, 0, len(result.Imports))
+	for pkg, imports := range result.Imports {
+		entry := ImportEntry{Package: pkg, Imports: make([]ImportEdge, 0, len(imports))}
+		for importPath := range imports {
+			kind := importExternal
+			if _, ok := result.Imports[importPath]; ok {
+				kind = importAnalyzed
+			} else if isStdlibPath(importPath) {
+				kind = importStdlib
+			}
+			entry.Imports = append(entry.Imports, ImportEdge{Path: importPath, Kind: kind})
+		}
+		sort.Slice(entry.Imports, func(i, j int) bool { return entry.Imports[i].Path < entry.Imports[j].Path })
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Package < entries[j].Package })
+	return writeIndentedJSON(w, entries)
+}
+
+// FileEntry is one record of the "fileindex" format: what a file declares and the calls it makes.
+type FileEntry struct {
+	Definitions []Definition `json:"definitions"` // Sorted by line
+	CallSites   []CallSite   `json:"callSites"`   // Calls located in the file, sorted by line
+}
+
+// buildFileIndex groups the definitions and call sites of the result by the slash-separated
+// file path they were found in, relative to their target root.
+func buildFileIndex(result *Result) map[string]*FileEntry {
+	index := make(map[string]*FileEntry)
+	entry := func(filePath string) *FileEntry {
+		e, ok := index[filePath]
+		if !ok {
+			e = &FileEntry{Definitions: []Definition{}, CallSites: []CallSite{}}
+			index[filePath] = e
+		}
+		return e
+	}
+	for _, def := range result.Definitions {
+		e := entry(def.FilePath)
+		e.Definitions = append(e.Definitions, def)
+	}
+	for _, m := range result.Mappings {
+		for _, cs := range m.CallSites {
+			e := entry(cs.FilePath)
+			e.CallSites = append(e.CallSites, cs)
+		}
+	}
+	for _, e := range index {
+		sort.Slice(e.Definitions, func(i, j int) bool {
+			if e.Definitions[i].Line != e.Definitions[j].Line {
+				return e.Definitions[i].Line < e.Definitions[j].Line
+			}
+			return e.Definitions[i].ID < e.Definitions[j].ID
+		})
+		sort.Slice(e.CallSites, func(i, j int) bool {
+			if e.CallSites[i].Line != e.CallSites[j].Line {
+				return e.CallSites[i].Line < e.CallSites[j].Line
+			}
+			return e.CallSites[i].CalleeID < e.CallSites[j].CalleeID
+		})
+	}
+	return index
+}
+
+// writeJSONFileIndex writes the file -> definitions and call sites index as an object keyed
+// by file path, for file outlines that shouldn't scan the whole map.
+func writeJSONFileIndex(w io.Writer, result *Result) error {
+	return writeIndentedJSON(w, buildFileIndex(result))
+}
+
+// writeDOT writes the call graph as a Graphviz digraph with one cluster per package, for
+// rendering with e.g. `dot -Tsvg`. Nodes are labelled with their name and the last element
+// of their package; edges other than calls are dashed.
+func writeDOT(w io.Writer, result *Result) error {
+	g := resultGraph(result)
+	byPackage := make(map[string][]GraphNode)
+	var packages []string
+	for _, node := range g.Nodes {
+		if _, seen := byPackage[node.Package]; !seen {
+			packages = append(packages, node.Package)
+		}
+		byPackage[node.Package] = append(byPackage[node.Package], node)
+	}
+	sort.Strings(packages)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph codemap {")
+	fmt.Fprintln(bw, "  rankdir=LR;")
+	fmt.Fprintln(bw, "  node [shape=box];")
+	for i, pkg := range packages {
+		fmt.Fprintf(bw, "  subgraph cluster_%d {\n    label=%s;\n", i, dotQuote(pkg))
+		for _, node := range byPackage[pkg] {
+			label := node.Name
+			if node.Package != "" {
+				label = path.Base(node.Package) + "." + node.Name
+			}
+			fmt.Fprintf(bw, "    %s [label=%s];\n", dotQuote(node.ID), dotQuote(label))
+		}
+		fmt.Fprintln(bw, "  }")
+	}
+	for _, e := range g.Edges {
+		attrs := ""
+		switch {
+		case e.Kind != edgeCalls:
+			attrs = fmt.Sprintf(" [style=dashed, label=%s]", dotQuote(e.Kind))
+		case e.Count > 1:
+			attrs = fmt.Sprintf(" [label=\"%d\"]", e.Count)
+		}
+		fmt.Fprintf(bw, "  %s -> %s%s;\n", dotQuote(e.Source), dotQuote(e.Target), attrs)
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// writeMermaid writes the call graph as a Mermaid `flowchart LR` for embedding in Markdown.
+// Mermaid can't use IDs with dots and slashes as node names, so nodes are named n0, n1, ...
+// in ID order and labelled with their short package and name.
+func writeMermaid(w io.Writer, result *Result) error {
+	g := resultGraph(result)
+	aliases := make(map[string]string, len(g.Nodes))
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "flowchart LR")
+	for i, node := range g.Nodes {
+		aliases[node.ID] = fmt.Sprintf("n%d", i)
+		label := node.Name
+		if node.Package != "" {
+			label = path.Base(node.Package) + "." + node.Name
+		}
+		fmt.Fprintf(bw, "    %s[\"%s\"]\n", aliases[node.ID], strings.ReplaceAll(label, `"`, "#quot;"))
+	}
+	for _, e := range g.Edges {
+		arrow := "-->"
+		if e.Kind != edgeCalls {
+			arrow = "-. " + e.Kind + " .->"
+		}
+		fmt.Fprintf(bw, "    %s %s %s\n", aliases[e.Source], arrow, aliases[e.Target])
+	}
+	return bw.Flush()
+}
+
+// csvHeader is the header row of the "csv" format.
+var csvHeader = []string{"caller_id", "caller_name", "caller_package", "callee_id", "callee_name", "callee_package", "call_file", "call_line"}
+
+// writeCSV writes one row per call site, for spreadsheets and BI tools. Callers that aren't
+// definitions, such as package-level function literals, have an empty name and package.
+func writeCSV(w io.Writer, result *Result) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, m := range result.Mappings {
+		callee := m.Definition
+		for _, cs := range m.CallSites {
+			caller := result.Definitions[cs.CallerID]
+			row := []string{cs.CallerID, caller.Name, caller.Package, callee.ID, callee.Name, callee.Package, cs.FilePath, strconv.Itoa(cs.Line)}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writePackageMatrix writes the package coupling matrix as CSV: one row and one column per
+// package, sorted, with the number of call sites from the row's package to the column's
+// package in each cell. The diagonal counts the calls within a package.
+func writePackageMatrix(w io.Writer, result *Result) error {
+	known := make(map[string]bool)
+	for _, def := range result.Definitions {
+		known[def.Package] = true
+	}
+	counts := make(map[[2]string]int)
+	packages := make(map[string]bool)
+	for _, m := range result.Mappings {
+		callee := m.Definition.Package
+		for _, cs := range m.CallSites {
+			caller := packageOfID(cs.CallerID, result.Definitions, known)
+			counts[[2]string{caller, callee}]++
+			packages[caller], packages[callee] = true, true
+		}
+	}
+	names := make([]string, 0, len(packages))
+	for pkg := range packages {
+		names = append(names, pkg)
+	}
+	sort.Strings(names)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{"caller\\callee"}, names...)); err != nil {
+		return err
+	}
+	for _, from := range names {
+		row := []string{from}
+		for _, to := range names {
+			row = append(row, strconv.Itoa(counts[[2]string{from, to}]))
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// packageOfID returns the import path of the package a definition ID belongs to. IDs that
+// aren't definitions, such as pkg.handler$func1, are matched against the known packages,
+// longest first, since import paths may contain dots themselves (gopkg.in/yaml.v3.Marshal).
+// As a last resort the package ends at the first dot after the last slash.
+func packageOfID(id string, defs map[string]Definition, known map[string]bool) string {
+	if def, ok := defs[id]; ok {
+		return def.Package
+	}
+	best := ""
+	for pkg := range known {
+		if len(pkg) > len(best) && strings.HasPrefix(id, pkg+".") {
+			best = pkg
+		}
+	}
+	if best != "" {
+		return best
+	}
+	slash := strings.LastIndex(id, "/")
+	if dot := strings.Index(id[slash+1:], "."); dot >= 0 {
+		return id[:slash+1+dot]
+	}
+	return id
+}
+
+// dotQuote returns s as a DOT double-quoted string. IDs contain dots and slashes, so they
+// always need quoting.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// jsonIndent is the indentation used by all JSON outputs.
+const jsonIndent = "  "
+
+// writeIndentedJSON writes v with the indentation used by all JSON outputs.
+func writeIndentedJSON(w io.Writer, v any) error {
+	data, err := json.MarshalIndent(v, "", jsonIndent)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// streamJSONArray writes items as an indented JSON array one element at a time, so only a
+// single element is held in memory in encoded form. The output is the same as
+// json.MarshalIndent(items, "", indent) would produce, which maps the multi-hundred-MB
+// outputs of big codebases without buffering them whole.
+func streamJSONArray[T any](w io.Writer, items []T, indent string) error {
+	if items == nil {
+		_, err := io.WriteString(w, "null")
+		return err
+	}
+	if len(items) == 0 {
+		_, err := io.WriteString(w, "[]")
+		return err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent(indent, indent)
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i := range items {
+		buf.Reset()
+		if err := enc.Encode(items[i]); err != nil {
+			return err
+		}
+		sep := ",\n" + indent
+		if i == 0 {
+			sep = "\n" + indent
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		// Encode ends every value with a newline, which the array's separators replace.
+		if _, err := w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n]")
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func init() {
+	// Registered in the child process of runCommand only, so the other tests see the
+	// built-in formats alone.
+	if os.Getenv(runMainEnv) != "" {
+		RegisterOutputWriter("test-count", OutputWriterFunc(func(w io.Writer, result *Result) error {
+			_, err := fmt.Fprintf(w, "%d mappings\n", len(result.Mappings))
+			return err
+		}))
+	}
+}
+
+func TestCustomOutputFormat(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":  "module example.com/format\n\ngo 1.23.0\n",
+		"main.go": "package main\n\nfunc a() {}\n\nfunc b() { a() }\n\nfunc main() { b() }\n",
+	})
+	out := filepath.Join(t.TempDir(), "out.txt")
+	if output, err := runCommand(t, "-path", dir, "-no-cache", "-format", "test-count", "-out", out); err != nil {
+		t.Fatalf("codemapper failed: %v\n%s", err, output)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "2 mappings\n" {
+		t.Errorf("got %q, want %q", data, "2 mappings\n")
+	}
+	if _, err := lookupOutputWriter("test-count"); err == nil {
+		t.Error("the test format leaked into the test process")
+	}
+}
+
+func TestJSONv2Format(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/v2\n\ngo 1.23.0\n",
+		"main.go": `package main
+
+type Shape interface{ Area() float64 }
+
+type Square struct{ side float64 }
+
+type Meters = float64
+
+func area(s Shape) float64 { return s.Area() }
+
+func main() { area(nil) }
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := Analyze(Options{TargetPath: dir})
+	if err != nil {
+		t.Fatalf("Analyze: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := writeJSONv2(&buf, result); err != nil {
+		t.Fatal(err)
+	}
+	var doc CodemapV2
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Version != 2 || len(doc.Mappings) != 1 || doc.Mappings[0].Definition.ID != "example.com/v2.area" {
+		t.Errorf("got version %d with mappings %+v, want 2 with area alone", doc.Version, doc.Mappings)
+	}
+	kinds := make(map[string]string)
+	for _, td := range doc.Types {
+		kinds[td.Name] = td.Kind
+	}
+	want := map[string]string{"Shape": "interface", "Square": "struct", "Meters": "alias"}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got types %v, want %v", kinds, want)
+	}
+	if doc.Types[0].Name != "Meters" || doc.Types[1].Name != "Shape" || len(doc.Types[1].Methods) != 1 {
+		t.Errorf("types aren't sorted by ID or Shape lost its methods: %+v", doc.Types)
+	}
+}
+
+func TestCSVEscaping(t *testing.T) {
+	caller := Definition{ID: `example.com/p.F,"x"`, Name: "F,\"x\"", Package: "example.com/p"}
+	callee := Definition{ID: "example.com/p.G", Name: "G", Package: "example.com/p"}
+	result := &Result{
+		Mappings: []Mapping{{Definition: callee, CallSites: []CallSite{
+			{FilePath: "dir, with comma/\"quoted\"\nname.go", Line: 3, CallerID: caller.ID, CalleeID: callee.ID},
+		}}},
+		Definitions: map[string]Definition{caller.ID: caller, callee.ID: callee},
+	}
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, result); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("reading the CSV back: %v\n%s", err, buf.String())
+	}
+	want := [][]string{
+		csvHeader,
+		{caller.ID, caller.Name, caller.Package, callee.ID, callee.Name, callee.Package, "dir, with comma/\"quoted\"\nname.go", "3"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows read back:\n%q\nwant:\n%q", rows, want)
+	}
+}
+
+func TestReverseFormatEdges(t *testing.T) {
+	result := analyzeModule(t, writeModule(t, orderFixture()), Options{})
+	type edge struct {
+		caller, callee, file string
+		line                 int
+	}
+	var forward, reverse bytes.Buffer
+	if err := writeJSONMappings(&forward, result); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSONReverse(&reverse, result); err != nil {
+		t.Fatal(err)
+	}
+	var mappings []Mapping
+	var entries []ReverseEntry
+	if err := json.Unmarshal(forward.Bytes(), &mappings); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(reverse.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	forwardEdges := make(map[edge]int)
+	for _, m := range mappings {
+		for _, cs := range m.CallSites {
+			forwardEdges[edge{cs.CallerID, m.Definition.ID, cs.FilePath, cs.Line}]++
+		}
+	}
+	reverseEdges := make(map[edge]int)
+	for _, e := range entries {
+		for _, c := range e.Callers {
+			reverseEdges[edge{c.CallerID, e.Definition.ID, c.File, c.Line}]++
+		}
+	}
+	if len(forwardEdges) == 0 || !reflect.DeepEqual(forwardEdges, reverseEdges) {
+		t.Errorf("reverse edges differ from the forward ones:\nforward: %v\nreverse: %v", forwardEdges, reverseEdges)
+	}
+}
+
+func TestImportsFormat(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":      "module example.com/imp\n\ngo 1.21\n\nrequire github.com/ext/lib v1.0.0\n",
+		"store/db.go": "package store\n\nimport \"strings\"\n\nfunc Get(k string) string { return strings.ToLower(k) }\n",
+		"api/api.go":  "package api\n\nimport (\n\t\"github.com/ext/lib\"\n\n\t\"example.com/imp/store\"\n)\n\nfunc Handle() { store.Get(lib.Name) }\n",
+		"main.go":     "package main\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/imp/api\"\n)\n\nfunc main() { api.Handle(); fmt.Println() }\n",
+	})
+	var buf bytes.Buffer
+	if err := writeJSONImports(&buf, analyzeModule(t, dir, Options{})); err != nil {
+		t.Fatal(err)
+	}
+	var entries []ImportEntry
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	want := []ImportEntry{
+		{Package: "example.com/imp", Imports: []ImportEdge{{"example.com/imp/api", importAnalyzed}, {"fmt", importStdlib}}},
+		{Package: "example.com/imp/api", Imports: []ImportEdge{{"example.com/imp/store", importAnalyzed}, {"github.com/ext/lib", importExternal}}},
+		{Package: "example.com/imp/store", Imports: []ImportEdge{{"strings", importStdlib}}},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("imports = %+v, want %+v", entries, want)
+	}
+}
+
+func TestStreamedJSONMatchesMarshalIndent(t *testing.T) {
+	result := analyzeModule(t, writeModule(t, orderFixture()), Options{})
+	if len(result.Mappings) < 2 {
+		t.Fatalf("fixture has %d mappings, want several", len(result.Mappings))
+	}
+	tests := map[string][]Mapping{
+		"fixture": result.Mappings,
+		"empty":   {},
+		"nil":     nil,
+		// Encoder and MarshalIndent must agree on escaping too.
+		"escaped": {{Definition: Definition{ID: "a.<b>&c", Doc: "line\n\"quoted\"  "}}},
+	}
+	for name, mappings := range tests {
+		var streamed bytes.Buffer
+		if err := streamJSONArray(&streamed, mappings, jsonIndent); err != nil {
+			t.Fatal(err)
+		}
+		want, err := json.MarshalIndent(mappings, "", jsonIndent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(streamed.Bytes(), want) {
+			t.Errorf("%s: streamed output differs from MarshalIndent:\n%s\nwant:\n%s", name, streamed.Bytes(), want)
+		}
+	}
+}
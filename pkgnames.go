@@ -0,0 +1,94 @@
+package main
+
+import (
+	"go/build"
+	"log"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// packageNameResolver finds the name declared in the package clause of imported packages,
+// for -resolve-pkg-names. Import paths whose last element isn't the package name, such as
+// gopkg.in/yaml.v3 (package yaml), are otherwise keyed by that element in the import map.
+// Every path is looked up once per run.
+type packageNameResolver struct {
+	targets []AnalysisTarget
+	ctx     *build.Context    // The -build-tags context, nil for build.Default
+	mu      sync.Mutex        // Guards names, which concurrent /api/analyze requests fill
+	names   map[string]string // By import path; "" when the name couldn't be found
+}
+
+// packageNames is the resolver of the current run, set by Analyze when -resolve-pkg-names
+// is on.
+var packageNames *packageNameResolver
+
+func newPackageNameResolver(targets []AnalysisTarget, ctx *build.Context) *packageNameResolver {
+	return &packageNameResolver{targets: targets, ctx: ctx, names: make(map[string]string)}
+}
+
+// importName returns the name a file refers to importPath by when it doesn't rename the
+// import: the declared package name with -resolve-pkg-names (when r isn't nil), if it can be
+// found, and the last element of the path otherwise.
+func (r *packageNameResolver) importName(importPath string) string {
+	if r != nil {
+		if name := r.lookup(importPath); name != "" {
+			return name
+		}
+	}
+	return path.Base(importPath)
+}
+
+// lookup returns the package name of importPath, or "" if it can't be found. Packages of the
+// analyzed targets and of the standard library are read from their sources; the others are
+// asked to `go list`, run from the main module so its build list picks the version.
+func (r *packageNameResolver) lookup(importPath string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name, ok := r.names[importPath]; ok {
+		return name
+	}
+	name := r.analyzedPackageName(importPath)
+	if name == "" && isStdlibPath(importPath) {
+		if pkg, err := r.buildContext().Import(importPath, "", 0); err == nil {
+			name = pkg.Name
+		}
+	}
+	if name == "" && len(r.targets) > 0 && !isStdlibPath(importPath) {
+		cmd := exec.Command("go", "list", "-e", "-f", "{{.Name}}", importPath)
+		cmd.Dir = r.targets[0].FSRoot
+		if out, err := cmd.Output(); err == nil {
+			name = strings.TrimSpace(string(out))
+		}
+	}
+	if name == "" {
+		log.Printf("Warning: could not find the package name of %s, using %s", importPath, path.Base(importPath))
+	}
+	r.names[importPath] = name
+	return name
+}
+
+// analyzedPackageName reads the package clause of importPath's files when it belongs to one
+// of the analyzed targets.
+func (r *packageNameResolver) analyzedPackageName(importPath string) string {
+	for _, target := range r.targets {
+		rel, ok := strings.CutPrefix(importPath, target.ModulePath)
+		if !ok || (rel != "" && !strings.HasPrefix(rel, "/")) || (target.SinglePackage && rel != "") {
+			continue
+		}
+		dir := filepath.Join(target.FSRoot, filepath.FromSlash(strings.TrimPrefix(rel, "/")))
+		if pkg, err := r.buildContext().ImportDir(dir, 0); err == nil {
+			return pkg.Name
+		}
+	}
+	return ""
+}
+
+func (r *packageNameResolver) buildContext() *build.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return &build.Default
+}
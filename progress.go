@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of ProgressEvent.
+const (
+	progressPhase  = "phase"    // a new phase started
+	progressFile   = "progress" // one more file was processed in the current phase
+	progressDone   = "done"     // the analysis finished and its output was written
+	progressReload = "reload"   // -watch analyzed again and rewrote the output
+)
+
+// ProgressEvent is a snapshot of a running analysis, streamed to the browser by /api/events.
+type ProgressEvent struct {
+	Type        string `json:"type"`
+	Phase       string `json:"phase"`            // e.g. "definitions", "call sites"
+	Target      string `json:"target,omitempty"` // Module path of the target being scanned
+	FilesParsed int    `json:"filesParsed"`      // Files processed in the current phase so far
+}
+
+// progressHub fans progress events out to subscribers. Slow subscribers miss intermediate
+// events rather than holding up the analysis, and every new subscriber is first sent the
+// latest event so it can show the current state straight away.
+type progressHub struct {
+	mu          sync.Mutex
+	subscribers map[chan ProgressEvent]bool
+	current     ProgressEvent
+	started     bool
+}
+
+// progress reports the analysis of this process.
+var progress = newProgressHub()
+
+func newProgressHub() *progressHub {
+	return &progressHub{subscribers: make(map[chan ProgressEvent]bool)}
+}
+
+// StartPhase begins a new phase and resets the file count.
+func (h *progressHub) StartPhase(phase string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.current = ProgressEvent{Type: progressPhase, Phase: phase}
+	h.publish()
+}
+
+// FileDone records that one more file of target was processed in the current phase.
+func (h *progressHub) FileDone(target string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.current.Type = progressFile
+	h.current.Target = target
+	h.current.FilesParsed++
+	h.publish()
+}
+
+// Done marks the analysis as complete.
+func (h *progressHub) Done() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.current = ProgressEvent{Type: progressDone, Phase: h.current.Phase, FilesParsed: h.current.FilesParsed}
+	h.publish()
+}
+
+// Reload tells subscribers that the output was rewritten, so they can fetch it again. The
+// event isn't replayed to later subscribers, which load the latest output anyway.
+func (h *progressHub) Reload() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ev := ProgressEvent{Type: progressReload, Phase: h.current.Phase, FilesParsed: h.current.FilesParsed}
+	for ch := range h.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			// A full buffer only holds stale progress; make room so the reload isn't lost.
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- ev:
+			default:
+			}
+		}
+	}
+}
+
+// publish sends the current event to every subscriber. h.mu must be held.
+func (h *progressHub) publish() {
+	h.started = true
+	h.send(h.current)
+}
+
+// send hands ev to every subscriber that has room for it. h.mu must be held.
+func (h *progressHub) send(ev ProgressEvent) {
+	for ch := range h.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of progress events, starting with the latest one if any, and
+// a function that must be called to stop receiving them.
+func (h *progressHub) Subscribe() (<-chan ProgressEvent, func()) {
+	ch := make(chan ProgressEvent, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.started {
+		ch <- h.current
+	}
+	h.subscribers[ch] = true
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers, ch)
+	}
+}
+
+// slowFileThreshold is how long one file may take in a pass before it is logged as slow.
+const slowFileThreshold = time.Second
+
+// PhaseTiming is how long one phase of a run took.
+type PhaseTiming struct {
+	Phase    string
+	Duration time.Duration
+}
+
+// phaseTimer times consecutive phases: each phase lasts from the end of the previous one.
+type phaseTimer struct {
+	timings []PhaseTiming
+	start   time.Time
+}
+
+func newPhaseTimer() *phaseTimer {
+	return &phaseTimer{start: time.Now()}
+}
+
+// done ends the current phase, logs how long it took and starts the next one.
+func (t *phaseTimer) done(phase string) {
+	now := time.Now()
+	timing := PhaseTiming{Phase: phase, Duration: now.Sub(t.start)}
+	t.timings = append(t.timings, timing)
+	t.start = now
+	log.Printf("Timing: %s took %s", phase, timing.Duration.Round(time.Millisecond))
+}
+
+// formatTimings renders timings as one line of phase=duration pairs followed by their total.
+func formatTimings(timings []PhaseTiming) string {
+	var b strings.Builder
+	var total time.Duration
+	for _, timing := range timings {
+		fmt.Fprintf(&b, "%s=%s ", timing.Phase, timing.Duration.Round(time.Millisecond))
+		total += timing.Duration
+	}
+	fmt.Fprintf(&b, "total=%s", total.Round(time.Millisecond))
+	return b.String()
+}
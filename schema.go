@@ -0,0 +1,160 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// codemapSchema is the JSON Schema of the json output format. It is embedded so -validate
+// always checks against the schema of the binary that wrote the file.
+//
+//go:embed codemap.schema.json
+var codemapSchema []byte
+
+// maxReportedViolations caps the violations -validate logs one by one.
+const maxReportedViolations = 50
+
+// jsonSchema is the subset of JSON Schema codemap.schema.json uses: types, enums, minimums,
+// object properties and array items, and references to its own $defs.
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Defs                 map[string]*jsonSchema `json:"$defs"`
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+}
+
+// schemaTypes is the "type" keyword, a single type name or a list of them.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = schemaTypes{name}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+// schemaValidator checks documents against a schema, resolving references from its root.
+type schemaValidator struct {
+	root       *jsonSchema
+	violations []string
+}
+
+// validateCodemap checks the JSON document in data against the embedded schema and returns
+// one message per violation, each prefixed with the path of the offending value.
+func validateCodemap(data []byte) ([]string, error) {
+	var root jsonSchema
+	if err := json.Unmarshal(codemapSchema, &root); err != nil {
+		return nil, fmt.Errorf("invalid embedded schema: %w", err)
+	}
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("not valid JSON: %w", err)
+	}
+	v := &schemaValidator{root: &root}
+	v.validate(doc, &root, "$")
+	return v.violations, nil
+}
+
+func (v *schemaValidator) fail(at, format string, args ...any) {
+	v.violations = append(v.violations, at+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *schemaValidator) validate(value any, s *jsonSchema, at string) {
+	if s.Ref != "" {
+		name, ok := strings.CutPrefix(s.Ref, "#/$defs/")
+		if ref := v.root.Defs[name]; ok && ref != nil {
+			s = ref
+		} else {
+			v.fail(at, "unresolvable reference %s", s.Ref)
+			return
+		}
+	}
+	if len(s.Type) > 0 && !slices.ContainsFunc(s.Type, func(t string) bool { return hasSchemaType(value, t) }) {
+		v.fail(at, "expected %s, got %s", strings.Join(s.Type, " or "), schemaTypeOf(value))
+		return
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return reflect.DeepEqual(e, value) }) {
+		v.fail(at, "%v is not one of %v", value, s.Enum)
+	}
+	switch val := value.(type) {
+	case float64:
+		if s.Minimum != nil && val < *s.Minimum {
+			v.fail(at, "%v is less than %v", val, *s.Minimum)
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range val {
+				v.validate(item, s.Items, fmt.Sprintf("%s[%d]", at, i))
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := val[name]; !ok {
+				v.fail(at, "missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := s.Properties[name]; ok {
+				v.validate(val[name], prop, at+"."+name)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				v.fail(at, "unexpected property %q", name)
+			}
+		}
+	}
+}
+
+// hasSchemaType reports whether a decoded JSON value is of the JSON Schema type t.
+func hasSchemaType(value any, t string) bool {
+	if t == "integer" {
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	}
+	return schemaTypeOf(value) == t
+}
+
+// schemaTypeOf names the JSON Schema type of a decoded JSON value.
+func schemaTypeOf(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// validateFile checks the json output at path against the embedded schema.
+func validateFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return validateCodemap(data)
+}
@@ -0,0 +1,806 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// exportResult streams the result in the format named by the "format" query parameter
+// (json by default) as a file download.
+func exportResult(w http.ResponseWriter, r *http.Request, result *Result) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	writer, err := lookupOutputWriter(format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	contentType, extension := outputMediaType(writer)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="codemap-%s%s"`, format, extension))
+	if err := writer.Write(w, result); err != nil {
+		log.Printf("Warning: %s export failed: %v", format, err)
+	}
+}
+
+// callIndex answers caller and callee lookups for the API from the in-memory result.
+type callIndex struct {
+	defs    map[string]Definition
+	callers map[string][]CallSite   // Call sites of each definition
+	callees map[string][]Definition // Definitions called from each caller, sorted by ID
+}
+
+func newCallIndex(result *Result) *callIndex {
+	idx := &callIndex{defs: result.Definitions, callers: make(map[string][]CallSite), callees: make(map[string][]Definition)}
+	seen := make(map[[2]string]bool)
+	for _, m := range result.Mappings {
+		idx.callers[m.Definition.ID] = m.CallSites
+		for _, cs := range m.CallSites {
+			if key := [2]string{cs.CallerID, m.Definition.ID}; !seen[key] {
+				seen[key] = true
+				idx.callees[cs.CallerID] = append(idx.callees[cs.CallerID], m.Definition)
+			}
+		}
+	}
+	for _, defs := range idx.callees {
+		sort.Slice(defs, func(i, j int) bool { return defs[i].ID < defs[j].ID })
+	}
+	return idx
+}
+
+// known reports whether id is a definition or a caller of the analyzed code.
+func (idx *callIndex) known(id string) bool {
+	_, isDef := idx.defs[id]
+	_, isCaller := idx.callees[id]
+	return isDef || isCaller
+}
+
+// serveCallers writes the call sites of the definition named by the "id" query parameter.
+func (idx *callIndex) serveCallers(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if !idx.known(id) {
+		http.Error(w, fmt.Sprintf("unknown definition %q", id), http.StatusNotFound)
+		return
+	}
+	sites := idx.callers[id]
+	if sites == nil {
+		sites = []CallSite{}
+	}
+	writeJSONResponse(w, sites)
+}
+
+// serveCallees writes the definitions called from the function named by the "id" query parameter.
+func (idx *callIndex) serveCallees(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if !idx.known(id) {
+		http.Error(w, fmt.Sprintf("unknown definition %q", id), http.StatusNotFound)
+		return
+	}
+	defs := idx.callees[id]
+	if defs == nil {
+		defs = []Definition{}
+	}
+	writeJSONResponse(w, defs)
+}
+
+// defaultPathDepth bounds /api/path searches when no maxDepth is given.
+const defaultPathDepth = 20
+
+// pathIndex holds the forward (caller -> callees) and reverse (callee -> callers) call
+// graph for /api/path, both with sorted neighbours so that answers are stable.
+type pathIndex struct {
+	forward map[string][]string
+	reverse map[string][]string
+}
+
+func newPathIndex(result *Result) *pathIndex {
+	idx := &pathIndex{forward: buildCallGraph(result.Mappings), reverse: make(map[string][]string)}
+	for caller, callees := range idx.forward {
+		for _, callee := range callees {
+			idx.reverse[callee] = append(idx.reverse[callee], caller)
+		}
+	}
+	for _, callers := range idx.reverse {
+		sort.Strings(callers)
+	}
+	return idx
+}
+
+// shortestPath returns the IDs along a shortest call path from one definition to another,
+// of at most maxDepth calls, or nil if there is none. The search runs from both ends at
+// once, advancing the smaller frontier by one level at a time.
+func (idx *pathIndex) shortestPath(from, to string, maxDepth int) []string {
+	if from == to {
+		return []string{from}
+	}
+	prev := map[string]string{from: ""} // Caller through which each node was reached from "from"
+	next := map[string]string{to: ""}   // Callee through which each node reaches "to"
+	fwd, bwd := []string{from}, []string{to}
+	for depth := 0; depth < maxDepth && len(fwd) > 0 && len(bwd) > 0; depth++ {
+		var meet string
+		if len(fwd) <= len(bwd) {
+			fwd, meet = expandFrontier(fwd, idx.forward, prev, next)
+		} else {
+			bwd, meet = expandFrontier(bwd, idx.reverse, next, prev)
+		}
+		if meet == "" {
+			continue
+		}
+		var path []string
+		for id := meet; id != ""; id = prev[id] {
+			path = append(path, id)
+		}
+		slices.Reverse(path)
+		for id := next[meet]; id != ""; id = next[id] {
+			path = append(path, id)
+		}
+		return path
+	}
+	return nil
+}
+
+// expandFrontier visits the neighbours of every node in frontier, recording in parents the
+// node each was first reached from. It returns the next frontier, or the first node already
+// reached from the other end, which joins the two halves of a path.
+func expandFrontier(frontier []string, adjacency map[string][]string, parents, other map[string]string) ([]string, string) {
+	var nextFrontier []string
+	for _, node := range frontier {
+		for _, neighbour := range adjacency[node] {
+			if _, seen := parents[neighbour]; seen {
+				continue
+			}
+			parents[neighbour] = node
+			if _, joined := other[neighbour]; joined {
+				return nil, neighbour
+			}
+			nextFrontier = append(nextFrontier, neighbour)
+		}
+	}
+	return nextFrontier, ""
+}
+
+// servePath writes the shortest call path between the definitions named by the "from" and
+// "to" query parameters as a list of IDs, searching at most "maxDepth" calls deep.
+func (idx *pathIndex) servePath(w http.ResponseWriter, r *http.Request, calls *callIndex) {
+	query := r.URL.Query()
+	from, to := query.Get("from"), query.Get("to")
+	for _, id := range []string{from, to} {
+		if !calls.known(id) {
+			http.Error(w, fmt.Sprintf("unknown definition %q", id), http.StatusNotFound)
+			return
+		}
+	}
+	maxDepth := defaultPathDepth
+	if raw := query.Get("maxDepth"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid maxDepth %q", raw), http.StatusBadRequest)
+			return
+		}
+		maxDepth = n
+	}
+	path := idx.shortestPath(from, to, maxDepth)
+	if path == nil {
+		http.Error(w, fmt.Sprintf("no call path from %q to %q within %d calls", from, to, maxDepth), http.StatusNotFound)
+		return
+	}
+	writeJSONResponse(w, path)
+}
+
+// defaultNeighbourhoodDepth is the number of calls /api/codemap follows from a root when no
+// depth is given.
+const defaultNeighbourhoodDepth = 2
+
+// neighbourhood returns the definitions reachable from root within depth calls, following
+// callees when forward is set and callers when reverse is set. Both directions are searched
+// separately, so the other callers of root's callees aren't included.
+func (idx *pathIndex) neighbourhood(root string, depth int, forward, reverse bool) map[string]bool {
+	reached := map[string]bool{root: true}
+	var directions []map[string][]string
+	if forward {
+		directions = append(directions, idx.forward)
+	}
+	if reverse {
+		directions = append(directions, idx.reverse)
+	}
+	for _, adjacency := range directions {
+		seen := map[string]bool{root: true}
+		frontier := []string{root}
+		for d := 0; d < depth && len(frontier) > 0; d++ {
+			var next []string
+			for _, id := range frontier {
+				for _, neighbour := range adjacency[id] {
+					if !seen[neighbour] {
+						seen[neighbour] = true
+						reached[neighbour] = true
+						next = append(next, neighbour)
+					}
+				}
+			}
+			frontier = next
+		}
+	}
+	return reached
+}
+
+// serveCodemap writes the mappings of the visualizer. Without a "root" query parameter
+// that's the whole output file. With one, only the definitions within "depth" calls of root
+// are kept, following its callees, its callers or both as chosen by "dir" (callees,
+// callers or both, the default), along with the call sites between them. Either is gzip
+// compressed for clients that accept it.
+func serveCodemap(w http.ResponseWriter, r *http.Request, jsonFile string, result *Result, paths *pathIndex, calls *callIndex) {
+	query := r.URL.Query()
+	root := query.Get("root")
+	if root == "" {
+		f, err := os.Open(jsonFile)
+		if err != nil {
+			log.Printf("Warning: could not open %s: %v", jsonFile, err)
+			http.Error(w, "codemap not available", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/json")
+		w, done := compressResponse(w, r)
+		defer done()
+		if _, err := io.Copy(w, f); err != nil {
+			log.Printf("Warning: could not write response: %v", err)
+		}
+		return
+	}
+	if !calls.known(root) {
+		http.Error(w, fmt.Sprintf("unknown definition %q", root), http.StatusNotFound)
+		return
+	}
+	depth := defaultNeighbourhoodDepth
+	if raw := query.Get("depth"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid depth %q", raw), http.StatusBadRequest)
+			return
+		}
+		depth = n
+	}
+	var forward, reverse bool
+	switch dir := query.Get("dir"); dir {
+	case "", "both":
+		forward, reverse = true, true
+	case "callees":
+		forward = true
+	case "callers":
+		reverse = true
+	default:
+		http.Error(w, fmt.Sprintf("invalid dir %q, want callees, callers or both", dir), http.StatusBadRequest)
+		return
+	}
+	reached := paths.neighbourhood(root, depth, forward, reverse)
+	subset := []Mapping{}
+	for _, m := range result.Mappings {
+		if !reached[m.Definition.ID] {
+			continue
+		}
+		kept := []CallSite{}
+		for _, cs := range m.CallSites {
+			if reached[cs.CallerID] {
+				kept = append(kept, cs)
+			}
+		}
+		if len(kept) > 0 || m.Definition.ID == root {
+			m.CallSites = kept
+			subset = append(subset, m)
+		}
+	}
+	w, done := compressResponse(w, r)
+	defer done()
+	writeJSONResponse(w, subset)
+}
+
+// compressResponse returns a writer that gzip-compresses the body when the client accepts
+// it, and the function that flushes the compressed stream once the body is written. Errors
+// must be written to the original writer, before this is called.
+func compressResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		return w, func() {}
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	gz := gzip.NewWriter(w)
+	return gzipResponseWriter{ResponseWriter: w, gz: gz}, func() {
+		if err := gz.Close(); err != nil {
+			log.Printf("Warning: could not write response: %v", err)
+		}
+	}
+}
+
+// gzipResponseWriter sends the body written to it through a gzip stream.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w gzipResponseWriter) Write(p []byte) (int, error) { return w.gz.Write(p) }
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows a gzip response.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		// "gzip;q=0" explicitly refuses it.
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// defaultSearchLimit caps /api/search results when no limit is given.
+const defaultSearchLimit = 50
+
+// searchEntry is a definition with the lowercased text /api/search matches against.
+type searchEntry struct {
+	def  Definition
+	text string // Name, package and ID, lowercased
+}
+
+// searchIndex holds every definition sorted by name for /api/search.
+type searchIndex []searchEntry
+
+func newSearchIndex(defs map[string]Definition) searchIndex {
+	idx := make(searchIndex, 0, len(defs))
+	for _, def := range defs {
+		idx = append(idx, searchEntry{def: def, text: strings.ToLower(def.Name + "\x00" + def.Package + "\x00" + def.ID)})
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		if idx[i].def.Name != idx[j].def.Name {
+			return idx[i].def.Name < idx[j].def.Name
+		}
+		return idx[i].def.ID < idx[j].def.ID
+	})
+	return idx
+}
+
+// serveSearch writes the definitions whose name, package or ID contains the "q" query
+// parameter, ignoring case, sorted by name. "kind" keeps only methods ("method") or only
+// functions and constructors ("func"); "limit" caps the number of results.
+func (idx searchIndex) serveSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.ToLower(query.Get("q"))
+	kind := query.Get("kind")
+	if kind != "" && kind != "func" && kind != "method" {
+		http.Error(w, fmt.Sprintf("invalid kind %q, want func or method", kind), http.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", raw), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	matches := []Definition{}
+	for _, entry := range idx {
+		if len(matches) == limit {
+			break
+		}
+		if kind != "" && (entry.def.Kind == "method") != (kind == "method") {
+			continue
+		}
+		if strings.Contains(entry.text, q) {
+			matches = append(matches, entry.def)
+		}
+	}
+	writeJSONResponse(w, matches)
+}
+
+// defaultTopLimit is the number of definitions /api/top returns when no n is given.
+const defaultTopLimit = 20
+
+// topEntry is one of the most-called definitions returned by /api/top.
+type topEntry struct {
+	Definition  Definition `json:"definition"`
+	CallCount   int        `json:"callCount"`
+	CallerCount int        `json:"callerCount"`
+}
+
+// topIndex holds the called definitions sorted by call count, then by distinct callers.
+type topIndex []topEntry
+
+func newTopIndex(result *Result) topIndex {
+	idx := make(topIndex, 0, len(result.Mappings))
+	for _, m := range result.Mappings {
+		if m.CallCount > 0 {
+			idx = append(idx, topEntry{Definition: m.Definition, CallCount: m.CallCount, CallerCount: m.CallerCount})
+		}
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		if idx[i].CallCount != idx[j].CallCount {
+			return idx[i].CallCount > idx[j].CallCount
+		}
+		if idx[i].CallerCount != idx[j].CallerCount {
+			return idx[i].CallerCount > idx[j].CallerCount
+		}
+		return idx[i].Definition.ID < idx[j].Definition.ID
+	})
+	return idx
+}
+
+// serveTop writes the "n" most-called definitions, most calls first.
+func (idx topIndex) serveTop(w http.ResponseWriter, r *http.Request) {
+	n := defaultTopLimit
+	if raw := r.URL.Query().Get("n"); raw != "" {
+		var err error
+		if n, err = strconv.Atoi(raw); err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid n %q", raw), http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSONResponse(w, idx[:min(n, len(idx))])
+}
+
+// fileIndex answers /api/file from the file index of the result.
+type fileIndex map[string]*FileEntry
+
+// serveFile writes the definitions and call sites of the file named by the "path" query
+// parameter, a slash-separated path relative to its target root.
+func (idx fileIndex) serveFile(w http.ResponseWriter, r *http.Request) {
+	filePath := r.URL.Query().Get("path")
+	if filePath == "" {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+	entry, ok := idx[filePath]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown file %q", filePath), http.StatusNotFound)
+		return
+	}
+	writeJSONResponse(w, entry)
+}
+
+// maxAnalyzeBody caps the size of a /api/analyze request body.
+const maxAnalyzeBody = 10 << 20
+
+// analyzeRequest is the body of POST /api/analyze: a Go source, typically an unsaved editor
+// buffer, and the path of its file, absolute or relative to -path.
+type analyzeRequest struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// analyzeResponse is what /api/analyze found in a single source.
+type analyzeResponse struct {
+	Definitions []Definition `json:"definitions"`
+	CallSites   []CallSite   `json:"callSites"`
+	Unresolved  int          `json:"unresolved"`           // Calls to nothing defined in the source or the analysis
+	ParseError  string       `json:"parseError,omitempty"` // Set when only part of the source could be parsed
+}
+
+// serveAnalyze runs both passes on the posted source and links its calls to the definitions
+// of the source itself and of the analysis. The analysis isn't changed: each request parses
+// into its own FileSet and collects into its own records, and the passes read the state kept
+// in result rather than the globals, so requests can run concurrently with each other and
+// with a -watch rebuild.
+// Init functions keep the position-based ID Pass 1 gives them, since the other init
+// functions of their package aren't looked at.
+func serveAnalyze(w http.ResponseWriter, r *http.Request, result *Result) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var req analyzeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAnalyzeBody)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+	target, filePath := sourceTarget(result, req.Path)
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, filePath, req.Content, parseMode)
+	if node == nil {
+		http.Error(w, fmt.Sprintf("could not parse %s: %v", req.Path, err), http.StatusBadRequest)
+		return
+	}
+	resp := analyzeResponse{CallSites: []CallSite{}}
+	if err != nil {
+		resp.ParseError = err.Error()
+	}
+	state := result.passes
+	if state == nil {
+		state = &passState{opts: &Options{}}
+	}
+	pkgPath, relPath := packagePathFor(target, filePath)
+	pkgPath = filePackagePath(pkgPath, relPath, node)
+	var src []byte
+	if state.opts.EmbedSource {
+		src = []byte(req.Content)
+	}
+	defs := definitionsIn(node, fset, src, pkgPath, relPath, state)
+	resp.Definitions = append([]Definition{}, defs.Definitions...)
+	declared := make(map[string]bool)
+	for _, def := range defs.Definitions {
+		declared[def.ID] = true
+	}
+	for _, c := range callSitesIn(node, fset, target, pkgPath, nil, state).Calls {
+		calleeID := ""
+		for _, id := range append([]string{c.Callee}, c.Alternatives...) {
+			if _, known := result.Definitions[id]; known || declared[id] {
+				calleeID = id
+				break
+			}
+		}
+		if calleeID == "" {
+			resp.Unresolved++
+			continue
+		}
+		site := c.Site
+		site.CalleeID = calleeID
+		resp.CallSites = append(resp.CallSites, site)
+	}
+	writeJSONResponse(w, resp)
+}
+
+// sourceTarget returns the analyzed target a path posted to /api/analyze belongs to, along
+// with the path made absolute. Relative paths, and absolute ones outside every target,
+// belong to the main target. A path inside nested modules belongs to the innermost one.
+func sourceTarget(result *Result, p string) (AnalysisTarget, string) {
+	targets := result.Metadata.Targets
+	if len(targets) == 0 {
+		return AnalysisTarget{}, p
+	}
+	if !filepath.IsAbs(p) {
+		return targets[0], filepath.Join(targets[0].FSRoot, p)
+	}
+	best, found := targets[0], false
+	for _, target := range targets {
+		if target.FSRoot == "" {
+			continue // Redacted
+		}
+		rel, err := filepath.Rel(target.FSRoot, p)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if !found || len(target.FSRoot) > len(best.FSRoot) {
+			best, found = target, true
+		}
+	}
+	return best, p
+}
+
+// writeJSONResponse writes v as the JSON body of a response.
+func writeJSONResponse(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Warning: could not write response: %v", err)
+	}
+}
+
+// serveFilteredGraph writes the graph of the result restricted by the "package" and
+// "minFanIn" query parameters, so the browser doesn't have to load the whole map. Filters
+// the analysis doesn't record ("label", "maxComplexity") are rejected rather than ignored.
+func serveFilteredGraph(w http.ResponseWriter, r *http.Request, result *Result) {
+	query := r.URL.Query()
+	for _, name := range []string{"label", "maxComplexity"} {
+		if query.Get(name) != "" {
+			http.Error(w, fmt.Sprintf("filter %q is not supported: the analysis doesn't record it", name), http.StatusBadRequest)
+			return
+		}
+	}
+	filter := GraphFilter{Package: query.Get("package")}
+	if raw := query.Get("minFanIn"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid minFanIn %q", raw), http.StatusBadRequest)
+			return
+		}
+		filter.MinFanIn = n
+	}
+	writeJSONResponse(w, filterGraph(buildGraph(result), filter))
+}
+
+// streamProgress sends the analysis progress as Server-Sent Events until the client goes
+// away. Each event is named after its type and carries a ProgressEvent as JSON data.
+func streamProgress(w http.ResponseWriter, r *http.Request, hub *progressHub) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	events, unsubscribe := hub.Subscribe()
+	defer unsubscribe()
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			// A comment line keeps proxies from closing an idle stream.
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case ev := <-events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("Warning: could not encode progress event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// normalizeBasePath turns a -base-path value into "" or a "/prefix" without trailing slash.
+func normalizeBasePath(basePath string) string {
+	basePath = "/" + strings.Trim(basePath, "/")
+	if basePath == "/" {
+		return ""
+	}
+	return basePath
+}
+
+// newVizHandler returns the visualization server's routes. When basePath is set
+// (e.g. "/codemapper"), every route, including the static assets, is mounted below it.
+// result is the in-memory analysis, used by the endpoints that don't just serve jsonFile.
+func newVizHandler(jsonFile, vizDir, basePath string, result *Result) http.Handler {
+	basePath = normalizeBasePath(basePath)
+	mux := http.NewServeMux()
+	calls := newCallIndex(result)
+	search := newSearchIndex(result.Definitions)
+	top := newTopIndex(result)
+	paths := newPathIndex(result)
+	files := fileIndex(buildFileIndex(result))
+	mux.HandleFunc("/api/codemap", func(w http.ResponseWriter, r *http.Request) {
+		serveCodemap(w, r, jsonFile, result, paths, calls)
+	})
+	mux.HandleFunc("/api/export", func(w http.ResponseWriter, r *http.Request) {
+		exportResult(w, r, result)
+	})
+	mux.HandleFunc("/api/graph", func(w http.ResponseWriter, r *http.Request) {
+		serveFilteredGraph(w, r, result)
+	})
+	mux.HandleFunc("/api/callers", calls.serveCallers)
+	mux.HandleFunc("/api/callees", calls.serveCallees)
+	mux.HandleFunc("/api/search", search.serveSearch)
+	mux.HandleFunc("/api/top", top.serveTop)
+	mux.HandleFunc("/api/path", func(w http.ResponseWriter, r *http.Request) {
+		paths.servePath(w, r, calls)
+	})
+	mux.HandleFunc("/api/file", files.serveFile)
+	mux.HandleFunc("/api/analyze", func(w http.ResponseWriter, r *http.Request) {
+		serveAnalyze(w, r, result)
+	})
+	mux.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		streamProgress(w, r, progress)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, r, result)
+	})
+	fs := http.FileServer(http.Dir(vizDir))
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".css") {
+			w.Header().Set("Content-Type", "text/css")
+		} else if strings.HasSuffix(r.URL.Path, ".js") || strings.HasSuffix(r.URL.Path, ".mjs") {
+			w.Header().Set("Content-Type", "application/javascript")
+		}
+		fs.ServeHTTP(w, r)
+	}))
+
+	if basePath == "" {
+		return mux
+	}
+	root := http.NewServeMux()
+	root.Handle(basePath+"/", http.StripPrefix(basePath, mux))
+	root.Handle(basePath, http.RedirectHandler(basePath+"/", http.StatusMovedPermanently))
+	return root
+}
+
+// serveHealth reports that the server is up along with the size of the loaded result, for
+// supervisors and orchestrators probing its liveness.
+func serveHealth(w http.ResponseWriter, r *http.Request, result *Result) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSONResponse(w, struct {
+		Status      string `json:"status"`
+		Mappings    int    `json:"mappings"`
+		Definitions int    `json:"definitions"`
+	}{"ok", len(result.Mappings), len(result.Definitions)})
+}
+
+// shutdownTimeout is how long in-flight requests may take to finish once the server is
+// asked to stop.
+const shutdownTimeout = 5 * time.Second
+
+// runVizServer serves handler on an already bound listener until ctx is cancelled, then
+// shuts down gracefully, letting in-flight requests finish for up to shutdownTimeout.
+func runVizServer(ctx context.Context, ln net.Listener, handler http.Handler) error {
+	// Requests inherit ctx so long-lived ones such as /api/events end on shutdown.
+	srv := &http.Server{Handler: handler, BaseContext: func(net.Listener) context.Context { return ctx }}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+		if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
+
+// liveHandler serves the handler built for the latest result, so -watch can swap in a new
+// result without restarting the server.
+type liveHandler struct {
+	current atomic.Pointer[http.Handler]
+}
+
+func (h *liveHandler) Store(handler http.Handler) { h.current.Store(&handler) }
+
+func (h *liveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*h.current.Load()).ServeHTTP(w, r)
+}
+
+// serveVisualization starts a web server on addr to display the results and blocks until
+// the process is interrupted. result is only used to log the size of the data served.
+func serveVisualization(addr, basePath string, handler http.Handler, result *Result) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatalf("Server failed: %v", err)
+	}
+	log.Printf("Starting visualization server at http://localhost%s%s/", addr, normalizeBasePath(basePath))
+	log.Printf("Listening on %s, serving %d mappings of %d definitions", ln.Addr(), len(result.Mappings), len(result.Definitions))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := runVizServer(ctx, ln, handler); err != nil {
+		fatalf("Server failed: %v", err)
+	}
+	log.Println("Visualization server stopped")
+}
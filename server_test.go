@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// serverFixture analyzes a small module and returns the result with the json output file
+// written for it, as the server is started.
+func serverFixture(t *testing.T) (*Result, string) {
+	t.Helper()
+	dir := writeModule(t, map[string]string{
+		"go.mod":  "module example.com/srv\n\ngo 1.23.0\n",
+		"main.go": "package main\n\nfunc leaf() {}\n\nfunc mid() { leaf() }\n\nfunc main() { mid() }\n",
+	})
+	result := analyzeModule(t, dir, Options{})
+	jsonFile := filepath.Join(t.TempDir(), "codemap.json")
+	if err := writeOutputFile(jsonFile, "json", result); err != nil {
+		t.Fatal(err)
+	}
+	return result, jsonFile
+}
+
+func TestServeCodemap(t *testing.T) {
+	result, jsonFile := serverFixture(t)
+	handler := newVizHandler(jsonFile, t.TempDir(), "", result)
+	want, err := os.ReadFile(jsonFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/codemap", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	if rec.Body.String() != string(want) {
+		t.Errorf("body differs from the output file:\n%s\nwant:\n%s", rec.Body, want)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/codemap?root=example.com/srv.mid&dir=callees&depth=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d with root, want 200", rec.Code)
+	}
+	var subset []Mapping
+	if err := json.Unmarshal(rec.Body.Bytes(), &subset); err != nil {
+		t.Fatal(err)
+	}
+	// The root is kept, without the call from main, which is out of reach.
+	if len(subset) != 2 || subset[0].Definition.ID != "example.com/srv.leaf" || subset[1].Definition.ID != "example.com/srv.mid" || len(subset[1].CallSites) != 0 {
+		t.Errorf("callees of mid: got %+v, want leaf and mid without call sites", subset)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/codemap?root=example.com/srv.missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d for an unknown root, want 404", rec.Code)
+	}
+}
+
+// rebuildWhile runs Analyze on the fixture module with o a few times in the background, as
+// -watch does, and calls serve until the runs are over, then once more.
+func rebuildWhile(t *testing.T, result *Result, o Options, serve func()) {
+	t.Helper()
+	o.TargetPath = result.Metadata.Targets[0].FSRoot
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			if _, err := Analyze(o); err != nil {
+				t.Errorf("Analyze: %v", err)
+				return
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		serve()
+	}
+}
+
+func TestHandlerKeepsOptionsDuringRebuild(t *testing.T) {
+	result, jsonFile := serverFixture(t)
+	handler := newVizHandler(jsonFile, t.TempDir(), "", result)
+	rebuildWhile(t, result, Options{Root: "example.com/srv.leaf"}, func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/export?format=graph", nil))
+		var graph Graph
+		if err := json.Unmarshal(rec.Body.Bytes(), &graph); err != nil {
+			t.Fatal(err)
+		}
+		// The rebuild's -root must not limit the graph of the result being served.
+		if len(graph.Nodes) != 3 {
+			t.Fatalf("graph of the served result has %d nodes, want 3", len(graph.Nodes))
+		}
+	})
+}
+
+func TestAnalyzeEndpointDuringRebuild(t *testing.T) {
+	result, jsonFile := serverFixture(t)
+	handler := newVizHandler(jsonFile, t.TempDir(), "", result)
+	body := `{"path": "extra.go", "content": "package main\n\nfunc extra() { leaf() }\n"}`
+	rebuildWhile(t, result, Options{EmbedSource: true}, func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/analyze", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		var resp analyzeResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Definitions) != 1 || len(resp.CallSites) != 1 || resp.CallSites[0].CalleeID != "example.com/srv.leaf" {
+			t.Fatalf("got %+v, want extra calling leaf", resp)
+		}
+		// The rebuild's -embed-source must not apply to the requests of the served result.
+		if resp.Definitions[0].Source != "" {
+			t.Fatalf("source embedded without -embed-source: %q", resp.Definitions[0].Source)
+		}
+	})
+}
+
+func TestBasePath(t *testing.T) {
+	result, jsonFile := serverFixture(t)
+	handler := newVizHandler(jsonFile, "visualizer", "/codemapper/", result)
+	serve := func(ctx context.Context, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx))
+		return rec
+	}
+
+	if rec := serve(context.Background(), "/codemapper"); rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/codemapper/" {
+		t.Errorf("/codemapper: status %d to %q, want a redirect to /codemapper/", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := serve(context.Background(), "/api/codemap"); rec.Code != http.StatusNotFound {
+		t.Errorf("/api/codemap outside the base path: status %d, want 404", rec.Code)
+	}
+
+	// Every URL the page and the app load is relative, so it resolves below the base path.
+	var refs []string
+	for _, src := range []struct{ file, pattern string }{
+		{"visualizer/index.html", `(?:src|href)="(\./[^"]+)"`},
+		{"visualizer/app.js", `(?:fetch|Worker|EventSource)\('([^']+)'`},
+		{"visualizer/app.js", "[`']([/.]*api/\\w+)"},
+	} {
+		data, err := os.ReadFile(src.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range regexp.MustCompile(src.pattern).FindAllStringSubmatch(string(data), -1) {
+			refs = append(refs, m[1])
+		}
+	}
+	if !slices.Contains(refs, "api/codemap") || !slices.Contains(refs, "./app.js") {
+		t.Fatalf("the visualizer's URLs weren't found: %v", refs)
+	}
+	base, _ := url.Parse("/codemapper/")
+	for _, ref := range append(refs, "") {
+		if strings.HasPrefix(ref, "/") {
+			t.Errorf("%s is absolute, so it ignores the base path", ref)
+			continue
+		}
+		u, err := url.Parse(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := base.ResolveReference(u).String()
+		// The event stream only returns once its request is done.
+		ctx, cancel := context.WithCancel(context.Background())
+		if ref == "api/events" {
+			cancel()
+		}
+		if rec := serve(ctx, target); rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", target, rec.Code)
+		}
+		cancel()
+	}
+}
+
+func TestExportDOT(t *testing.T) {
+	result, jsonFile := serverFixture(t)
+	handler := newVizHandler(jsonFile, t.TempDir(), "", result)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/export?format=dot", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/vnd.graphviz" {
+		t.Errorf("Content-Type %q, want text/vnd.graphviz", ct)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="codemap-dot.dot"` {
+		t.Errorf("Content-Disposition %q", cd)
+	}
+	var want bytes.Buffer
+	if err := writeDOT(&want, result); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "digraph") || rec.Body.String() != want.String() {
+		t.Errorf("body isn't the dot output:\n%s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/export?format=nope", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d for an unknown format, want 400", rec.Code)
+	}
+}
+
+func TestProgressEvents(t *testing.T) {
+	hub := newProgressHub()
+	hub.StartPhase("definitions")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streamProgress(w, r, hub)
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	next := func() (string, ProgressEvent) {
+		t.Helper()
+		var name string
+		var ev ProgressEvent
+		for lines.Scan() {
+			line := lines.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+					t.Fatal(err)
+				}
+			case line == "" && name != "":
+				return name, ev
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return "", ev
+	}
+
+	// The phase started before subscribing is replayed first, so the subscription is in
+	// place once it arrives.
+	if name, ev := next(); name != progressPhase || ev.Phase != "definitions" {
+		t.Errorf("first event = %s %+v, want the definitions phase", name, ev)
+	}
+	hub.FileDone("example.com/srv")
+	want := ProgressEvent{Type: progressFile, Phase: "definitions", Target: "example.com/srv", FilesParsed: 1}
+	if name, ev := next(); name != progressFile || ev != want {
+		t.Errorf("second event = %s %+v, want %+v", name, ev, want)
+	}
+}
+
+func TestGraphPackageFilter(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod":         "module example.com/gf\n\ngo 1.21\n",
+		"store/store.go": "package store\n\nfunc load() {}\n\nfunc Get() { load() }\n",
+		"api/api.go":     "package api\n\nimport \"example.com/gf/store\"\n\nfunc Handle() { store.Get() }\n",
+		"main.go":        "package main\n\nimport \"example.com/gf/api\"\n\nfunc main() { api.Handle() }\n",
+	})
+	result := analyzeModule(t, dir, Options{})
+	jsonFile := filepath.Join(t.TempDir(), "codemap.json")
+	if err := writeOutputFile(jsonFile, "json", result); err != nil {
+		t.Fatal(err)
+	}
+	handler := newVizHandler(jsonFile, t.TempDir(), "", result)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/graph?package=example.com/gf/store", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	var g Graph
+	if err := json.Unmarshal(rec.Body.Bytes(), &g); err != nil {
+		t.Fatal(err)
+	}
+	var nodes, edges []string
+	for _, n := range g.Nodes {
+		nodes = append(nodes, n.ID)
+	}
+	for _, e := range g.Edges {
+		edges = append(edges, e.Source+" -> "+e.Target)
+	}
+	slices.Sort(nodes)
+	slices.Sort(edges)
+	if want := []string{"example.com/gf/store.Get", "example.com/gf/store.load"}; !slices.Equal(nodes, want) {
+		t.Errorf("nodes = %v, want %v", nodes, want)
+	}
+	// The call from api into the package is kept; main -> api.Handle touches no kept node.
+	want := []string{"example.com/gf/api.Handle -> example.com/gf/store.Get", "example.com/gf/store.Get -> example.com/gf/store.load"}
+	if !slices.Equal(edges, want) {
+		t.Errorf("edges = %v, want %v", edges, want)
+	}
+
+	for _, query := range []string{"label=db", "maxComplexity=5"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/graph?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestServedOutputDuringRewrite(t *testing.T) {
+	result, jsonFile := serverFixture(t)
+	// A large output keeps each rewrite in progress long enough for requests to overlap it.
+	big := *result
+	big.Mappings = nil
+	for i := 0; i < 1000; i++ {
+		big.Mappings = append(big.Mappings, result.Mappings...)
+	}
+	if err := writeOutputFile(jsonFile, "json", &big); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(jsonFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newVizHandler(jsonFile, t.TempDir(), "", result)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			if err := writeOutputFile(jsonFile, "json", &big); err != nil {
+				t.Errorf("rewrite: %v", err)
+				return
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/codemap", nil))
+		if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), want) {
+			t.Errorf("status %d, served %d bytes during a rewrite, want the %d of the complete file", rec.Code, rec.Body.Len(), len(want))
+			break
+		}
+	}
+	<-done
+	entries, err := os.ReadDir(filepath.Dir(jsonFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("output directory holds %d files, want only the output without temporary files", len(entries))
+	}
+}
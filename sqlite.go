@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	_ "modernc.org/sqlite" // Pure Go driver, registered as "sqlite"
+)
+
+func init() {
+	RegisterOutputWriter("sqlite", formatWriter{writeSQLite, "application/vnd.sqlite3", ".db"})
+}
+
+// sqliteSchema creates the tables written by the sqlite format. call_sites is indexed on
+// both ends so callers and callees can be queried without a full scan.
+const sqliteSchema = `
+CREATE TABLE definitions (
+	id        TEXT PRIMARY KEY,
+	name      TEXT NOT NULL,
+	package   TEXT NOT NULL,
+	file_path TEXT NOT NULL,
+	line      INTEGER NOT NULL,
+	kind      TEXT NOT NULL
+);
+CREATE TABLE call_sites (
+	callee_id TEXT NOT NULL,
+	caller_id TEXT NOT NULL,
+	file_path TEXT NOT NULL,
+	line      INTEGER NOT NULL
+);
+CREATE TABLE mappings (
+	definition_id     TEXT PRIMARY KEY,
+	call_site_count   INTEGER NOT NULL,
+	caller_file_count INTEGER NOT NULL
+);
+CREATE INDEX call_sites_callee_id ON call_sites (callee_id);
+CREATE INDEX call_sites_caller_id ON call_sites (caller_id);
+`
+
+// writeSQLite writes the result as an SQLite database for ad-hoc SQL queries on maps too
+// large for JSON. SQLite needs a file to work on, so the database is built in a temporary
+// file and then copied to w.
+func writeSQLite(w io.Writer, result *Result) error {
+	dir, err := os.MkdirTemp("", "codemapper-sqlite")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "codemap.db")
+	if err := buildSQLite(dbPath, result); err != nil {
+		return err
+	}
+	f, err := os.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// buildSQLite creates the database at dbPath and fills it in a single transaction.
+func buildSQLite(dbPath string, result *Result) error {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return fmt.Errorf("creating tables: %w", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ids := make([]string, 0, len(result.Definitions))
+	for id := range result.Definitions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		def := result.Definitions[id]
+		if _, err := tx.Exec(`INSERT INTO definitions (id, name, package, file_path, line, kind) VALUES (?, ?, ?, ?, ?, ?)`,
+			def.ID, def.Name, def.Package, def.FilePath, def.Line, def.Kind); err != nil {
+			return fmt.Errorf("inserting definition %s: %w", def.ID, err)
+		}
+	}
+	for _, m := range result.Mappings {
+		total := len(m.CallSites)
+		if m.Truncated {
+			total = m.TotalCallSites
+		}
+		if _, err := tx.Exec(`INSERT INTO mappings (definition_id, call_site_count, caller_file_count) VALUES (?, ?, ?)`,
+			m.Definition.ID, total, m.CallerFileCount); err != nil {
+			return fmt.Errorf("inserting mapping %s: %w", m.Definition.ID, err)
+		}
+		for _, cs := range m.CallSites {
+			if _, err := tx.Exec(`INSERT INTO call_sites (callee_id, caller_id, file_path, line) VALUES (?, ?, ?, ?)`,
+				cs.CalleeID, cs.CallerID, cs.FilePath, cs.Line); err != nil {
+				return fmt.Errorf("inserting call site of %s: %w", m.Definition.ID, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
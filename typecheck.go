@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checkedPackage is an analyzed package type-checked for -types. files holds the ASTs the
+// types.Info refers to, keyed by file path, so Pass 2 walks those exact nodes.
+type checkedPackage struct {
+	pkg   *types.Package
+	info  *types.Info
+	files map[string]*ast.File
+}
+
+// typeChecker type-checks analyzed packages from source on demand and serves as the importer
+// for the packages they import. Standard library packages come from the compiler's export
+// data; other packages that aren't analyzed can't be imported, which only leaves the values
+// of their types unresolved.
+type typeChecker struct {
+	targets      []AnalysisTarget
+	buildContext *build.Context             // Of -tags and -env, nil for the default one
+	packages     map[string]*checkedPackage // By import path; nil while the package is being checked
+	stdlib       types.Importer
+}
+
+// typesChecker is the checker of the current run, set by Analyze when -types is on.
+var typesChecker *typeChecker
+
+func newTypeChecker(targets []AnalysisTarget, buildContext *build.Context) *typeChecker {
+	return &typeChecker{targets: targets, buildContext: buildContext, packages: make(map[string]*checkedPackage), stdlib: importer.Default()}
+}
+
+// Import implements types.Importer.
+func (c *typeChecker) Import(importPath string) (*types.Package, error) {
+	if isStdlibPath(importPath) {
+		return c.stdlib.Import(importPath)
+	}
+	for _, target := range c.targets {
+		if importPath != target.ModulePath && !strings.HasPrefix(importPath, target.ModulePath+"/") {
+			continue
+		}
+		if target.SinglePackage && importPath != target.ModulePath {
+			continue
+		}
+		dir := filepath.Join(target.FSRoot, filepath.FromSlash(strings.TrimPrefix(importPath, target.ModulePath)))
+		if cp := c.check(importPath, dir, target.FileSet); cp != nil {
+			return cp.pkg, nil
+		}
+	}
+	return nil, errors.New("package is not analyzed")
+}
+
+// packageFor returns the type-checked package containing filePath, or nil if it couldn't be checked.
+func (c *typeChecker) packageFor(target AnalysisTarget, filePath string) *checkedPackage {
+	pkgPath, _ := packagePathFor(target, filePath)
+	return c.check(pkgPath, filepath.Dir(filePath), target.FileSet)
+}
+
+// check type-checks the non-test files of dir as the package importPath, once, recording
+// positions in fset, the FileSet of the target the package belongs to. Type errors,
+// which are expected when dependencies aren't analyzed, are ignored: whatever could be
+// inferred is still recorded.
+func (c *typeChecker) check(importPath, dir string, fset *token.FileSet) *checkedPackage {
+	if cp, ok := c.packages[importPath]; ok {
+		return cp
+	}
+	c.packages[importPath] = nil // Breaks import cycles
+	ctx := &build.Default
+	if c.buildContext != nil {
+		ctx = c.buildContext
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	cp := &checkedPackage{files: make(map[string]*ast.File)}
+	var files []*ast.File
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if match, err := ctx.MatchFile(dir, name); err != nil || !match {
+			continue
+		}
+		filePath := filepath.Join(dir, name)
+		node, ok := astCache[filePath]
+		if !ok {
+			if node, _ = parser.ParseFile(fset, filePath, nil, parseMode); node == nil {
+				continue
+			}
+		}
+		// Files of an external test or stray package in the same directory don't belong here.
+		if len(files) > 0 && node.Name.Name != files[0].Name.Name {
+			continue
+		}
+		files = append(files, node)
+		cp.files[filePath] = node
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	cp.info = &types.Info{Uses: make(map[*ast.Ident]types.Object)}
+	conf := types.Config{Importer: c, Error: func(error) {}, FakeImportC: true}
+	cp.pkg, _ = conf.Check(importPath, fset, files, cp.info)
+	c.packages[importPath] = cp
+	return cp
+}
+
+// typesMethodID builds the Definition ID of a method from its type-checked object, in the
+// same pkg.Receiver.Method form methodID produces from the declaration, e.g. pkg.*T.Get or
+// pkg.List.Len for a List[T]. Interface methods and functions yield "".
+func typesMethodID(fn *types.Func) string {
+	fn = fn.Origin() // The generic method rather than its instantiation
+	sig, ok := fn.Type().(*types.Signature)
+	if !ok || sig.Recv() == nil || fn.Pkg() == nil {
+		return ""
+	}
+	recv := sig.Recv().Type()
+	prefix := ""
+	if ptr, ok := recv.(*types.Pointer); ok {
+		prefix, recv = "*", ptr.Elem()
+	}
+	named, ok := recv.(*types.Named)
+	if !ok {
+		return ""
+	}
+	if _, isIface := named.Underlying().(*types.Interface); isIface {
+		return ""
+	}
+	return fn.Pkg().Path() + "." + prefix + named.Obj().Name() + "." + fn.Name()
+}
+
+// typesInterfaceID returns the type ID of t if it is a named interface, or "".
+func typesInterfaceID(t types.Type) string {
+	named, ok := t.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil {
+		return ""
+	}
+	if _, isIface := named.Underlying().(*types.Interface); !isIface {
+		return ""
+	}
+	return named.Obj().Pkg().Path() + "." + named.Obj().Name()
+}
+
+// refineImplementations replaces the method-name comparison of computeTypeStats with
+// go/types for the types and interfaces of the checked packages, so that signatures,
+// pointer receivers and embedded interfaces are taken into account. Generic types and
+// interfaces, and those of packages that couldn't be checked, keep the name comparison.
+func (c *typeChecker) refineImplementations() {
+	lookup := func(td *TypeDef) types.Type {
+		cp := c.packages[td.Package]
+		if cp == nil || cp.pkg == nil {
+			return nil
+		}
+		obj, ok := cp.pkg.Scope().Lookup(td.Name).(*types.TypeName)
+		if !ok {
+			return nil
+		}
+		if named, ok := obj.Type().(*types.Named); ok && named.TypeParams().Len() > 0 {
+			return nil
+		}
+		return obj.Type()
+	}
+	ifaces := make(map[string]*types.Interface)
+	concrete := make(map[*TypeDef]types.Type)
+	for _, td := range typeDefs {
+		t := lookup(td)
+		if t == nil {
+			continue
+		}
+		if iface, ok := t.Underlying().(*types.Interface); ok {
+			if td.Kind == "interface" {
+				ifaces[td.ID] = iface
+			}
+			continue
+		}
+		concrete[td] = t
+	}
+	for td, t := range concrete {
+		asserted := make(map[string]bool)
+		for _, id := range td.AssertedInterfaces {
+			asserted[id] = true
+		}
+		var implements []string
+		for _, id := range td.Implements {
+			if _, checked := ifaces[id]; !checked || asserted[id] {
+				implements = append(implements, id)
+			}
+		}
+		for id, iface := range ifaces {
+			if asserted[id] || iface.NumMethods() == 0 {
+				continue
+			}
+			if types.Implements(t, iface) || types.Implements(types.NewPointer(t), iface) {
+				implements = append(implements, id)
+			}
+		}
+		sort.Strings(implements)
+		td.Implements = implements
+		td.SatisfiesCount = len(implements)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSatisfiesCount(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"go.mod": "module example.com/sat\n\ngo 1.23.0\n",
+		"sat.go": `package sat
+
+type Reader interface{ Read() string }
+
+type Writer interface{ Write(s string) }
+
+type File struct{}
+
+func (f *File) Read() string  { return "" }
+func (f *File) Write(s string) {}
+func (f *File) Close()         {}
+`,
+	})
+	for _, typeCheck := range []bool{false, true} {
+		result := analyzeModule(t, dir, Options{TypeCheck: typeCheck})
+		path := filepath.Join(t.TempDir(), "types.json")
+		if err := writeTypesReport(path, result.Types); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var types []TypeDef
+		if err := json.Unmarshal(data, &types); err != nil {
+			t.Fatal(err)
+		}
+		var file *TypeDef
+		for i := range types {
+			if types[i].ID == "example.com/sat.File" {
+				file = &types[i]
+			}
+		}
+		if file == nil {
+			t.Fatalf("types: File not found in %s", data)
+		}
+		if file.SatisfiesCount != 2 || file.MethodCount != 3 {
+			t.Errorf("types=%t: File satisfies %d interfaces with %d methods, want 2 with 3", typeCheck, file.SatisfiesCount, file.MethodCount)
+		}
+	}
+}
@@ -10,12 +10,22 @@ import ReactFlow, {
   Position,
 } from 'reactflow';
 
+// packageLabel shows the import path of a node, followed by the package clause name when
+// it differs from the last path element (e.g. `main` in cmd/foo).
+const packageLabel = (data) => {
+    const pkg = data.package || '';
+    if (!data.packageName || data.packageName === pkg.split('/').pop()) return pkg;
+    return `${pkg} (${data.packageName})`;
+};
+
 // Memoized CustomNode component for performance
 const CustomNode = React.memo(({ data, selected }) => {
     return React.createElement(
         'div',
         { 
-            className: `custom-node ${selected ? 'selected' : ''}`
+            className: `custom-node ${selected ? 'selected' : ''}`,
+            // The source is only there with -embed-source.
+            title: [data.doc, data.source].filter(Boolean).join('\n\n') || undefined
         },
         React.createElement(Handle, {
             type: 'target',
@@ -23,7 +33,7 @@ const CustomNode = React.memo(({ data, selected }) => {
             isConnectable: false,
             style: { background: '#555' }
         }),
-        React.createElement('div', { className: 'node-header' }, data.package),
+        React.createElement('div', { className: 'node-header' }, packageLabel(data)),
         React.createElement(
             'div',
             { className: 'node-body' },
@@ -51,6 +61,8 @@ function Flow() {
     const [isSelecting, setIsSelecting] = useState(false);
     const [selectionBox, setSelectionBox] = useState(null);
     const [selectionStart, setSelectionStart] = useState(null);
+    // Bumped on every `reload` event, which makes the data effect below fetch the map again.
+    const [reloadCount, setReloadCount] = useState(0);
     // Cache of latest node bounding rects to avoid repeated layout reads during drag
     const nodeRectsRef = useRef(new Map());
 
@@ -143,8 +155,8 @@ function Flow() {
 
         let pathNodes, pathEdges;
         
-        // Check if this is a root node (no incoming edges)
-        if (isRootNode(node.id, edges)) {
+        // Check if this is a root node (an entry point or no incoming edges)
+        if (node.data.entryPoint || isRootNode(node.id, edges)) {
             // For root nodes, highlight all forward connections
             const result = findForwardPath(node.id);
             pathNodes = result.pathNodes;
@@ -318,7 +330,7 @@ function Flow() {
 
         try {
             // Load the HTML template
-            const response = await fetch('/path-view.html');
+            const response = await fetch('path-view.html');
             if (!response.ok) {
                 throw new Error(`Failed to load template: ${response.status}`);
             }
@@ -358,7 +370,7 @@ function Flow() {
         setIsLoading(true);
         // *** THIS IS THE FIX ***
         // Load the worker from the public folder using a root-relative path.
-        const worker = new Worker('/layout.worker.js');
+        const worker = new Worker('layout.worker.js');
 
         worker.onmessage = (event) => {
             const { initialNodes, initialEdges } = event.data;
@@ -372,7 +384,7 @@ function Flow() {
             event.preventDefault();
             console.error(
                 `WORKER SCRIPT ERROR:\n` +
-                `This error usually means the worker file ('/layout.worker.js') could not be found or has a syntax error.\n`+
+                `This error usually means the worker file ('layout.worker.js') could not be found or has a syntax error.\n`+
                 `- Message: ${event.message}\n` +
                 `- Filename: ${event.filename}\n` +
                 `- Line: ${event.lineno}`
@@ -389,11 +401,19 @@ function Flow() {
 
         async function fetchData() {
             try {
-                const response = await fetch('/api/codemap');
+                // root, depth and dir in the page URL narrow the map to a neighbourhood.
+                const params = new URLSearchParams(window.location.search);
+                const query = new URLSearchParams();
+                for (const key of ['root', 'depth', 'dir']) {
+                    if (params.has(key)) query.set(key, params.get(key));
+                }
+                const response = await fetch(query.has('root') ? `api/codemap?${query}` : 'api/codemap');
                 if (!response.ok) {
                     throw new Error(`API request failed with status: ${response.status}`);
                 }
-                const mappings = await response.json();
+                const data = await response.json();
+                // The json-v2 format wraps the mappings in a document alongside the types.
+                const mappings = Array.isArray(data) ? data : data.mappings;
                 worker.postMessage(mappings);
             } catch (error) {
                 console.error("Failed to fetch API data:", error);
@@ -413,6 +433,13 @@ function Flow() {
         return () => {
             worker.terminate();
         };
+    }, [reloadCount]);
+
+    // With -watch the server sends a `reload` event whenever it rewrites the map.
+    useEffect(() => {
+        const events = new EventSource('api/events');
+        events.addEventListener('reload', () => setReloadCount(count => count + 1));
+        return () => events.close();
     }, []);
 
     if (isLoading) {
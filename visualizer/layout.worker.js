@@ -37,8 +37,12 @@ const getDagreLayout = (mappings) => {
                 id: def.id,
                 data: {
                     package: def.package,
+                    packageName: def.packageName,
                     name: def.name,
-                    filePath: `${def.filePath}:${def.line}`,
+                    filePath: def.endLine > def.line ? `${def.filePath}:${def.line}-${def.endLine}` : `${def.filePath}:${def.line}`,
+                    doc: def.doc,
+                    source: def.source,
+                    entryPoint: def.entryPoint,
                     highlighted: false,
                 },
                 position: { x: 0, y: 0 },
@@ -139,8 +143,12 @@ const getLayoutedElements = (mappings) => {
                 id: def.id,
                 data: {
                     package: def.package,
+                    packageName: def.packageName,
                     name: def.name,
-                    filePath: `${def.filePath}:${def.line}`,
+                    filePath: def.endLine > def.line ? `${def.filePath}:${def.line}-${def.endLine}` : `${def.filePath}:${def.line}`,
+                    doc: def.doc,
+                    source: def.source,
+                    entryPoint: def.entryPoint,
                     highlighted: false,
                 },
                 position: { x: 0, y: 0 },
@@ -298,6 +306,55 @@ const getLayoutedElements = (mappings) => {
     return { initialNodes, initialEdges };
 };
 
+/**
+ * Rebuilds the mappings shape from a graph without positions so the regular
+ * layout can run on it.
+ */
+const graphToMappings = (graph) => {
+    const byId = new Map(graph.nodes.map(n => [n.id, n]));
+    const mappings = new Map();
+    for (const e of graph.edges) {
+        if (e.kind && e.kind !== 'calls') continue;
+        if (!mappings.has(e.target)) {
+            const n = byId.get(e.target) || { id: e.target, name: e.target, package: '' };
+            mappings.set(e.target, {
+                definition: { id: n.id, name: n.name, package: n.package, filePath: n.filePath || '', line: n.line || 0 },
+                callSites: [],
+            });
+        }
+        const caller = byId.get(e.source);
+        mappings.get(e.target).callSites.push({ callerId: e.source, filePath: caller ? caller.filePath || '' : '', line: 0 });
+    }
+    return Array.from(mappings.values());
+};
+
+/**
+ * Converts the output of `-format graph` into ReactFlow elements. When the graph
+ * was generated with `-layout`, the server-side positions are used as-is and no
+ * layout is computed here.
+ *
+ * @param {{nodes: Array, edges: Array}} graph The graph document from the API.
+ * @returns {{initialNodes: Array, initialEdges: Array}}
+ */
+const getGraphElements = (graph) => {
+    const initialNodes = graph.nodes.map(n => ({
+        id: n.id,
+        data: {
+            package: n.package,
+            name: n.name,
+            filePath: n.line ? `${n.filePath}:${n.line}` : (n.filePath || ''),
+            highlighted: false,
+        },
+        position: n.position ? { x: n.position.x, y: n.position.y } : { x: 0, y: 0 },
+        type: 'customNode',
+    }));
+    const initialEdges = graph.edges.map(e => ({
+        id: e.kind && e.kind !== 'calls' ? `${e.source}-${e.kind}->${e.target}` : `${e.source}->${e.target}`,
+        source: e.source,
+        target: e.target,
+    }));
+    return { initialNodes, initialEdges };
+};
 
 // This is the "assistant's" main job. It waits for the manager to give it work.
 self.onmessage = (event) => {
@@ -305,7 +362,11 @@ self.onmessage = (event) => {
     const mappings = event.data;
     if (mappings) {
         // It does the heavy lifting
-        const { initialNodes, initialEdges } = getLayoutedElements(mappings);
+        const isGraph = !Array.isArray(mappings) && Array.isArray(mappings.nodes);
+        const positioned = isGraph && mappings.nodes.every(n => n.position);
+        const { initialNodes, initialEdges } = positioned
+            ? getGraphElements(mappings)
+            : getLayoutedElements(isGraph ? graphToMappings(mappings) : mappings);
 
         // It sends the results back to app.js
         self.postMessage({ initialNodes, initialEdges });
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long -watch waits after the last change before rebuilding, so that
+// saving several files or a branch switch triggers a single run.
+const watchDebounce = 300 * time.Millisecond
+
+// watchRoots returns the directories -watch observes: the analyzed targets, except the
+// dependencies read from the module cache, which don't change.
+func watchRoots(targets []AnalysisTarget, goModCache string) []string {
+	var roots []string
+	for _, target := range targets {
+		if goModCache != "" {
+			if rel, err := filepath.Rel(goModCache, target.FSRoot); err == nil && !strings.HasPrefix(rel, "..") {
+				continue
+			}
+		}
+		roots = append(roots, target.FSRoot)
+	}
+	return roots
+}
+
+// watchTargets calls rebuild whenever a source file below roots is written, created,
+// removed or renamed, once no change happened for watchDebounce. Files and directories
+// matched by -skip or the generated directory names don't trigger a rebuild, nor do the
+// files no enabled analyzer handles. It blocks until ctx is cancelled.
+func watchTargets(ctx context.Context, roots []string, o *Options, rebuild func()) error {
+	enabled, err := enabledAnalyzers(o.Languages)
+	if err != nil {
+		return err
+	}
+	skipPatterns, err := compileSkipPatterns(o.SkipPatterns)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// skipped reports whether path, below one of the roots, is left out of the analysis.
+	skipped := func(path string, isDir bool) bool {
+		for _, root := range roots {
+			rel, err := filepath.Rel(root, path)
+			if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			if isDir && (strings.HasPrefix(filepath.Base(path), ".") || slices.Contains(o.GeneratedDirs, filepath.Base(path))) {
+				return true // .git, the analysis cache and generated code
+			}
+			for _, pattern := range skipPatterns {
+				if pattern.Match(filepath.ToSlash(rel)) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	// watchTree watches dir and every directory below it that isn't skipped; fsnotify
+	// only reports changes to the direct entries of a watched directory.
+	watchTree := func(dir string) {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			if skipped(path, true) {
+				return filepath.SkipDir
+			}
+			if err := watcher.Add(path); err != nil {
+				log.Printf("Warning: could not watch %s: %v", path, err)
+			}
+			return nil
+		})
+	}
+	for _, root := range roots {
+		watchTree(root)
+	}
+	log.Printf("Watching %v for changes", roots)
+
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			log.Printf("Warning: watch error: %v", err)
+		case event := <-watcher.Events:
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if !skipped(event.Name, true) {
+						watchTree(event.Name)
+					}
+					continue
+				}
+			}
+			if event.Op == fsnotify.Chmod || skipped(event.Name, false) {
+				continue
+			}
+			dir, name := filepath.Split(event.Name)
+			if !slices.ContainsFunc(enabled, func(a Analyzer) bool { return a.Match(filepath.Clean(dir), name, o) }) {
+				continue
+			}
+			timer.Reset(watchDebounce)
+		case <-timer.C:
+			rebuild()
+		}
+	}
+}